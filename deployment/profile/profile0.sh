@@ -66,6 +66,11 @@ RCFolder:
     the path to the project's root directory
     NOTE: ending the path with a slash (/) is not required
 
+CoinSecret:
+    the cluster secret that keys the common coin, see the coin package (required, servers exit if it is empty)
+    NOTE: generate one for each deployment, e.g., head -c 32 /dev/urandom | base64, and do not commit it; anyone who
+    knows the secret can predict the coin
+
 RCLogLevel:
     warn | debug | info, only messages of and above this level will be logged
     
@@ -116,6 +121,7 @@ NetworkStartPort=28080
 
 User="$USER"
 RCFolder=~/go/src/rabia
+CoinSecret=""
 
 # Section 2. user configurations - type 2 (see comments above for their meanings)
 
@@ -215,7 +221,7 @@ load_variables_p2() {
 # export 12 variables for go programs
 export_variables() {
     export RC_Ctrl=${Controller} RC_Folder=${RCFolder} RC_LLevel=${RCLogLevel}
-    export Rabia_ClosedLoop=${Rabia_ClosedLoop}
+    export Rabia_ClosedLoop=${Rabia_ClosedLoop} Rabia_CoinSecret=${CoinSecret}
 
     export Rabia_NServers=$NServers Rabia_NFaulty=$NFaulty Rabia_NClients=$NClients Rabia_NConcurrency=$NConcurrency
     export Rabia_ClientBatchSize=$ClientBatchSize Rabia_ClientTimeout=$ClientTimeout Rabia_ClientThinkTime=$ClientThinkTime Rabia_ClientNRequests=$NClientRequests
@@ -0,0 +1,64 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+/*
+	The coin package defines the CommonCoin interface and HashCoin, the default common coin of Rabia's randomized
+	binary consensus. In a phase where no vote reaches a majority, every server sets its next state to the common
+	coin's bit, and the liveness argument requires that (1) every server obtains the same bit for the same slot and
+	phase, and (2) the bit is unpredictable to the network scheduler before the phase.
+
+	Note:
+
+	1. HashCoin derives the bit of (slot, phase) from an HMAC-SHA256 keyed with a cluster secret (Conf.CoinSecret), so
+	(1) holds trivially, and (2) holds as long as the secret is not known outside the cluster. A coin based on threshold
+	signatures or a verifiable random function can implement CommonCoin as well, which also tolerates a leaked secret
+	at the cost of an extra message exchange per flip.
+*/
+package coin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+/*
+	A CommonCoin returns a bit (0 or 1) for each (slot, phase) that is the same on every server
+*/
+type CommonCoin interface {
+	Flip(seq, phase uint32) uint32
+}
+
+/*
+	A HashCoin is a CommonCoin keyed with a cluster secret
+*/
+type HashCoin struct {
+	Key []byte
+}
+
+// Initialize a HashCoin, every server of a cluster must use the same secret
+func HashCoinInit(secret string) *HashCoin {
+	return &HashCoin{Key: []byte(secret)}
+}
+
+// Returns the lowest bit of HMAC-SHA256(Key, seq || phase)
+func (h *HashCoin) Flip(seq, phase uint32) uint32 {
+	var buf [8]byte
+	binary.BigEndian.PutUint32(buf[0:4], seq)
+	binary.BigEndian.PutUint32(buf[4:8], phase)
+	mac := hmac.New(sha256.New, h.Key)
+	_, _ = mac.Write(buf[:]) // never returns an error
+	return uint32(mac.Sum(nil)[0] & 1)
+}
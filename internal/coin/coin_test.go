@@ -0,0 +1,47 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package coin
+
+import (
+	"testing"
+)
+
+func TestHashCoin_Flip(t *testing.T) {
+	c1, c2, c3 := HashCoinInit("secret"), HashCoinInit("secret"), HashCoinInit("another secret")
+	ones, diffs := 0, 0
+	for seq := uint32(0); seq < 1000; seq++ {
+		for phase := uint32(0); phase < 4; phase++ {
+			b := c1.Flip(seq, phase)
+			if b > 1 {
+				t.Fatalf("Flip(%d, %d) = %d, want 0 or 1", seq, phase, b)
+			}
+			if b != c2.Flip(seq, phase) {
+				t.Fatalf("two coins of the same secret disagree at (%d, %d)", seq, phase)
+			}
+			if b != c3.Flip(seq, phase) {
+				diffs++
+			}
+			ones += int(b)
+		}
+	}
+	// 4000 fair flips: the num. of ones (and of disagreements with another secret) is within 2000 +- 200 w.h.p.
+	if ones < 1800 || ones > 2200 {
+		t.Errorf("%d ones out of 4000 flips, the coin is biased", ones)
+	}
+	if diffs < 1800 || diffs > 2200 {
+		t.Errorf("coins of different secrets disagree %d times out of 4000 flips", diffs)
+	}
+}
@@ -58,24 +58,69 @@ type Config struct {
 	/*
 		Peers: an array of lister address, each server uses it to contact every other server to establish TCP connections.
 	*/
+	GroupId int // the Rabia group this server belongs to (optional, 0 by default), see NGroups below
 
 	// If Role == cli, the following field should be filled
-	ProxyAddr string // the client proxy's SvrIp:ProxyPort
+	ProxyAddr  string   // the client proxy's SvrIp:ProxyPort
+	ProxyAddrs []string // if NGroups > 1: one proxy SvrIp:ProxyPort per group, in the order of group ids
 
 	// For all roles, the following fields should be filled
 	ClosedLoop bool // whether clients are closed-loop clients
 
-	NServers            int           // the num. of server instances
-	NFaulty             int           // the num. of faulty servers (< 1/2 NServers)
-	NClients            int           // the num. of clients
-	NConcurrency        int           // the num. of concurrent consensus instances (= concurrency >= 1)
-	NClientRequests     int           // the num. of requests PER client, open-loop only
-	ClientThinkTime     int           // the think time between sending two requests (ms)
-	ClientBatchSize     int           // the num. of DB operations in a client's request
-	ProxyBatchSize      int           // the num. of client requests in a consensus object
-	ProxyBatchTimeout   time.Duration // the max. time between submitting requests (ms, Millisecond)
-	NetworkBatchSize    int           // reserved
-	NetworkBatchTimeout time.Duration // reserved (ms, Millisecond)
+	NServers          int           // the num. of server instances
+	NFaulty           int           // the num. of faulty servers (< 1/2 NServers)
+	NClients          int           // the num. of clients
+	NConcurrency      int           // the num. of concurrent consensus instances (= concurrency >= 1)
+	Window            int           // the max. num. of slots that a consensus instance decides at once (>= 1)
+	Ordering          string        // the order of pending requests: "seq", "fair" (round-robin by proxy), or "time"
+	HoldDelay         time.Duration // "time" ordering only, how long a replica holds an object before proposing it (ms)
+	NClientRequests   int           // the num. of requests PER client, open-loop only
+	ClientThinkTime   int           // the think time between sending two requests (ms)
+	ClientBatchSize   int           // the num. of DB operations in a client's request
+	ProxyBatchSize    int           // the num. of client requests in a consensus object
+	ProxyBatchTimeout time.Duration // the max. time between submitting requests (ms, Millisecond)
+	ProxyBatchBytes   int           // the max. num. of command bytes in a consensus object (0: unlimited)
+	/*
+		Adaptive batching: if AdaptiveBatching is true, a proxy starts with ProxyBatchSize and ProxyBatchTimeout and
+		adjusts them within the bounds below every BatchAdaptInterval, see batcher.go in the proxy package. Otherwise,
+		the bounds equal ProxyBatchSize and ProxyBatchTimeout.
+	*/
+	AdaptiveBatching     bool
+	ProxyBatchSizeMin    int           // >= 1
+	ProxyBatchSizeMax    int           // >= ProxyBatchSize, 4 * ProxyBatchSize by default
+	ProxyBatchTimeoutMin time.Duration // (ms, Millisecond) 1 ms by default
+	ProxyBatchTimeoutMax time.Duration // (ms, Millisecond) 4 * ProxyBatchTimeout by default
+	NetworkBatchSize     int           // reserved
+	NetworkBatchTimeout  time.Duration // reserved (ms, Millisecond)
+
+	/*
+		Common coin: the servers of a cluster share CoinSecret, which keys the common coin of the consensus layer (see
+		the coin package). A server panics if it is unset, since anyone who knows the secret can predict the coin.
+	*/
+	CoinSecret string
+
+	/*
+		Handshake: each connection opens with a handshake in which the ends exchange their ClusterIds, groups, protocol
+		versions, roles, ids, and codecs (see the tcp package). Nodes refuse connections from other clusters.
+	*/
+	ClusterId string // the id of this cluster ("rabia" by default)
+
+	/*
+		Wire format: messages are serialized with Codec and framed by the message package (see codec.go and message.go
+		there). All nodes of a cluster must use the same Codec.
+	*/
+	MaxFrameSize int    // the max. length of a frame, a longer message is sent in chunks (0: unlimited), 4 MB by default
+	MaxMsgSize   int    // the max. length of a message that a reader accepts (0: unlimited), 64 MB by default
+	Codec        string // the wire codec: "gogo" (default), "proto" (vanilla protobuf), or "binary"
+
+	/*
+		Sharding: a deployment may run NGroups independent Rabia groups, each with its own NServers servers, peers, and
+		ledger. Group i owns the keys in [ShardBounds[i-1], ShardBounds[i]), where ShardBounds[-1] and
+		ShardBounds[NGroups-1] stand for the smallest and the largest keys. A client connects to one proxy per group and
+		sends each command to the group that owns its key, see the shard package.
+	*/
+	NGroups     int      // the num. of Rabia groups (optional, 1 by default, i.e., no sharding)
+	ShardBounds []string // NGroups - 1 ascending keys that split the key space into key ranges
 
 	/*
 		Sec 2. load these fields from the LoadConst function, they are not assigned from environment variables because
@@ -90,11 +135,22 @@ type Config struct {
 	LenBlockArray int    // the length of each ledger block's array
 	LenChannel    int    // the length of buffer channels (excepted the channel Q in a Block Block)
 	LenPQueue     int    // the length of each priority queue's initial capacity in a consensus instance
+	LenEarlyMsgs  int    // the max. num. of future-term messages that a consensus instance buffers per ledger entry
 	IoBufSize     int    // the size of each underlying buffer in bufio.Reader and bufio.Writer
 	TcpBufSize    int    // the size of each TCP write buffer and TCP read buffer
 	KeyLen        int    // the length of KV-store key string
 	ValLen        int    // the length of KV-store value string
 
+	WatchHistoryLen int // the num. of most recent slots whose changes a proxy retains for watches
+	WatchQueueLen   int // the max. num. of event messages queued per watch, a watch that overflows is canceled
+
+	LeaseCheckInterval time.Duration // how often a proxy checks the deadlines of leases
+	LeaseRetryInterval time.Duration // a proxy proposes an expire command again if the lease still exists after this
+
+	BatchAdaptInterval     time.Duration // how often a proxy adjusts its batch size and timeout (adaptive batching)
+	ProposalRequestTimeout time.Duration // an executor sends a ProposalRequest again if no reply comes within this
+	HandshakeTimeout       time.Duration // a node closes a connection whose handshake does not finish within this
+
 	SvrLogInterval      time.Duration // a server logger's sleep time after generating a log
 	ClientLogInterval   time.Duration // a client logger's sleep time after generating a log
 	ClientTimeout       time.Duration // closed-loop only, a client exits after ClientTimeout
@@ -120,6 +176,9 @@ func (c *Config) loadEnvVars1() {
 	c.Peers = strings.Split(os.Getenv("RC_Peers"), " ")
 
 	c.ProxyAddr = os.Getenv("RC_Proxy")
+
+	c.GroupId = getEnvIntOr("RC_Group", 0)
+	c.ProxyAddrs = strings.Fields(os.Getenv("RC_Proxies"))
 }
 
 func (c *Config) loadEnvVars2() {
@@ -132,9 +191,41 @@ func (c *Config) loadEnvVars2() {
 	Conf.NFaulty = getEnvInt("Rabia_NFaulty")
 	Conf.NClients = getEnvInt("Rabia_NClients")
 	Conf.NConcurrency = 1
+	Conf.Window = getEnvIntOr("Rabia_Window", 1)
+	if Conf.Window < 1 {
+		Conf.Window = 1
+	}
+	Conf.Ordering = os.Getenv("Rabia_Ordering")
+	if Conf.Ordering == "" {
+		Conf.Ordering = "seq"
+	} else if Conf.Ordering != "fair" && Conf.Ordering != "seq" && Conf.Ordering != "time" {
+		panic(fmt.Sprint("should not happen, unknown Rabia_Ordering ", Conf.Ordering))
+	}
+	Conf.HoldDelay = time.Duration(getEnvIntOr("Rabia_HoldDelay", 2)) * time.Millisecond
 
 	Conf.ProxyBatchSize = getEnvInt("Rabia_ProxyBatchSize")
 	Conf.ProxyBatchTimeout = time.Duration(getEnvInt("Rabia_ProxyBatchTimeout")) * time.Millisecond
+	Conf.AdaptiveBatching = strToBool(os.Getenv("Rabia_AdaptiveBatching"), false)
+	Conf.ProxyBatchSizeMin, Conf.ProxyBatchSizeMax = Conf.ProxyBatchSize, Conf.ProxyBatchSize
+	Conf.ProxyBatchTimeoutMin, Conf.ProxyBatchTimeoutMax = Conf.ProxyBatchTimeout, Conf.ProxyBatchTimeout
+	if Conf.AdaptiveBatching {
+		Conf.ProxyBatchSizeMin = getEnvIntOr("Rabia_ProxyBatchSizeMin", 1)
+		Conf.ProxyBatchSizeMax = getEnvIntOr("Rabia_ProxyBatchSizeMax", 4*Conf.ProxyBatchSize)
+		Conf.ProxyBatchTimeoutMin = time.Duration(getEnvIntOr("Rabia_ProxyBatchTimeoutMin", 1)) * time.Millisecond
+		Conf.ProxyBatchTimeoutMax = time.Duration(getEnvIntOr("Rabia_ProxyBatchTimeoutMax",
+			4*getEnvInt("Rabia_ProxyBatchTimeout"))) * time.Millisecond
+	}
+	if Conf.ProxyBatchSizeMin < 1 || Conf.ProxyBatchSizeMin > Conf.ProxyBatchSize ||
+		Conf.ProxyBatchSize > Conf.ProxyBatchSizeMax {
+		panic(fmt.Sprint("should not happen, Rabia_ProxyBatchSize is out of bounds ", Conf.ProxyBatchSizeMin, " ",
+			Conf.ProxyBatchSize, " ", Conf.ProxyBatchSizeMax))
+	}
+	if Conf.ProxyBatchTimeoutMin <= 0 || Conf.ProxyBatchTimeoutMin > Conf.ProxyBatchTimeout ||
+		Conf.ProxyBatchTimeout > Conf.ProxyBatchTimeoutMax {
+		panic(fmt.Sprint("should not happen, Rabia_ProxyBatchTimeout is out of bounds ", Conf.ProxyBatchTimeoutMin,
+			" ", Conf.ProxyBatchTimeout, " ", Conf.ProxyBatchTimeoutMax))
+	}
+	Conf.ProxyBatchBytes = getEnvIntOr("Rabia_ProxyBatchBytes", 1<<20)
 	Conf.NetworkBatchSize = getEnvInt("Rabia_NetworkBatchSize")
 	Conf.NetworkBatchTimeout = time.Duration(getEnvInt("Rabia_NetworkBatchTimeout")) * time.Millisecond
 
@@ -142,6 +233,30 @@ func (c *Config) loadEnvVars2() {
 	Conf.ClientTimeout = time.Duration(getEnvInt("Rabia_ClientTimeout")) * time.Second
 	Conf.ClientThinkTime = getEnvInt("Rabia_ClientThinkTime")
 	Conf.NClientRequests = getEnvInt("Rabia_ClientNRequests")
+
+	Conf.CoinSecret = os.Getenv("Rabia_CoinSecret")
+	if Conf.CoinSecret == "" && Conf.Role == "svr" { // clients and the controller do not flip the coin
+		panic("should not happen, Rabia_CoinSecret is unset, each deployment must set its own secret")
+	}
+	Conf.ClusterId = os.Getenv("Rabia_ClusterId")
+	if Conf.ClusterId == "" {
+		Conf.ClusterId = "rabia"
+	}
+
+	Conf.MaxFrameSize = getEnvIntOr("Rabia_MaxFrameSize", 4<<20)
+	Conf.MaxMsgSize = getEnvIntOr("Rabia_MaxMsgSize", 64<<20)
+	if Conf.MaxFrameSize < 0 || Conf.MaxFrameSize >= 1<<31 {
+		panic(fmt.Sprint("should not happen, Rabia_MaxFrameSize is out of range ", Conf.MaxFrameSize))
+	}
+	Conf.Codec = os.Getenv("Rabia_Codec")
+	if Conf.Codec == "" {
+		Conf.Codec = "gogo"
+	} else if Conf.Codec != "gogo" && Conf.Codec != "proto" && Conf.Codec != "binary" {
+		panic(fmt.Sprint("should not happen, unknown Rabia_Codec ", Conf.Codec))
+	}
+
+	Conf.NGroups = getEnvIntOr("Rabia_NGroups", 1)
+	Conf.ShardBounds = strings.Fields(os.Getenv("Rabia_ShardBounds"))
 }
 
 func (c *Config) CalcConstants() {
@@ -150,18 +265,39 @@ func (c *Config) CalcConstants() {
 	c.MajorityPlusF = c.NServers/2 + c.NFaulty + 1
 	c.FaultyPlusOne = c.NFaulty + 1
 
+	if c.NGroups < 1 {
+		c.NGroups = 1
+	}
+	if len(c.ShardBounds) != c.NGroups-1 {
+		panic(fmt.Sprint("should not happen, len(Conf.ShardBounds) != Conf.NGroups - 1 ", c.ShardBounds))
+	}
+	if c.Role == "cli" && c.NGroups > 1 && len(c.ProxyAddrs) != c.NGroups {
+		panic(fmt.Sprint("should not happen, len(Conf.ProxyAddrs) != Conf.NGroups ", c.ProxyAddrs))
+	}
+
 	if c.NClientRequests == 0 {
 		c.NClientRequests = 10000000 // the default value
 	}
 	c.LenLedger = 10000
 	c.LenBlockArray = 10
 	c.LenChannel = 500000
+	c.LenEarlyMsgs = 64
 
 	c.IoBufSize = 4096 * 4000
 	c.TcpBufSize = 7000000
 	c.KeyLen = 8
 	c.ValLen = 8
 
+	c.WatchHistoryLen = 1000
+	c.WatchQueueLen = 1024
+
+	c.LeaseCheckInterval = 50 * time.Millisecond
+	c.LeaseRetryInterval = 1 * time.Second
+
+	c.ProposalRequestTimeout = 50 * time.Millisecond
+	c.HandshakeTimeout = 5 * time.Second
+	c.BatchAdaptInterval = 200 * time.Millisecond
+
 	c.SvrLogInterval = 4 * time.Second
 	c.ClientLogInterval = 15 * time.Second
 	c.ConsensusStartAfter = 0 * time.Second // for open-loop testings
@@ -184,6 +320,14 @@ func getEnvInt(key string) int {
 	return ret
 }
 
+// Returns the integer value of an environment variable, or defaultVal if the variable is not set
+func getEnvIntOr(key string, defaultVal int) int {
+	if os.Getenv(key) == "" {
+		return defaultVal
+	}
+	return getEnvInt(key)
+}
+
 /*
 	Convert a string to an integer array
 	str: the input string, integers in the string are separated by spaces (e.g., "1 3 5 7 9")
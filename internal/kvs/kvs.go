@@ -0,0 +1,215 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+/*
+	1. Package Description
+
+	The kvs package defines the command vocabulary of Rabia's key-value store and the dictionary store (Store) that
+	executes these commands. A proxy's KVSExecutor applies every decided command to its Store in slot order, so all
+	replicas reach the same state and produce the same replies.
+
+	2. Command Format
+
+	Each command is a string of the form <operation type><key>[<argument>], where the operation type takes one byte and
+	the key takes Conf.KeyLen bytes. The argument depends on the operation type:
+
+		OpWrite       "0"  <key><value>                     sets the key's value
+		OpRead        "1"  <key>                            reads the key's value
+		OpDelete      "2"  <key>                            deletes the key
+		OpCAS         "3"  <key><field(expected)><value>    sets the key's value if its value equals expected
+		OpCASVersion  "4"  <key><field(version)><value>     sets the key's value if its version equals version
+		OpIncr        "5"  <key><delta>                     adds a signed decimal delta to the key's integer value
+		OpSetIfAbsent "6"  <key><value>                     sets the key's value if the key does not exist
+		OpTxn         "7"  see txn.go                       applies writes if all guards hold
+		OpWatch       "8"  see watch.go                     streams the changes of keys to the client
+		OpUnwatch     "9"  see watch.go                     cancels a watch
+		"a" ... "f"        see lease.go                     lease and key TTL operations
+
+	where field(x) is x prefixed by its length and a colon, e.g., field("abc") = "3:abc". The helper functions below
+	(Write, Read, Delete, CAS, ...) build well-formed commands, so callers rarely need to know about the format.
+
+	3. Reply Format
+
+	A reply starts with the operation type and the key of its command. Write and read replies are unchanged from the
+	original vocabulary ("0<key>ok" and "1<key><value>"). Replies of the other operations then carry a status, StatusOk,
+	StatusNo, or StatusNoKey, followed by an optional payload:
+
+		OpDelete      ok: the key was deleted                no: the key did not exist
+		OpCAS         ok: the value was swapped              no<current value>, or
+		                                                     nk: the key does not exist
+		OpCASVersion  ok<new version>                        no<current version>
+		OpIncr        ok<new value>                          no: the current value is not an integer, or
+		                                                     no<current value>: the sum overflows int64
+		OpSetIfAbsent ok: the value was set                  no<current value>
+
+	A malformed command or a command of an unknown operation type is answered with StatusNo after its operation type
+	and key (see Reject).
+
+	4. Versions
+
+	Store keeps a revision counter that increases by one on every mutation. A key's version is the revision at which
+	it was last modified, and a key that does not exist has version 0. Since every replica applies the same commands in
+	the same order, revisions and versions are identical on all replicas.
+*/
+package kvs
+
+import (
+	. "rabia/internal/config"
+	"strconv"
+	"strings"
+)
+
+// Operation types, the first byte of each command and reply
+const (
+	OpWrite       = "0"
+	OpRead        = "1"
+	OpDelete      = "2"
+	OpCAS         = "3"
+	OpCASVersion  = "4"
+	OpIncr        = "5"
+	OpSetIfAbsent = "6"
+)
+
+// Reply statuses of operations other than OpWrite and OpRead
+const (
+	StatusOk    = "ok"
+	StatusNo    = "no"
+	StatusNoKey = "nk" // OpCAS only, so that a missing key is told apart from a key whose value is ""
+)
+
+// Returns a command that sets key to val
+func Write(key, val string) string {
+	return OpWrite + key + val
+}
+
+// Returns a command that reads key
+func Read(key string) string {
+	return OpRead + key
+}
+
+// Returns a command that deletes key
+func Delete(key string) string {
+	return OpDelete + key
+}
+
+// Returns a command that sets key to val if key's current value equals expected
+func CAS(key, expected, val string) string {
+	return OpCAS + key + field(expected) + val
+}
+
+// Returns a command that sets key to val if key's current version equals version (0: key must not exist)
+func CASVersion(key string, version uint64, val string) string {
+	return OpCASVersion + key + field(strconv.FormatUint(version, 10)) + val
+}
+
+// Returns a command that adds delta to key's integer value (a key that does not exist counts as 0)
+func Incr(key string, delta int64) string {
+	return OpIncr + key + strconv.FormatInt(delta, 10)
+}
+
+// Returns a command that sets key to val if key does not exist
+func SetIfAbsent(key, val string) string {
+	return OpSetIfAbsent + key + val
+}
+
+/*
+	Returns the reply to a malformed or unsupported command: StatusNo after the command's operation type and key (or
+	after its operation type only, if the command accesses no key (see keyless) or is too short to hold a key).
+*/
+func Reject(cmd string) string {
+	if len(cmd) == 0 {
+		return StatusNo
+	}
+	if keyless(cmd) || len(cmd) < 1+Conf.KeyLen {
+		return cmd[0:1] + StatusNo
+	}
+	return cmd[:1+Conf.KeyLen] + StatusNo
+}
+
+/*
+	Splits a command into its operation type, key, and argument. The last return value is false if the command is
+	too short to hold an operation type and a key.
+*/
+func Parse(cmd string) (op, key, arg string, ok bool) {
+	if len(cmd) < 1+Conf.KeyLen {
+		return "", "", "", false
+	}
+	return cmd[0:1], cmd[1 : 1+Conf.KeyLen], cmd[1+Conf.KeyLen:], true
+}
+
+/*
+	Returns the keys that a command accesses, i.e., the key of a single-key command, or the keys of every guard and
+	every operation of a transaction. Returns an empty array for a keyless lease command, and nil if the command is
+	malformed or is a watch command.
+*/
+func Keys(cmd string) []string {
+	if IsWatchCmd(cmd) {
+		return nil
+	}
+	if len(cmd) != 0 && cmd[0:1] == OpTxn {
+		guards, ops, ok := parseTxn(cmd[1:])
+		if !ok {
+			return nil
+		}
+		keys := make([]string, 0, len(guards)+len(ops))
+		for _, g := range guards {
+			keys = append(keys, g.Key)
+		}
+		for _, op := range ops {
+			_, key, _, ok := Parse(op)
+			if !ok {
+				return nil
+			}
+			keys = append(keys, key)
+		}
+		return keys
+	}
+	if len(cmd) != 0 && isKeylessLeaseOp(cmd[0:1]) {
+		return []string{} // a lease is local to a group, see lease.go
+	}
+	if _, key, _, ok := Parse(cmd); ok {
+		return []string{key}
+	}
+	return nil
+}
+
+/*
+	Returns true if the command does not follow the <operation type><key>[<argument>] format, i.e., it is a
+	transaction, a watch command, or a keyless lease command
+*/
+func keyless(cmd string) bool {
+	return len(cmd) != 0 && (cmd[0:1] == OpTxn || IsWatchCmd(cmd) || isKeylessLeaseOp(cmd[0:1]))
+}
+
+// Prefixes a string with its length and a colon, see the package-level comment
+func field(s string) string {
+	return strconv.Itoa(len(s)) + ":" + s
+}
+
+/*
+	Reads a field from the front of s, returns the field and the remaining string. The last return value is false if
+	s does not start with a well-formed field.
+*/
+func nextField(s string) (string, string, bool) {
+	idx := strings.IndexByte(s, ':')
+	if idx <= 0 {
+		return "", "", false
+	}
+	n, err := strconv.Atoi(s[:idx])
+	if err != nil || n < 0 || idx+1+n > len(s) {
+		return "", "", false
+	}
+	return s[idx+1 : idx+1+n], s[idx+1+n:], true
+}
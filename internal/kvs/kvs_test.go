@@ -0,0 +1,229 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package kvs
+
+import (
+	"math"
+	"rabia/internal/config"
+	"testing"
+)
+
+func TestStore_IncrOverflow(t *testing.T) {
+	config.Conf.KeyLen = 2
+
+	s := StoreInit()
+	steps := []struct {
+		cmd, rep string
+	}{
+		{Incr("k1", math.MaxInt64), "5k1ok9223372036854775807"},
+		{Incr("k1", 1), "5k1no9223372036854775807"},
+		{Incr("k1", math.MinInt64), "5k1ok-1"},
+		{Incr("k1", math.MinInt64), "5k1no-1"},
+		{Incr("k1", math.MinInt64+1), "5k1ok-9223372036854775808"},
+		{Incr("k1", -1), "5k1no-9223372036854775808"},
+		{Incr("k1", math.MaxInt64), "5k1ok-1"},
+	}
+	for i, step := range steps {
+		if rep := s.Execute(step.cmd); rep != step.rep {
+			t.Errorf("step %d: Execute(%q) = %q, want %q", i, step.cmd, rep, step.rep)
+		}
+	}
+}
+
+func TestStore_Execute(t *testing.T) {
+	config.Conf.KeyLen = 2
+
+	s := StoreInit()
+	steps := []struct {
+		cmd, rep string
+	}{
+		{Read("k1"), "1k1"},
+		{Write("k1", "v1"), "0k1ok"},
+		{Read("k1"), "1k1v1"},
+		{CAS("k1", "v0", "v2"), "3k1nov1"},
+		{CAS("k1", "v1", "v2"), "3k1ok"},
+		{CAS("k2", "", "v2"), "3k2nk"},
+		{CASVersion("k1", 1, "v3"), "4k1no2"},
+		{CASVersion("k1", 2, "v3"), "4k1ok3"},
+		{CASVersion("k2", 0, "v2"), "4k2ok4"},
+		{SetIfAbsent("k2", "v5"), "6k2nov2"},
+		{SetIfAbsent("k3", "v3"), "6k3ok"},
+		{Incr("k4", 5), "5k4ok5"},
+		{Incr("k4", -7), "5k4ok-2"},
+		{Incr("k1", 1), "5k1no"},
+		{Delete("k1"), "2k1ok"},
+		{Delete("k1"), "2k1no"},
+		{Read("k1"), "1k1"},
+		{"3k1x:", "3k1no"},
+		{"zk1", "zk1no"},
+		{"0", "0no"},
+		{Write("k5", ""), "0k5ok"},
+		{CAS("k5", "v0", "v5"), "3k5no"}, // the value is "", unlike k2's missing value above
+		{CAS("k5", "", "v5"), "3k5ok"},
+	}
+	for i, step := range steps {
+		if rep := s.Execute(step.cmd); rep != step.rep {
+			t.Errorf("step %d: Execute(%q) = %q, want %q", i, step.cmd, rep, step.rep)
+		}
+	}
+	if s.Revision != 10 {
+		t.Errorf("Revision = %d, want 10", s.Revision)
+	}
+	if v := s.Version("k4"); v != 7 {
+		t.Errorf("Version(k4) = %d, want 7", v)
+	}
+}
+
+func TestStore_Txn(t *testing.T) {
+	config.Conf.KeyLen = 2
+
+	s := StoreInit()
+	s.Execute(Write("k1", "v1")) // revision 1
+	s.Execute(Write("k2", "v2")) // revision 2
+
+	// all guards hold, so both operations are applied
+	rep := s.Execute(Txn([]Guard{
+		{Key: "k1", Target: GuardValue, Cmp: CmpEqual, Operand: "v1"},
+		{Key: "k2", Target: GuardVersion, Cmp: CmpLess, Operand: "3"},
+		{Key: "k3", Target: GuardVersion, Cmp: CmpEqual, Operand: "0"},
+	}, []string{Write("k1", "v3"), Write("k3", "2")}))
+	status, fields, ok := ParseTxnReply(rep)
+	if !ok || !status || len(fields) != 2 || fields[0] != "0k1ok" || fields[1] != "0k3ok" {
+		t.Errorf("unexpected reply %q", rep)
+	}
+
+	// the second guard fails, so nothing is applied
+	rep = s.Execute(Txn([]Guard{
+		{Key: "k1", Target: GuardValue, Cmp: CmpNotEqual, Operand: "v1"},
+		{Key: "k2", Target: GuardValue, Cmp: CmpGreater, Operand: "v2"},
+	}, []string{Delete("k1"), Delete("k2")}))
+	status, fields, ok = ParseTxnReply(rep)
+	if !ok || status || len(fields) != 1 || fields[0] != "1" {
+		t.Errorf("unexpected reply %q", rep)
+	}
+	if s.Revision != 4 || s.Execute(Read("k1")) != "1k1v3" {
+		t.Errorf("a failed transaction changed the store")
+	}
+
+	// malformed transactions are rejected as a whole
+	for _, cmd := range []string{
+		Txn([]Guard{{Key: "k1", Target: "x", Cmp: CmpEqual}}, []string{Delete("k1")}),
+		Txn([]Guard{{Key: "k1", Target: GuardVersion, Cmp: CmpEqual, Operand: "a"}}, nil),
+		Txn(nil, []string{Delete("k1"), Txn(nil, nil)}),
+		Txn(nil, []string{Delete("k1"), Read("k2")}),
+		Txn(nil, []string{Delete("k1"), Incr("k3", 1)}),
+		Txn(nil, []string{Write("k1", "v4"), WriteLease("k2", 1, "v2")}),
+		Txn(nil, []string{Write("k1", "v4"), "0k"}),
+		Txn(nil, []string{Write("k1", "v4"), Delete("k2") + "x"}),
+		OpTxn + "1:",
+		OpTxn + "19:9223372036854775807",
+		OpTxn + "4:1000" + field("k1v=v1"),
+	} {
+		if rep := s.Execute(cmd); rep != OpTxn+StatusNo {
+			t.Errorf("Execute(%q) = %q, want %q", cmd, rep, OpTxn+StatusNo)
+		}
+	}
+	if s.Revision != 4 {
+		t.Errorf("a malformed transaction changed the store")
+	}
+}
+
+func TestStore_Events(t *testing.T) {
+	config.Conf.KeyLen = 2
+
+	s := StoreInit()
+	s.Execute(Write("k1", "v1")) // not recorded
+	s.RecordEvents = true
+	s.Execute(Write("k2", "v2"))
+	s.Execute(Txn(nil, []string{Delete("k1"), Write("k3", "1")}))
+	s.Execute(Delete("k4")) // no change
+	want := []string{Write("k2", "v2"), Delete("k1"), Write("k3", "1")}
+	events := s.TakeEvents()
+	if len(events) != len(want) {
+		t.Fatalf("TakeEvents() = %v, want %v", events, want)
+	}
+	for i, e := range events {
+		if e.String() != want[i] {
+			t.Errorf("event %d = %q, want %q", i, e.String(), want[i])
+		}
+		if parsed, ok := ParseEvent(e.String()); !ok || parsed != e {
+			t.Errorf("ParseEvent(%q) = %v, %v", e.String(), parsed, ok)
+		}
+	}
+	if len(s.TakeEvents()) != 0 {
+		t.Errorf("events are taken twice")
+	}
+
+	if prefix, seq, ok := ParseWatch(Watch("k", 42)); !ok || prefix != "k" || seq != 42 {
+		t.Errorf("ParseWatch(Watch(k, 42)) = %q, %d, %v", prefix, seq, ok)
+	}
+	if id, ok := ParseUnwatch(Unwatch(7)); !ok || id != 7 {
+		t.Errorf("ParseUnwatch(Unwatch(7)) = %d, %v", id, ok)
+	}
+	if rep := s.Execute(Watch("k", 0)); rep != OpWatch+StatusNo {
+		t.Errorf("the store executed a watch command: %q", rep)
+	}
+	if _, _, ok := ParseWatch(Watch("kkk", 0)); ok {
+		t.Errorf("a prefix longer than a key is accepted")
+	}
+}
+
+func TestStore_Leases(t *testing.T) {
+	config.Conf.KeyLen = 2
+
+	s := StoreInit()
+	s.RecordLeases = true
+	steps := []struct {
+		cmd, rep string
+	}{
+		{Grant(1000), OpGrant + "ok1"},
+		{WriteLease("k1", 1, "v1"), "ek1ok"},
+		{WriteLease("k2", 1, "v2"), "ek2ok"},
+		{WriteLease("k3", 9, "v3"), "ek3no"},
+		{Write("k2", "v3"), "0k2ok"}, // k2 keeps its lease
+		{KeepAlive(1), OpKeepAlive + "ok"},
+		{Expire(1, 0), OpExpire + "no"}, // the lease has been renewed
+		{Read("k1"), "1k1v1"},
+		{Expire(1, 1), OpExpire + "ok"},
+		{Read("k1"), "1k1"},
+		{Read("k2"), "1k2"},
+		{KeepAlive(1), OpKeepAlive + "no"},
+		{WriteTTL("k3", 500, "v3"), "fk3ok2"},
+		{Delete("k3"), "2k3ok"}, // k3 is detached from lease 2
+		{Write("k3", "v4"), "0k3ok"},
+		{Revoke(2), OpRevoke + "ok"},
+		{Read("k3"), "1k3v4"},
+		{Grant(0), OpGrant + "no"},
+		{OpExpire + "x", OpExpire + "no"},
+	}
+	for i, step := range steps {
+		if rep := s.Execute(step.cmd); rep != step.rep {
+			t.Errorf("step %d: Execute(%q) = %q, want %q", i, step.cmd, rep, step.rep)
+		}
+	}
+
+	want := []LeaseChange{{Id: 1, TTL: 1000}, {Id: 1, TTL: 1000, Epoch: 1}, {Id: 1, Deleted: true},
+		{Id: 2, TTL: 500}, {Id: 2, Deleted: true}}
+	changes := s.TakeLeaseChanges()
+	if len(changes) != len(want) {
+		t.Fatalf("TakeLeaseChanges() = %v, want %v", changes, want)
+	}
+	for i := range changes {
+		if changes[i] != want[i] {
+			t.Errorf("change %d = %v, want %v", i, changes[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,247 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package kvs
+
+import (
+	"sort"
+	"strconv"
+)
+
+/*
+	Leases and key TTLs
+
+	A lease is a time-to-live (TTL) that one or more keys are attached to. When a lease expires, the lease and all its
+	keys are deleted. Wall-clock time differs among replicas, so a replica never expires a lease on its own; instead,
+	each proxy keeps a local deadline for every lease, and when a deadline passes, the proxy proposes an expire command
+	(OpExpire) that is decided like any other command. The expire command carries the lease's epoch, which increments
+	on every keep-alive, so an expire command decided after a keep-alive of the same lease does nothing. Hence, a lease
+	expires at the same slot on every replica.
+
+	A per-key TTL (OpWriteTTL) is a write that grants a new lease and attaches the key to it.
+
+	Command format:
+		OpGrant      "a"  <ttl>                            grants a lease of ttl milliseconds
+		OpKeepAlive  "b"  <lease id>                       renews a lease, i.e., restarts its ttl
+		OpRevoke     "c"  <lease id>                       deletes a lease and its keys
+		OpExpire     "d"  <field(lease id)><epoch>         the same as OpRevoke if the lease's epoch equals epoch
+		OpWriteLease "e"  <key><field(lease id)><value>    sets the key's value and attaches the key to a lease
+		OpWriteTTL   "f"  <key><field(ttl)><value>         sets the key's value and attaches the key to a new lease
+
+	Reply format:
+		OpGrant      ok<lease id>                          no: malformed or ttl is 0
+		OpKeepAlive  ok                                    no: no such lease
+		OpRevoke     ok                                    no: no such lease
+		OpExpire     ok                                    no: no such lease, or the lease has been renewed
+		OpWriteLease ok                                    no: no such lease
+		OpWriteTTL   ok<lease id>                          no: malformed or ttl is 0
+
+	Replies of OpWriteLease and OpWriteTTL start with the operation type and the key, and replies of the other lease
+	operations (which access no key) start with the operation type only. Other writes to a key (e.g., OpWrite, OpCAS)
+	keep the key's lease, and deleting a key detaches it from its lease.
+
+	Note: leases are local to a Rabia group. With sharding (see the shard package), keyless lease commands are routed
+	to group 0, so a client should use OpWriteTTL for keys owned by other groups.
+*/
+
+// The operation types of lease commands
+const (
+	OpGrant      = "a"
+	OpKeepAlive  = "b"
+	OpRevoke     = "c"
+	OpExpire     = "d"
+	OpWriteLease = "e"
+	OpWriteTTL   = "f"
+)
+
+// A Lease and the keys attached to it
+type Lease struct {
+	Id    uint64
+	TTL   uint64 // in milliseconds
+	Epoch uint64 // increments on every keep-alive
+	Keys  map[string]struct{}
+}
+
+/*
+	A LeaseChange tells a proxy to start, restart, or stop the local deadline of a lease (see Store.RecordLeases)
+*/
+type LeaseChange struct {
+	Id      uint64
+	TTL     uint64
+	Epoch   uint64
+	Deleted bool // the lease was revoked or expired
+}
+
+// Returns a command that grants a lease of ttl milliseconds
+func Grant(ttl uint64) string {
+	return OpGrant + strconv.FormatUint(ttl, 10)
+}
+
+// Returns a command that renews a lease
+func KeepAlive(id uint64) string {
+	return OpKeepAlive + strconv.FormatUint(id, 10)
+}
+
+// Returns a command that revokes a lease
+func Revoke(id uint64) string {
+	return OpRevoke + strconv.FormatUint(id, 10)
+}
+
+// Returns a command that expires a lease if the lease has not been renewed since epoch
+func Expire(id, epoch uint64) string {
+	return OpExpire + field(strconv.FormatUint(id, 10)) + strconv.FormatUint(epoch, 10)
+}
+
+// Returns a command that sets a key's value and attaches the key to a lease
+func WriteLease(key string, id uint64, val string) string {
+	return OpWriteLease + key + field(strconv.FormatUint(id, 10)) + val
+}
+
+// Returns a command that sets a key's value and attaches the key to a new lease of ttl milliseconds
+func WriteTTL(key string, ttl uint64, val string) string {
+	return OpWriteTTL + key + field(strconv.FormatUint(ttl, 10)) + val
+}
+
+// Returns true if the operation type is a lease operation that accesses no key
+func isKeylessLeaseOp(op string) bool {
+	return op == OpGrant || op == OpKeepAlive || op == OpRevoke || op == OpExpire
+}
+
+/*
+	Returns the changes of leases recorded since the last call (if RecordLeases is true), in the order they were made
+*/
+func (s *Store) TakeLeaseChanges() []LeaseChange {
+	changes := s.LeaseChanges
+	s.LeaseChanges = nil
+	return changes
+}
+
+// Executes a keyless lease command and returns its reply, see the format above
+func (s *Store) executeLease(cmd string) string {
+	op := cmd[0:1]
+	switch op {
+	case OpGrant:
+		ttl, err := strconv.ParseUint(cmd[1:], 10, 64)
+		if err != nil || ttl == 0 {
+			return op + StatusNo
+		}
+		return op + StatusOk + strconv.FormatUint(s.grant(ttl).Id, 10)
+	case OpKeepAlive:
+		id, err := strconv.ParseUint(cmd[1:], 10, 64)
+		if err != nil {
+			return op + StatusNo
+		}
+		l, exists := s.Leases[id]
+		if !exists {
+			return op + StatusNo
+		}
+		l.Epoch++
+		s.recordLease(LeaseChange{Id: l.Id, TTL: l.TTL, Epoch: l.Epoch})
+		return op + StatusOk
+	case OpRevoke:
+		id, err := strconv.ParseUint(cmd[1:], 10, 64)
+		if err != nil || !s.revoke(id) {
+			return op + StatusNo
+		}
+		return op + StatusOk
+	default: // OpExpire
+		f, rest, ok := nextField(cmd[1:])
+		if !ok {
+			return op + StatusNo
+		}
+		id, err1 := strconv.ParseUint(f, 10, 64)
+		epoch, err2 := strconv.ParseUint(rest, 10, 64)
+		if err1 != nil || err2 != nil {
+			return op + StatusNo
+		}
+		if l, exists := s.Leases[id]; !exists || l.Epoch != epoch || !s.revoke(id) {
+			return op + StatusNo
+		}
+		return op + StatusOk
+	}
+}
+
+// Executes an OpWriteLease or an OpWriteTTL command, key and arg are returned by Parse
+func (s *Store) executeWriteLease(op, key, arg string) string {
+	f, val, ok := nextField(arg)
+	if !ok {
+		return op + key + StatusNo
+	}
+	n, err := strconv.ParseUint(f, 10, 64)
+	if err != nil {
+		return op + key + StatusNo
+	}
+	if op == OpWriteLease {
+		l, exists := s.Leases[n]
+		if !exists {
+			return op + key + StatusNo
+		}
+		s.put(key, val)
+		s.attach(key, l)
+		return op + key + StatusOk
+	}
+	if n == 0 {
+		return op + key + StatusNo
+	}
+	l := s.grant(n)
+	s.put(key, val)
+	s.attach(key, l)
+	return op + key + StatusOk + strconv.FormatUint(l.Id, 10)
+}
+
+// Creates a lease, lease ids are assigned in order starting from 1
+func (s *Store) grant(ttl uint64) *Lease {
+	s.LeaseCtr++
+	l := &Lease{Id: s.LeaseCtr, TTL: ttl, Keys: make(map[string]struct{})}
+	s.Leases[l.Id] = l
+	s.recordLease(LeaseChange{Id: l.Id, TTL: l.TTL, Epoch: l.Epoch})
+	return l
+}
+
+// Deletes a lease and its keys, returns false if there is no such lease
+func (s *Store) revoke(id uint64) bool {
+	l, exists := s.Leases[id]
+	if !exists {
+		return false
+	}
+	keys := make([]string, 0, len(l.Keys))
+	for key := range l.Keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // delete keys in the same order on every replica, so that revisions and events match
+	for _, key := range keys {
+		s.delete(key)
+	}
+	delete(s.Leases, id)
+	s.recordLease(LeaseChange{Id: id, Deleted: true})
+	return true
+}
+
+// Attaches an existing key to a lease, and detaches it from its previous lease (if any)
+func (s *Store) attach(key string, l *Lease) {
+	e := s.Data[key]
+	if prev, exists := s.Leases[e.Lease]; exists {
+		delete(prev.Keys, key)
+	}
+	e.Lease = l.Id
+	s.Data[key] = e
+	l.Keys[key] = struct{}{}
+}
+
+func (s *Store) recordLease(c LeaseChange) {
+	if s.RecordLeases {
+		s.LeaseChanges = append(s.LeaseChanges, c)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package kvs
+
+import (
+	"math"
+	"strconv"
+)
+
+// An Entry is a key's value, version (the store revision at which the key was last modified), and lease
+type Entry struct {
+	Value   string
+	Version uint64
+	Lease   uint64 // the id of the lease the key is attached to, 0 if none (see lease.go)
+}
+
+/*
+	The dictionary KV store. It is only accessed by a proxy's KVSExecutor routine, so it does not need a lock.
+*/
+type Store struct {
+	Data     map[string]Entry
+	Revision uint64 // increments on every mutation, see the package-level comment
+
+	RecordEvents bool    // whether to record changes for watches, see watch.go
+	Events       []Event // the changes recorded since the last TakeEvents call
+
+	Leases       map[uint64]*Lease // see lease.go
+	LeaseCtr     uint64            // the id of the last granted lease
+	RecordLeases bool              // whether to record changes of leases for the proxy's lease deadlines
+	LeaseChanges []LeaseChange     // the changes of leases recorded since the last TakeLeaseChanges call
+}
+
+// Initialize an empty store
+func StoreInit() *Store {
+	return &Store{
+		Data:   make(map[string]Entry),
+		Leases: make(map[uint64]*Lease),
+	}
+}
+
+/*
+	Executes a command and returns its reply, see the package-level comment for the formats of commands and replies.
+	Given the same sequence of commands, every Store produces the same sequence of replies.
+*/
+func (s *Store) Execute(cmd string) string {
+	if len(cmd) != 0 && cmd[0:1] == OpTxn {
+		return s.executeTxn(cmd)
+	}
+	if len(cmd) != 0 && isKeylessLeaseOp(cmd[0:1]) {
+		return s.executeLease(cmd)
+	}
+	op, key, arg, ok := Parse(cmd)
+	if !ok {
+		return Reject(cmd)
+	}
+	switch op {
+	case OpWrite:
+		s.put(key, arg)
+		return op + key + "ok"
+	case OpRead:
+		return op + key + s.Data[key].Value
+	case OpDelete:
+		if _, exists := s.Data[key]; !exists {
+			return op + key + StatusNo
+		}
+		s.delete(key)
+		return op + key + StatusOk
+	case OpCAS:
+		expected, val, ok := nextField(arg)
+		if !ok {
+			return op + key + StatusNo
+		}
+		e, exists := s.Data[key]
+		if !exists {
+			return op + key + StatusNoKey
+		}
+		if e.Value != expected {
+			return op + key + StatusNo + e.Value
+		}
+		s.put(key, val)
+		return op + key + StatusOk
+	case OpCASVersion:
+		f, val, ok := nextField(arg)
+		if !ok {
+			return op + key + StatusNo
+		}
+		version, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return op + key + StatusNo
+		}
+		if e := s.Data[key]; e.Version != version {
+			return op + key + StatusNo + strconv.FormatUint(e.Version, 10)
+		}
+		s.put(key, val)
+		return op + key + StatusOk + strconv.FormatUint(s.Revision, 10)
+	case OpIncr:
+		delta, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return op + key + StatusNo
+		}
+		var curr int64
+		if e, exists := s.Data[key]; exists {
+			if curr, err = strconv.ParseInt(e.Value, 10, 64); err != nil {
+				return op + key + StatusNo
+			}
+		}
+		if (delta > 0 && curr > math.MaxInt64-delta) || (delta < 0 && curr < math.MinInt64-delta) {
+			return op + key + StatusNo + strconv.FormatInt(curr, 10) // the counter would overflow
+		}
+		val := strconv.FormatInt(curr+delta, 10)
+		s.put(key, val)
+		return op + key + StatusOk + val
+	case OpSetIfAbsent:
+		if e, exists := s.Data[key]; exists {
+			return op + key + StatusNo + e.Value
+		}
+		s.put(key, arg)
+		return op + key + StatusOk
+	case OpWriteLease, OpWriteTTL:
+		return s.executeWriteLease(op, key, arg)
+	default:
+		return Reject(cmd)
+	}
+}
+
+// Returns a key's version, 0 if the key does not exist
+func (s *Store) Version(key string) uint64 {
+	return s.Data[key].Version
+}
+
+// Sets a key's value (the key keeps its lease) and bumps the revision
+func (s *Store) put(key, val string) {
+	s.Revision++
+	s.Data[key] = Entry{Value: val, Version: s.Revision, Lease: s.Data[key].Lease}
+	if s.RecordEvents {
+		s.Events = append(s.Events, Event{Key: key, Value: val})
+	}
+}
+
+// Deletes a key (and detaches it from its lease) and bumps the revision
+func (s *Store) delete(key string) {
+	s.Revision++
+	if l, exists := s.Leases[s.Data[key].Lease]; exists {
+		delete(l.Keys, key)
+	}
+	delete(s.Data, key)
+	if s.RecordEvents {
+		s.Events = append(s.Events, Event{Key: key, Deleted: true})
+	}
+}
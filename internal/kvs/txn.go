@@ -0,0 +1,208 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package kvs
+
+import (
+	. "rabia/internal/config"
+	"strconv"
+)
+
+/*
+	Multi-key transactions
+
+	A transaction (OpTxn) is a list of guards followed by a list of operations. When a proxy applies a transaction, it
+	first evaluates every guard against the store; if all guards hold, it executes the operations in order, otherwise
+	it executes none of them. Since a decided ConsensusObj is applied by one routine, nothing interleaves with a
+	transaction, and every replica evaluates the guards against the same state (i.e., etcd's Txn semantics without the
+	else branch).
+
+	Command format:
+		"7" <field(n)> <field(guard 1)> ... <field(guard n)> <field(op 1)> ... <field(op m)>
+
+	where each guard is encoded as <key><target><comparison><operand> (see Guard), and each operation is a write, i.e.,
+	an OpWrite or an OpDelete command. Other operations (e.g., reads, conditional writes, or lease operations) are not
+	allowed, since their outcomes may depend on the store, and a transaction either applies all of its writes or none
+	of them.
+
+	Reply format:
+		"7" "ok" <field(reply of op 1)> ... <field(reply of op m)>     if all guards hold
+		"7" "no" <field(i)>                                              if guard i (0-based) is the first failed guard
+		"7" "no"                                                         if the transaction is malformed
+
+	A malformed transaction (e.g., a guard of an unknown target, an operation that is not a write, or a malformed
+	write) is rejected as a whole before any guard is evaluated.
+*/
+
+// The operation type of a transaction
+const OpTxn = "7"
+
+// Guard targets, i.e., what a guard compares with its operand
+const (
+	GuardValue   = "v" // the key's value, compared lexicographically
+	GuardVersion = "r" // the key's version, compared numerically
+)
+
+// Guard comparisons
+const (
+	CmpEqual    = "="
+	CmpNotEqual = "!"
+	CmpLess     = "<"
+	CmpGreater  = ">"
+)
+
+/*
+	A Guard holds if "<the Target of Key> <Cmp> <Operand>" is true. A key that does not exist has an empty value and
+	version 0.
+*/
+type Guard struct {
+	Key     string
+	Target  string // GuardValue or GuardVersion
+	Cmp     string // CmpEqual, CmpNotEqual, CmpLess, or CmpGreater
+	Operand string // a value, or a version in decimal
+}
+
+// Returns a transaction command, see the format above
+func Txn(guards []Guard, ops []string) string {
+	cmd := OpTxn + field(strconv.Itoa(len(guards)))
+	for _, g := range guards {
+		cmd += field(g.Key + g.Target + g.Cmp + g.Operand)
+	}
+	for _, op := range ops {
+		cmd += field(op)
+	}
+	return cmd
+}
+
+/*
+	Decodes the body of a transaction command (the command without its operation type). The last return value is
+	false if the transaction is malformed.
+*/
+func parseTxn(body string) ([]Guard, []string, bool) {
+	f, rest, ok := nextField(body)
+	if !ok {
+		return nil, nil, false
+	}
+	n, err := strconv.Atoi(f)
+	if err != nil || n < 0 || n > len(rest)/(Conf.KeyLen+4) { // a guard takes at least "N:" and Conf.KeyLen+2 bytes
+		return nil, nil, false
+	}
+
+	guards := make([]Guard, n)
+	for i := range guards {
+		if f, rest, ok = nextField(rest); !ok || len(f) < Conf.KeyLen+2 {
+			return nil, nil, false
+		}
+		guards[i] = Guard{Key: f[:Conf.KeyLen], Target: f[Conf.KeyLen : Conf.KeyLen+1],
+			Cmp: f[Conf.KeyLen+1 : Conf.KeyLen+2], Operand: f[Conf.KeyLen+2:]}
+		if guards[i].Target != GuardValue && guards[i].Target != GuardVersion {
+			return nil, nil, false
+		}
+		if guards[i].Cmp != CmpEqual && guards[i].Cmp != CmpNotEqual && guards[i].Cmp != CmpLess &&
+			guards[i].Cmp != CmpGreater {
+			return nil, nil, false
+		}
+		if guards[i].Target == GuardVersion {
+			if _, err := strconv.ParseUint(guards[i].Operand, 10, 64); err != nil {
+				return nil, nil, false
+			}
+		}
+	}
+
+	var ops []string
+	for len(rest) != 0 {
+		if f, rest, ok = nextField(rest); !ok || !isTxnWrite(f) {
+			return nil, nil, false
+		}
+		ops = append(ops, f)
+	}
+	return guards, ops, true
+}
+
+// Returns whether a command is a well-formed write that a transaction may contain, see the format above
+func isTxnWrite(cmd string) bool {
+	op, _, arg, ok := Parse(cmd)
+	return ok && (op == OpWrite || (op == OpDelete && arg == ""))
+}
+
+// Evaluates a guard against the store
+func (s *Store) holds(g Guard) bool {
+	e := s.Data[g.Key]
+	var c int // -1, 0, or 1 if the target is less than, equal to, or greater than the operand
+	if g.Target == GuardValue {
+		if e.Value < g.Operand {
+			c = -1
+		} else if e.Value > g.Operand {
+			c = 1
+		}
+	} else {
+		operand, _ := strconv.ParseUint(g.Operand, 10, 64) // checked in parseTxn
+		if e.Version < operand {
+			c = -1
+		} else if e.Version > operand {
+			c = 1
+		}
+	}
+	switch g.Cmp {
+	case CmpEqual:
+		return c == 0
+	case CmpNotEqual:
+		return c != 0
+	case CmpLess:
+		return c < 0
+	default: // CmpGreater
+		return c > 0
+	}
+}
+
+// Executes a transaction command and returns its reply, see the format above
+func (s *Store) executeTxn(cmd string) string {
+	guards, ops, ok := parseTxn(cmd[1:])
+	if !ok {
+		return OpTxn + StatusNo
+	}
+	for i, g := range guards {
+		if !s.holds(g) {
+			return OpTxn + StatusNo + field(strconv.Itoa(i))
+		}
+	}
+	rep := OpTxn + StatusOk
+	for _, op := range ops {
+		rep += field(s.Execute(op))
+	}
+	return rep
+}
+
+/*
+	Splits the reply of a transaction into its status (true if all guards held) and its payload fields: the replies of
+	its operations if the status is true, otherwise the index of the first failed guard (if any). The last return value
+	is false if the reply is malformed.
+*/
+func ParseTxnReply(rep string) (bool, []string, bool) {
+	if len(rep) < 1+len(StatusOk) || rep[0:1] != OpTxn {
+		return false, nil, false
+	}
+	status := rep[1:1+len(StatusOk)] == StatusOk
+	var fields []string
+	for rest := rep[1+len(StatusOk):]; len(rest) != 0; {
+		var f string
+		var ok bool
+		if f, rest, ok = nextField(rest); !ok {
+			return false, nil, false
+		}
+		fields = append(fields, f)
+	}
+	return status, fields, true
+}
@@ -0,0 +1,143 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package kvs
+
+import (
+	. "rabia/internal/config"
+	"strconv"
+)
+
+/*
+	Watches
+
+	A watch streams the changes of every key that starts with a prefix to a client over the client's existing
+	connection. A watch is registered by a command, so it is applied at a definite slot like any other command: the
+	watching proxy first replays the retained changes from the watch's start slot, and then pushes the changes of every
+	subsequent slot, so the client sees each change with a slot # no less than the start slot exactly once and in slot
+	order. Watch commands are handled by the proxy (see the proxy package), the Store only records the changes.
+
+	Command format:
+		OpWatch   "8"  <field(prefix)><start slot #>    watches the keys that start with prefix (an empty prefix watches
+		                                                every key), starting from the given slot #
+		OpUnwatch "9"  <watch id>                       cancels a watch
+
+	Reply format:
+		OpWatch   ok<watch id>                          no<oldest slot #> if the changes of the start slot are no longer
+		                                                retained, or no if the command is malformed
+		OpUnwatch ok: the watch was cancelled           no: the client has no such watch
+
+	Events: each change is encoded as a write command (OpWrite<key><new value>) or a delete command (OpDelete<key>),
+	and the changes of one slot are pushed as a Command whose WatchId is the watch's id and whose SvrSeq is the slot #.
+
+	A proxy queues at most Conf.WatchQueueLen such Commands per watch. If a client does not keep up with the changes of
+	a watch, the proxy cancels the watch and pushes a last Command whose only command is WatchOverflow and whose SvrSeq
+	is the first slot # whose changes are not pushed, so that the client may watch again from that slot.
+*/
+
+// The operation types of watch commands
+const (
+	OpWatch   = "8"
+	OpUnwatch = "9"
+)
+
+// The last event of a watch that is canceled because its client does not keep up, see the format above
+const WatchOverflow = OpUnwatch + StatusNo
+
+// An Event is a change of a key made by a decided command
+type Event struct {
+	Key     string
+	Value   string // the new value, empty if Deleted
+	Deleted bool
+}
+
+// Returns a watch command, see the format above
+func Watch(prefix string, startSeq uint32) string {
+	return OpWatch + field(prefix) + strconv.FormatUint(uint64(startSeq), 10)
+}
+
+// Returns an unwatch command, see the format above
+func Unwatch(id uint32) string {
+	return OpUnwatch + strconv.FormatUint(uint64(id), 10)
+}
+
+// Returns true if the command is a watch or an unwatch command
+func IsWatchCmd(cmd string) bool {
+	return len(cmd) != 0 && (cmd[0:1] == OpWatch || cmd[0:1] == OpUnwatch)
+}
+
+// Decodes a watch command, the last return value is false if the command is malformed
+func ParseWatch(cmd string) (prefix string, startSeq uint32, ok bool) {
+	if len(cmd) == 0 || cmd[0:1] != OpWatch {
+		return "", 0, false
+	}
+	prefix, rest, ok := nextField(cmd[1:])
+	if !ok || len(prefix) > Conf.KeyLen {
+		return "", 0, false
+	}
+	seq, err := strconv.ParseUint(rest, 10, 32)
+	if err != nil {
+		return "", 0, false
+	}
+	return prefix, uint32(seq), true
+}
+
+// Decodes an unwatch command, the last return value is false if the command is malformed
+func ParseUnwatch(cmd string) (uint32, bool) {
+	if len(cmd) == 0 || cmd[0:1] != OpUnwatch {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(cmd[1:], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(id), true
+}
+
+// Encodes an event as a write or a delete command, see the format above
+func (e Event) String() string {
+	if e.Deleted {
+		return Delete(e.Key)
+	}
+	return Write(e.Key, e.Value)
+}
+
+// Decodes an event, the last return value is false if the event is malformed
+func ParseEvent(s string) (Event, bool) {
+	op, key, val, ok := Parse(s)
+	if !ok {
+		return Event{}, false
+	}
+	switch op {
+	case OpWrite:
+		return Event{Key: key, Value: val}, true
+	case OpDelete:
+		if len(val) != 0 {
+			return Event{}, false
+		}
+		return Event{Key: key, Deleted: true}, true
+	default:
+		return Event{}, false
+	}
+}
+
+/*
+	Returns the changes recorded since the last call (if RecordEvents is true), in the order they were made
+*/
+func (s *Store) TakeEvents() []Event {
+	events := s.Events
+	s.Events = nil
+	return events
+}
@@ -18,8 +18,8 @@ package ledger
 import (
 	"rabia/internal/config"
 	"rabia/internal/message"
-	"sort"
 	"sync"
+	"sync/atomic"
 )
 
 /*
@@ -36,7 +36,8 @@ import (
 	object. Nevertheless, Rabia's goal is to let all servers in the cluster agree on the same sequence of decisions
 	eventually, and as fast as possible
 
-	Note: At each server, the ledger is read by the proxy layer and read and written by the consensus layer.
+	Note: At each server, the ledger is read by the proxy layer and read and written by the consensus layer (its
+	MsgHandler and Executor routines). See section 4 for how these routines access a Slot without data races.
 
 	2. About ConsensusObj
 
@@ -55,6 +56,33 @@ import (
 	function prefers to output 1
 
 	RecvBCMsgs' majority value's tally (MajT): the occurrences of MajV
+
+	4. Terms and Concurrency
+
+	Entry i of the ledger ring stores logical slots i, i + LenLedger, i + 2 * LenLedger, ..., one at a time; the term
+	of logical slot seq is seq / LenLedger. Each term of an entry has its own Slot object, and advancing an entry to the
+	next term (Renew) atomically replaces the entry's Slot with a new one instead of resetting the old one in place. So
+	a routine that still holds the Slot of an older term never observes a half-reset Slot, and a Slot's Term never
+	changes. Within a term, the fields of a Slot are handed over as follows:
+
+		MsgHandler only: HasRecvDec (written), RecvProposals, RecvBCMsgs, RecvBCMsgsT (written) -- the Executor reads
+			the tallies of a round only after MsgHandler notifies it through Queue that the round has n - f messages,
+			and MsgHandler never changes the tallies of a round after that, so the channel orders the accesses.
+		Executor only: MyProposal, MyBCMsgs, Phase, Round
+		Decision: written once by the Executor before IsDone becomes true (atomically), read by others after that; the
+			Executor then wakes up the proxy through NotifyDecided
+		HasRecvDec and IsDone: atomic flags, read by both routines
+
+	The majority getters do not reorder RecvProposals, so both routines may compute the majority value concurrently.
+
+	5. Flow Control
+
+	The proxy applies decisions in the order of logical slots, and it records the number of slots applied so far in
+	the ledger (SetApplied). An entry advances to its next term only after the proxy has applied the entry's current
+	slot, so the consensus layer cannot overwrite a decision that has not been applied. Until then, Renew refuses the
+	next term, and the Executor waits before it starts a slot that is not free yet (see IsFree). SetApplied notifies
+	both the Executor (Freed) and MsgHandler (Renewable), which replays the messages that it buffers for the entries
+	that may advance now.
 */
 
 // A Tally object counts the number of occurrences of a proposal
@@ -63,21 +91,22 @@ type Tally struct {
 	Count    int                  // increment-only for the purpose of tallying
 }
 
+/*
+	The state of a logical slot in one term of a ledger entry, see section 4 above
+*/
 type Slot struct {
-	Term       uint32               // the num of times that this slot has been reused/reset
-	Lock       sync.Mutex           // prevents undesirable concurrent slot operations, see comments below (important!)
-	IsDone     bool                 // whether a decision has been generated
-	HasRecvDec bool                 // whether a decision msg is received, and it guarantees <=1 Decision msg goes into the Queue
-	Decision   message.ConsensusObj // if IsDone == true, this field saves the decision for the current term
-	Queue      chan message.Msg     // from Msg Handler to Executor
-	Phase      uint32               // current phase
-	Round      uint32               // current round
+	Term     uint32               // the num of times that this ledger entry has been reused, never changes
+	Decision message.ConsensusObj // if IsDone() == true, this field saves the decision for this term
+	Queue    chan message.Msg     // from Msg Handler to Executor
+	Phase    uint32               // current phase
+	Round    uint32               // current round
 
-	/*
-		Lock: prevents undesirable concurrent reset. Also see the Race Conditions Documented section in consensus.go
+	done    uint32 // whether a decision has been generated, accessed atomically
+	recvDec uint32 // whether a decision msg is received, it guarantees <=1 Decision msg goes into the Queue (atomic)
 
+	/*
 		MyProposal: does not change after a variable assignment
-		RecvProposals: the order of elements is not stable -- some functions may sort the Tally objects
+		RecvProposals: the order of elements is stable, the majority getters scan it
 		MyBCMsgs: stands for "my binary consensus messages".
 			MyBCMsgs[p][0] stores the STATE of phase p, round 1
 			MyBCMsgs[p][1] stores the VOTE of phase p, round 2
@@ -99,27 +128,194 @@ type Slot struct {
 	RecvBCMsgsT   [][2]int             // received state and vote messages' tallies
 }
 
-type Ledger []*Slot
+/*
+	A ledger entry, which points to the Slot of the entry's current term
+*/
+type entry struct {
+	slot  atomic.Value // a *Slot, replaced (not modified) when the entry advances to the next term
+	prev  atomic.Value // a *message.ConsensusObj, the decision of the entry's previous term
+	renew sync.Mutex   // serializes Renew calls of this entry
+}
 
 /*
- this function resets or initializes every fields but leaves the Term and Lock fields unchanged. Please acquire the Lock
- before resetting the slot, and increment the Term variable while holding the lock.
+	A Ledger is a ring of Conf.LenLedger entries, see section 4 above
+*/
+type Ledger struct {
+	entries []entry
+	applied *uint32       // the num. of logical slots that the proxy has applied, accessed atomically
+	decided chan struct{} // notifies the proxy of new decisions, see NotifyDecided
+	freed   chan struct{} // notifies the consensus executor of newly applied slots, see SetApplied
+	// notifies the consensus MsgHandler of newly applied slots, i.e., the entries that may advance, see SetApplied
+	renewable chan struct{}
+}
 
- Note: Term and Lock are initialized at object allocation phase -- Lock is an allocated lock object but not a pointer.
+/*
+	Initialize a Ledger of Conf.LenLedger entries, each entry starts from term 0
 */
-func (s *Slot) Reset() {
-	s.IsDone = false
-	s.HasRecvDec = false
-	s.Decision = message.ConsensusObj{}
-	s.Queue = make(chan message.Msg, 10)
-	s.Phase = 0
-	s.Round = 0
+func LedgerInit() Ledger {
+	l := Ledger{
+		entries: make([]entry, config.Conf.LenLedger),
+		applied: new(uint32),
+		decided: make(chan struct{}, 1),
+		freed:   make(chan struct{}, 1),
+
+		renewable: make(chan struct{}, 1),
+	}
+	for i := range l.entries {
+		l.entries[i].slot.Store(newSlot(0))
+	}
+	return l
+}
+
+// Returns the Slot of entry idx's current term
+func (l Ledger) Get(idx uint32) *Slot {
+	return l.entries[idx].slot.Load().(*Slot)
+}
+
+/*
+	Advances entry idx to the given term if the entry's current term is term - 1 and the proxy has applied the entry's
+	current slot. Returns false if the entry's term is neither term nor term - 1 (i.e., term is older than or > 1 newer
+	than the entry's term), or if the entry's current slot has not been applied.
+*/
+func (l Ledger) Renew(idx, term uint32) bool {
+	if s := l.Get(idx); term == s.Term {
+		return true // the fast path, without locking
+	}
+	e := &l.entries[idx]
+	e.renew.Lock()
+	defer e.renew.Unlock()
+	s := l.Get(idx)
+	if term == s.Term {
+		return true
+	} else if term == s.Term+1 && l.IsFree(term*config.Conf.LenLedger+idx) {
+		if dec, ok := s.GetDecision(); ok { // the proxy has applied the slot, so it has been decided
+			e.prev.Store(dec)
+		}
+		e.slot.Store(newSlot(term))
+		return true
+	}
+	return false
+}
+
+/*
+	Returns the decision of logical slot seq if the ledger still knows it, i.e., if seq is of its entry's current term
+	and has been decided, or if seq is of its entry's previous term
+*/
+func (l Ledger) Decision(seq uint32) (*message.ConsensusObj, bool) {
+	idx, term := seq%config.Conf.LenLedger, seq/config.Conf.LenLedger
+	if s := l.Get(idx); term == s.Term {
+		return s.GetDecision()
+	} else if term+1 == s.Term {
+		if dec, ok := l.entries[idx].prev.Load().(*message.ConsensusObj); ok {
+			return dec, dec.SvrSeq == seq
+		}
+	}
+	return nil, false
+}
+
+/*
+	Notifies the routine that waits on Decided that a decision has been set. It never blocks, and notifications that
+	have not been received yet are merged into one, so the receiver should check all slots that may be decided.
+*/
+func (l Ledger) NotifyDecided() {
+	select {
+	case l.decided <- struct{}{}:
+	default:
+	}
+}
 
-	s.MyProposal = message.ConsensusObj{}
-	s.RecvProposals = make([]Tally, 0)
-	s.MyBCMsgs = make([][2]uint32, config.Conf.LenBlockArray)
-	s.RecvBCMsgs = make([][2][3]int, config.Conf.LenBlockArray)
-	s.RecvBCMsgsT = make([][2]int, config.Conf.LenBlockArray)
+// Returns the channel that receives the notifications of NotifyDecided
+func (l Ledger) Decided() <-chan struct{} {
+	return l.decided
+}
+
+/*
+	Records that the proxy has applied the decisions of logical slots 0, 1, ..., applied - 1, and notifies the routines
+	that wait on Freed and Renewable (in the same way as NotifyDecided). Called by the proxy only.
+*/
+func (l Ledger) SetApplied(applied uint32) {
+	atomic.StoreUint32(l.applied, applied)
+	select {
+	case l.freed <- struct{}{}:
+	default:
+	}
+	select {
+	case l.renewable <- struct{}{}:
+	default:
+	}
+}
+
+// Returns the channel that receives the notifications of SetApplied
+func (l Ledger) Freed() <-chan struct{} {
+	return l.freed
+}
+
+// Returns the channel that receives the notifications of SetApplied for MsgHandler, see section 5 above
+func (l Ledger) Renewable() <-chan struct{} {
+	return l.renewable
+}
+
+// Returns the num. of logical slots that the proxy has applied
+func (l Ledger) Applied() uint32 {
+	return atomic.LoadUint32(l.applied)
+}
+
+/*
+	Returns whether logical slot seq can be stored in the ledger, i.e., whether the proxy has applied the slot that
+	seq's entry stores in the previous term
+*/
+func (l Ledger) IsFree(seq uint32) bool {
+	return seq < l.Applied()+config.Conf.LenLedger
+}
+
+/*
+	Allocates the Slot of a term
+*/
+func newSlot(term uint32) *Slot {
+	return &Slot{
+		Term:  term,
+		Queue: make(chan message.Msg, 10),
+
+		RecvProposals: make([]Tally, 0),
+		MyBCMsgs:      make([][2]uint32, config.Conf.LenBlockArray),
+		RecvBCMsgs:    make([][2][3]int, config.Conf.LenBlockArray),
+		RecvBCMsgsT:   make([][2]int, config.Conf.LenBlockArray),
+	}
+}
+
+// Returns whether a decision has been generated
+func (s *Slot) IsDone() bool {
+	return atomic.LoadUint32(&s.done) == 1
+}
+
+/*
+	Saves the decision and then marks the slot as done, so that a routine that sees IsDone() == true also sees the
+	decision. Called by the Executor only, at most once per Slot.
+*/
+func (s *Slot) SetDecision(dec message.ConsensusObj) {
+	s.Decision = dec
+	atomic.StoreUint32(&s.done, 1)
+}
+
+/*
+	Returns the decision if a decision has been generated. The decision is never modified afterwards, so the caller
+	may keep the pointer.
+*/
+func (s *Slot) GetDecision() (*message.ConsensusObj, bool) {
+	if !s.IsDone() {
+		return nil, false
+	}
+	return &s.Decision, true
+}
+
+// Returns whether a decision msg is received
+func (s *Slot) HasRecvDec() bool {
+	return atomic.LoadUint32(&s.recvDec) == 1
+}
+
+// Marks that a decision msg is received
+func (s *Slot) SetRecvDec() {
+	atomic.StoreUint32(&s.recvDec, 1)
 }
 
 // Increases the Phase variable by one and decreases the Round variable by one
@@ -152,27 +348,29 @@ func (s *Slot) PutRecvProposals(p message.ConsensusObj) {
 }
 
 /*
-	Sort RecvProposals according to their occurrences so that the fist proposal after sorting is the majority value,
-	if two proposals have the same number of occurrences, put the one wins the less-than relation to the front.
+	Returns the index of the majority value in RecvProposals: the proposal with the most occurrences, if two proposals
+	have the same number of occurrences, the one wins the less-than relation. RecvProposals is not modified.
 */
-func (s *Slot) SortRecvProposals() {
-	sort.Slice(s.RecvProposals, func(i, j int) bool {
-		return s.RecvProposals[i].Count > s.RecvProposals[j].Count ||
-			(s.RecvProposals[i].Count == s.RecvProposals[j].Count &&
-				message.ProxySeqIdLessThan(&s.RecvProposals[i].Proposal, &s.RecvProposals[j].Proposal))
-	})
+func (s *Slot) recvProposalsMajIdx() int {
+	idx := 0
+	for i := 1; i < len(s.RecvProposals); i++ {
+		if s.RecvProposals[i].Count > s.RecvProposals[idx].Count ||
+			(s.RecvProposals[i].Count == s.RecvProposals[idx].Count &&
+				message.ProxySeqIdLessThan(&s.RecvProposals[i].Proposal, &s.RecvProposals[idx].Proposal)) {
+			idx = i
+		}
+	}
+	return idx
 }
 
 // RecvProposals' majority value getter
 func (s *Slot) RecvProposalsMajV() message.ConsensusObj {
-	s.SortRecvProposals()
-	return s.RecvProposals[0].Proposal
+	return s.RecvProposals[s.recvProposalsMajIdx()].Proposal
 }
 
 //RecvProposals' majority tally getter
 func (s *Slot) RecvProposalsMajT() int {
-	s.SortRecvProposals()
-	return s.RecvProposals[0].Count
+	return s.RecvProposals[s.recvProposalsMajIdx()].Count
 }
 
 // MyBCMsgs setter
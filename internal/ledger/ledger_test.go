@@ -0,0 +1,191 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package ledger
+
+import (
+	"rabia/internal/config"
+	"rabia/internal/message"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSlot_RecvProposalsMaj(t *testing.T) {
+	config.Conf.LenBlockArray = 10
+	s := newSlot(0)
+	p1 := message.ConsensusObj{ProId: 1, ProSeq: 5}
+	p2 := message.ConsensusObj{ProId: 2, ProSeq: 4}
+	p3 := message.ConsensusObj{ProId: 0, ProSeq: 9}
+	for _, p := range []message.ConsensusObj{p1, p3, p2, p1, p2} {
+		s.PutRecvProposals(p)
+	}
+	// p1 and p2 occur twice, and p2 wins the less-than relation
+	if v := s.RecvProposalsMajV(); !message.ProxySeqIdEqual(&v, &p2) || s.RecvProposalsMajT() != 2 {
+		t.Errorf("RecvProposalsMajV() = %v (%d), want %v (2)", v, s.RecvProposalsMajT(), p2)
+	}
+	if !message.ProxySeqIdEqual(&s.RecvProposals[0].Proposal, &p1) {
+		t.Errorf("the majority getters reordered RecvProposals")
+	}
+}
+
+func TestLedger_Renew(t *testing.T) {
+	config.Conf.LenLedger = 4
+	config.Conf.LenBlockArray = 10
+	l := LedgerInit()
+	s0 := l.Get(1)
+	if !l.Renew(1, 0) || l.Get(1) != s0 {
+		t.Errorf("renewing an entry to its current term replaced the slot")
+	}
+	if l.Renew(1, 2) {
+		t.Errorf("an entry is renewed to a term > 1 newer")
+	}
+	l.SetApplied(1)
+	if l.IsFree(5) || l.Renew(1, 1) {
+		t.Errorf("an entry is renewed before its slot is applied")
+	}
+	l.SetApplied(2)
+	if !l.IsFree(5) || !l.Renew(1, 1) || l.Get(1).Term != 1 || s0.Term != 0 {
+		t.Errorf("an entry is not renewed to the next term")
+	}
+	for _, c := range []<-chan struct{}{l.Freed(), l.Renewable()} {
+		select {
+		case <-c:
+		default:
+			t.Errorf("SetApplied does not notify Freed and Renewable")
+		}
+	}
+	if l.Renew(1, 0) {
+		t.Errorf("an entry is renewed to an older term")
+	}
+}
+
+func TestLedger_Decision(t *testing.T) {
+	config.Conf.LenLedger = 4
+	config.Conf.LenBlockArray = 10
+	l := LedgerInit()
+	if _, ok := l.Decision(2); ok {
+		t.Errorf("an undecided slot has a decision")
+	}
+	l.Get(2).SetDecision(message.ConsensusObj{ProId: 1, ProSeq: 7, SvrSeq: 2})
+	l.SetApplied(3)
+	if !l.Renew(2, 1) {
+		t.Fatalf("an entry is not renewed to the next term")
+	}
+	if dec, ok := l.Decision(2); !ok || dec.ProSeq != 7 {
+		t.Errorf("Decision(2) = %v, %v, want the decision of the previous term", dec, ok)
+	}
+	l.Get(2).SetDecision(message.ConsensusObj{ProId: 1, ProSeq: 8, SvrSeq: 6})
+	if dec, ok := l.Decision(6); !ok || dec.ProSeq != 8 {
+		t.Errorf("Decision(6) = %v, %v, want the decision of the current term", dec, ok)
+	}
+	if _, ok := l.Decision(10); ok {
+		t.Errorf("a slot of a future term has a decision")
+	}
+	l.SetApplied(7)
+	if !l.Renew(2, 2) {
+		t.Fatalf("an entry is not renewed to the next term")
+	}
+	if _, ok := l.Decision(2); ok {
+		t.Errorf("a slot older than the previous term has a decision")
+	}
+}
+
+/*
+	Mimics MsgHandler, Executor, and KVSExecutor on a short ledger so that entries are renewed thousands of times. Run
+	with "go test -race" to detect unsynchronized accesses.
+*/
+func TestLedger_Concurrent(t *testing.T) {
+	config.Conf.LenLedger = 8
+	config.Conf.LenBlockArray = 10
+	config.Conf.NMinusF = 2
+	config.Conf.Majority = 2
+	const nSlots = 20000
+	l := LedgerInit()
+	L := config.Conf.LenLedger
+
+	var decided int64 = -1 // the last decided slot
+	spinUntil := func(cond func() bool) {
+		for !cond() {
+			runtime.Gosched()
+		}
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(3)
+
+	go func() { // MsgHandler: receives n - f proposals of each slot and notifies the Executor
+		defer wg.Done()
+		for seq := uint32(0); seq < nSlots; seq++ {
+			spinUntil(func() bool { return l.IsFree(seq) })
+			if !l.Renew(seq%L, seq/L) {
+				t.Errorf("MsgHandler: cannot renew slot %d", seq)
+				return
+			}
+			s := l.Get(seq % L)
+			for i := 0; i < config.Conf.NMinusF; i++ {
+				s.PutRecvProposals(message.ConsensusObj{ProId: 1, ProSeq: seq})
+			}
+			s.Queue <- message.Msg{Type: message.Proposal, Value: seq}
+			if s.RecvProposalsMajT() < config.Conf.Majority { // a ProposalRequest
+				t.Errorf("MsgHandler: wrong majority tally of slot %d", seq)
+			}
+			if seq >= L && l.Renew((seq-L)%L, (seq-L)/L) { // a message older than the slot's term
+				t.Errorf("MsgHandler: renewed slot %d to an older term", seq)
+			}
+		}
+	}()
+
+	go func() { // Executor: decides each slot after the MsgHandler's notification
+		defer wg.Done()
+		for seq := uint32(0); seq < nSlots; seq++ {
+			spinUntil(func() bool { return l.IsFree(seq) })
+			if !l.Renew(seq%L, seq/L) {
+				t.Errorf("Executor: cannot renew slot %d", seq)
+				return
+			}
+			s := l.Get(seq % L)
+			s.SetMyProposal(message.ConsensusObj{ProId: 1, ProSeq: seq})
+			<-s.Queue
+			dec := s.RecvProposalsMajV()
+			dec.SvrSeq = seq
+			s.SetDecision(dec)
+			l.NotifyDecided()
+			atomic.StoreInt64(&decided, int64(seq))
+		}
+	}()
+
+	go func() { // KVSExecutor: applies decisions in order, and sleeps until a notification if a slot is not decided
+		defer wg.Done()
+		for seq := uint32(0); seq < nSlots; seq++ {
+			s := l.Get(seq % L)
+			dec, ok := s.GetDecision()
+			for s.Term != seq/L || !ok {
+				<-l.Decided()
+				s = l.Get(seq % L)
+				dec, ok = s.GetDecision()
+			}
+			if dec.SvrSeq != seq || dec.ProSeq != seq {
+				t.Errorf("KVSExecutor: slot %d has decision %v", seq, dec)
+			}
+			l.SetApplied(seq + 1)
+		}
+	}()
+
+	wg.Wait()
+	if decided != nSlots-1 || l.Applied() != nSlots {
+		t.Errorf("decided %d slots and applied %d slots, want %d", decided+1, l.Applied(), nSlots)
+	}
+}
@@ -52,6 +52,9 @@ import (
 	subId: subroutine id -- e.g., a consensus instance's id
 */
 func GetLogFilePathAndName(component string, svrId, subId uint32) string {
+	if config.Conf.NGroups > 1 && config.Conf.Role == "svr" { // server ids are only unique within a Rabia group
+		component = fmt.Sprintf("%s.g%d", component, config.Conf.GroupId)
+	}
 	fileName := fmt.Sprintf("/logs/ns%d-nf%d-nc%d-nC%d-to%d-tt%d-cb%d-pb%d-pt%d-nb%d-nt%d--%s-%d-%d.log",
 		config.Conf.NServers, config.Conf.NFaulty, config.Conf.NClients, config.Conf.NConcurrency,
 		int64(config.Conf.ClientTimeout.Seconds()), config.Conf.ClientThinkTime, config.Conf.ClientBatchSize,
@@ -0,0 +1,342 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package message
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/runtime/protoiface"
+	"google.golang.org/protobuf/runtime/protoimpl"
+)
+
+/*
+	codec.go defines the wire codecs that serialize Msg and Command objects. A codec is chosen through Conf.Codec, and
+	the endpoints in the tcp package agree on it during their handshakes, so that we can compare codecs (see
+	deployment/serialization_test) without editing the code:
+
+	"gogo": the code generated by gogo-protobuf (message.pb.go), the default
+	"proto": the vanilla protobuf, which serializes the gogo-protobuf objects through reflection; it produces the same
+		bytes as "gogo", but it is slower
+	"binary": a hand-rolled format, see binaryCodec below
+
+	A codec serializes an object into a pooled Buf (see pool.go), and it decodes into the object that it is given, so
+	that a pooled ConsensusObj in Msg.Obj is reused (see ReadDecode in message.go). The frames that carry the bytes are
+	the same for all codecs, see section 3 of the comment in message.go.
+*/
+type Codec interface {
+	Name() string
+	MarshalMsg(m *Msg) (*Buf, error)
+	UnmarshalMsg(data []byte, m *Msg) error
+	MarshalCommand(c *Command) (*Buf, error)
+	UnmarshalCommand(data []byte, c *Command) error
+}
+
+var (
+	GogoCodec   Codec = gogoCodec{}
+	ProtoCodec  Codec = protoCodec{}
+	BinaryCodec Codec = binaryCodec{}
+)
+
+/*
+	Returns the codec of a name in Conf.Codec, an empty name stands for "gogo"
+*/
+func CodecByName(name string) (Codec, error) {
+	switch name {
+	case "", "gogo":
+		return GogoCodec, nil
+	case "proto":
+		return ProtoCodec, nil
+	case "binary":
+		return BinaryCodec, nil
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+type gogoCodec struct{}
+
+func (gogoCodec) Name() string { return "gogo" }
+
+func (gogoCodec) MarshalMsg(m *Msg) (*Buf, error) {
+	b := GetBuf(m.Size())
+	if _, err := m.MarshalToSizedBuffer(b.Data); err != nil {
+		b.Release()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (gogoCodec) UnmarshalMsg(data []byte, m *Msg) error {
+	return m.Unmarshal(data)
+}
+
+func (gogoCodec) MarshalCommand(c *Command) (*Buf, error) {
+	b := GetBuf(c.Size())
+	if _, err := c.MarshalToSizedBuffer(b.Data); err != nil {
+		b.Release()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (gogoCodec) UnmarshalCommand(data []byte, c *Command) error {
+	return c.Unmarshal(data)
+}
+
+/*
+	The vanilla protobuf codec, the objects generated by gogo-protobuf are wrapped as (legacy) protobuf messages
+*/
+type protoCodec struct{}
+
+func (protoCodec) Name() string { return "proto" }
+
+func (protoCodec) marshal(m protoiface.MessageV1) (*Buf, error) {
+	b := GetBuf(0)
+	data, err := proto.MarshalOptions{}.MarshalAppend(b.Data, protoimpl.X.ProtoMessageV2Of(m))
+	if err != nil {
+		b.Release()
+		return nil, err
+	}
+	b.Data = data
+	return b, nil
+}
+
+func (protoCodec) unmarshal(data []byte, m protoiface.MessageV1) error {
+	return proto.UnmarshalOptions{Merge: true}.Unmarshal(data, protoimpl.X.ProtoMessageV2Of(m))
+}
+
+func (c protoCodec) MarshalMsg(m *Msg) (*Buf, error) { return c.marshal(m) }
+
+func (c protoCodec) UnmarshalMsg(data []byte, m *Msg) error { return c.unmarshal(data, m) }
+
+func (c protoCodec) MarshalCommand(r *Command) (*Buf, error) { return c.marshal(r) }
+
+func (c protoCodec) UnmarshalCommand(data []byte, r *Command) error { return c.unmarshal(data, r) }
+
+/*
+	A hand-rolled binary codec. Fields are written in a fixed order without tags: each integer is a varint (uint32
+	fields are unsigned varints and Timestamp is a signed one), each bool is a byte, each array is its length followed by
+	its elements, and each string is its length followed by its bytes. A Msg is written as
+
+		Type | Phase | Value | Dst | 0 (no Obj) or 1 followed by the Obj
+
+	a ConsensusObj as
+
+		ProId | ProSeq | SvrSeq | IsNull | Timestamp | CliIds | CliSeqs | CliLens | Commands
+
+	and a Command as
+
+		CliId | CliSeq | SvrSeq | WatchId | Commands
+*/
+type binaryCodec struct{}
+
+var errTruncated = errors.New("binary codec: truncated or invalid data")
+
+func (binaryCodec) Name() string { return "binary" }
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+func appendUint32s(dst []byte, vs []uint32) []byte {
+	dst = appendUvarint(dst, uint64(len(vs)))
+	for _, v := range vs {
+		dst = appendUvarint(dst, uint64(v))
+	}
+	return dst
+}
+
+func appendStrings(dst []byte, ss []string) []byte {
+	dst = appendUvarint(dst, uint64(len(ss)))
+	for _, s := range ss {
+		dst = appendUvarint(dst, uint64(len(s)))
+		dst = append(dst, s...)
+	}
+	return dst
+}
+
+func appendObj(dst []byte, o *ConsensusObj) []byte {
+	dst = appendUvarint(dst, uint64(o.ProId))
+	dst = appendUvarint(dst, uint64(o.ProSeq))
+	dst = appendUvarint(dst, uint64(o.SvrSeq))
+	if o.IsNull {
+		dst = append(dst, 1)
+	} else {
+		dst = append(dst, 0)
+	}
+	dst = appendUvarint(dst, uint64(o.Timestamp<<1^o.Timestamp>>63)) // zig-zag, as binary.PutVarint
+	dst = appendUint32s(dst, o.CliIds)
+	dst = appendUint32s(dst, o.CliSeqs)
+	dst = appendUint32s(dst, o.CliLens)
+	return appendStrings(dst, o.Commands)
+}
+
+func (binaryCodec) MarshalMsg(m *Msg) (*Buf, error) {
+	b := GetBuf(0)
+	data := b.Data
+	data = appendUvarint(data, uint64(m.Type))
+	data = appendUvarint(data, uint64(m.Phase))
+	data = appendUvarint(data, uint64(m.Value))
+	data = appendUvarint(data, uint64(m.Dst))
+	if m.Obj == nil {
+		data = append(data, 0)
+	} else {
+		data = appendObj(append(data, 1), m.Obj)
+	}
+	b.Data = data
+	return b, nil
+}
+
+func (binaryCodec) MarshalCommand(c *Command) (*Buf, error) {
+	b := GetBuf(0)
+	data := b.Data
+	data = appendUvarint(data, uint64(c.CliId))
+	data = appendUvarint(data, uint64(c.CliSeq))
+	data = appendUvarint(data, uint64(c.SvrSeq))
+	data = appendUvarint(data, uint64(c.WatchId))
+	b.Data = appendStrings(data, c.Commands)
+	return b, nil
+}
+
+/*
+	Reads the binary format, the first error sticks, and the getters return zeros after it
+*/
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errTruncated
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) uint32() uint32 {
+	v := r.uvarint()
+	if v > 1<<32-1 {
+		r.err = errTruncated
+	}
+	return uint32(v)
+}
+
+func (r *binaryReader) byte() byte {
+	if r.err != nil || len(r.data) == 0 {
+		r.err = errTruncated
+		return 0
+	}
+	v := r.data[0]
+	r.data = r.data[1:]
+	return v
+}
+
+// Returns the length of an array, which cannot exceed the num. of remaining bytes (each element takes >= 1 byte)
+func (r *binaryReader) length() int {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		r.err = errTruncated
+		return 0
+	}
+	return int(n)
+}
+
+func (r *binaryReader) uint32s() []uint32 {
+	n := r.length()
+	if n == 0 {
+		return nil
+	}
+	vs := make([]uint32, n)
+	for i := range vs {
+		vs[i] = r.uint32()
+	}
+	return vs
+}
+
+func (r *binaryReader) strings() []string {
+	n := r.length()
+	if n == 0 {
+		return nil
+	}
+	ss := make([]string, n)
+	for i := range ss {
+		l := r.length()
+		if r.err != nil {
+			return nil
+		}
+		ss[i] = string(r.data[:l])
+		r.data = r.data[l:]
+	}
+	return ss
+}
+
+func (r *binaryReader) obj(o *ConsensusObj) {
+	o.ProId = r.uint32()
+	o.ProSeq = r.uint32()
+	o.SvrSeq = r.uint32()
+	o.IsNull = r.byte() != 0
+	t := r.uvarint()
+	o.Timestamp = int64(t>>1) ^ -int64(t&1)
+	o.CliIds = r.uint32s()
+	o.CliSeqs = r.uint32s()
+	o.CliLens = r.uint32s()
+	o.Commands = r.strings()
+}
+
+func (r *binaryReader) done() error {
+	if r.err == nil && len(r.data) != 0 {
+		r.err = errTruncated
+	}
+	return r.err
+}
+
+func (binaryCodec) UnmarshalMsg(data []byte, m *Msg) error {
+	r := binaryReader{data: data}
+	m.Type = MsgType(r.uint32())
+	m.Phase = r.uint32()
+	m.Value = r.uint32()
+	m.Dst = r.uint32()
+	if r.byte() == 0 {
+		m.Obj = nil
+	} else {
+		if m.Obj == nil {
+			m.Obj = &ConsensusObj{}
+		}
+		r.obj(m.Obj)
+	}
+	return r.done()
+}
+
+func (binaryCodec) UnmarshalCommand(data []byte, c *Command) error {
+	r := binaryReader{data: data}
+	c.CliId = r.uint32()
+	c.CliSeq = r.uint32()
+	c.SvrSeq = r.uint32()
+	c.WatchId = r.uint32()
+	c.Commands = r.strings()
+	return r.done()
+}
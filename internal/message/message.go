@@ -18,8 +18,11 @@ package message
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	. "rabia/internal/config"
 	"strconv"
 )
 
@@ -30,7 +33,8 @@ import (
 	ConsensusObj, and Msg objects, where ConsensusObj is embedded in Msg for server-server transmission.
 
 	msg.go defines several messaging-related helper functions that facilitate ConsensusObj comparison, Command
-	serialization, and Msg serialization.
+	serialization, and Msg serialization. codec.go defines the wire codecs that serialize objects (gogo-protobuf by
+	default, see Conf.Codec), and pool.go defines the buffer and object pools used in serialization.
 
 	msg.pb.go, defines the serialization & de-serialization schema of messaging objects, and it is auto-generated by
 	gogo-protobuf based on definitions in msg.proto.
@@ -62,16 +66,59 @@ import (
 	3. Notes on on-wire data format:
 
 	We send and receive messages through native TCP channels. Since we did not use the gob package to serialize and send
-	messages (which are too slow for our purpose) but use gogo-protobuf to serialize instead, we need to define how
-	messages are represented on wires. Say the length of a message in bytes is N, we always use 4 bytes to send the
+	messages (which are too slow for our purpose) but use a codec (e.g., gogo-protobuf) to serialize instead, we need to
+	define how messages are represented on wires. Say the length of a message in bytes is N, we always use 4 bytes to send the
 	number N, and then send those N bytes. We do so for the next message so lengths of messages and the actual data
 	appear alternatives on wire. At the reader end, we first read 4 bytes to determine how much we want to read next and
 	then read the whole message. In this way, we avoid the possibility of reading a partial message or force all
 	messages to have the same size. What we have done here is indeed a common practice.
 
 		Reader <-- the number N | msg 1 (N bytes) | the number M | msg 2 (M bytes) | ... <-- Writer
+
+	A message longer than Conf.MaxFrameSize bytes (e.g., a batch of large values) is sent in chunks of at most
+	Conf.MaxFrameSize bytes, and each chunk is sent like a message above. The highest bit of the 4-byte number
+	(frameMore) is set if more chunks of the same message follow, so the number of a chunk is N | frameMore, and the
+	reader appends chunks until a chunk without the bit. The reader checks each number before it reads the chunk, and it
+	returns an error instead of reading a chunk longer than Conf.MaxFrameSize bytes or a message longer than
+	Conf.MaxMsgSize bytes, so a peer cannot make the reader allocate unbounded memory.
+
+		Reader <-- N1 | frameMore | chunk 1 (N1 bytes) | N2 | chunk 2 (N2 bytes) | the number M | msg 2 | ... <-- Writer
+
+	Each frame (a message or a chunk) starts with a 9-byte header: a version byte (FrameVersion), the 4-byte number
+	above, and the 4-byte CRC-32C checksum of the frame's data. The reader rejects a frame of another version or with a
+	wrong checksum, so a corrupt or hostile frame is detected instead of being decoded.
+
+		Frame: version (1 byte) | N or N | frameMore (4 bytes) | checksum (4 bytes) | data (N bytes)
+
+	All errors about malformed input wrap ErrMalformed, i.e., errors.Is(err, ErrMalformed) is true. The reader cannot
+	find the next frame after a malformed frame, so the connection should be closed, see the tcp package.
+
+	4. Notes on memory allocation:
+
+	Servers send and receive messages at high rates, so the functions here avoid allocating memory per message: frame
+	headers are written byte by byte to and peeked from the bufio objects, messages are serialized into pooled buffers
+	(Buf in pool.go), and Msg.ReadUnmarshal decodes a message's ConsensusObj into a pooled object. A routine that is
+	done with a received Msg (and that keeps no pointer to its ConsensusObj) may return the object through
+	PutConsensusObj, see the consensus package's MsgHandler. (A Msg itself is passed by value, so it is not allocated
+	on the heap.)
 */
 
+const (
+	FrameVersion    = 1       // the version of the frame format above
+	frameHeaderSize = 9       // the size of a frame header
+	frameMore       = 1 << 31 // the bit of a frame's length that tells more chunks of the same message follow the frame
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	ErrMalformed     = errors.New("malformed input")
+	ErrFrameTooLarge = fmt.Errorf("%w: frame exceeds Conf.MaxFrameSize", ErrMalformed)
+	ErrMsgTooLarge   = fmt.Errorf("%w: message exceeds Conf.MaxMsgSize", ErrMalformed)
+	ErrFrameVersion  = fmt.Errorf("%w: unknown frame version", ErrMalformed)
+	ErrFrameChecksum = fmt.Errorf("%w: frame checksum mismatch", ErrMalformed)
+)
+
 /*
 	vanilla protobuf variables
 */
@@ -105,114 +152,270 @@ func ProxySeqIdLessThan(c1 *ConsensusObj, c2 *ConsensusObj) bool {
 	return c1.ProSeq < c2.ProSeq || c1.ProSeq == c2.ProSeq && c1.ProId < c2.ProId
 }
 
+/*
+	Compares whether consensus object c1 is less than c2 by their Timestamp fields, ties are broken by the less-than
+	relation above.
+*/
+func TimestampLessThan(c1 *ConsensusObj, c2 *ConsensusObj) bool {
+	return c1.Timestamp < c2.Timestamp || c1.Timestamp == c2.Timestamp && ProxySeqIdLessThan(c1, c2)
+}
+
 /*
 	Purpose:
-		writes a byte array to a bufio.Writer (writer). We first write the length of the byte array and then write the
-		actual data.
+		writes a byte array to a bufio.Writer (writer). We first write the frame header (which includes the length of
+		the byte array) and then write the actual data. If the array is longer than Conf.MaxFrameSize, it is written in
+		chunks (see section 3 above).
 	Upon errors/exceptions:
 		when the reader closes its connection, the writer may or may NOT return any error.
 	Parameters:
 		writer: the bufio.Writer that binds to the TCP connection
 		data: the source of data (the whole array) that will be written
 	Return value(s):
-		success: it returns the length of the data written and nil as the err field.
-		failure: it returns the error message (the int field is not that useful)
+		success: it returns nil.
+		failure: it returns the error message
 */
 func BufWrite(writer *bufio.Writer, data []byte) error {
-	lenBuf := make([]byte, 4)
-	binary.LittleEndian.PutUint32(lenBuf, uint32(len(data)))
-	n1, err := writer.Write(lenBuf)
-	if n1 != 4 {
-		panic(fmt.Sprint("should not happen", err))
+	for {
+		chunk, more := data, uint32(0)
+		if Conf.MaxFrameSize > 0 && len(chunk) > Conf.MaxFrameSize {
+			chunk, more = data[:Conf.MaxFrameSize], frameMore
+		}
+		if err := writer.WriteByte(FrameVersion); err != nil {
+			return err
+		}
+		if err := writeUint32(writer, uint32(len(chunk))|more); err != nil {
+			return err
+		}
+		if err := writeUint32(writer, crc32.Checksum(chunk, crcTable)); err != nil {
+			return err
+		}
+		if _, err := writer.Write(chunk); err != nil || more == 0 {
+			return err
+		}
+		data = data[len(chunk):]
 	}
-	if err != nil {
-		return err
-	}
-	n2, err := writer.Write(data)
-	if n2 != len(data) {
-		panic(fmt.Sprint("should not happen", err))
+}
+
+/*
+	Writes a number in little endian, byte by byte, so that no array is allocated for it
+*/
+func writeUint32(writer *bufio.Writer, v uint32) error {
+	for i := 0; i < 4; i++ {
+		if err := writer.WriteByte(byte(v >> (8 * i))); err != nil {
+			return err
+		}
 	}
-	return err
+	return nil
 }
 
 /*
 	Purpose:
 		reads a byte array from a bufio.Reader (reader) to an array called data. We first read the length of the byte
-		array and then read the actual data because that's how data and its size are passed from the writer end.
+		array and then read the actual data because that's how data and its size are passed from the writer end. If the
+		array is sent in chunks (see section 3 above), the chunks are joined.
 	Upon errors/exceptions:
-		if the sender closes the connection, err may become EOF.
+		if the sender closes the connection, err may become EOF. If a frame is malformed (see section 3 above), err
+		wraps ErrMalformed, and the reader should not be read anymore because the rest of the array is not consumed.
 	Parameters:
 		reader: the bufio.Reader that binds to the TCP connection
-		data: where the data should be read to (its size should be larger than the length of incoming data)
+		data: where the data should be read to, if it is shorter than the incoming data, a larger array is allocated
 	Return value(s):
-		success: it returns the length of the data and nil as err.
-		failure: it returns the error message (but the int field is not that useful)
+		success: it returns the data (a prefix of data or the larger array) and nil as err.
+		failure: it returns the error message (the data returned is not that useful)
 */
-func BufRead(reader *bufio.Reader, data []byte) (int, error) {
-	lenBuf := make([]byte, 4)
-	n1, err := io.ReadFull(reader, lenBuf)
-	if n1 != 4 || err != nil {
-		return n1, err
+func BufRead(reader *bufio.Reader, data []byte) ([]byte, error) {
+	total := 0
+	for {
+		header, err := reader.Peek(frameHeaderSize) // the header stays in the reader's buffer, it is not copied
+		if err != nil {
+			if err == io.EOF && len(header) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return data[:total], err
+		}
+		if header[0] != FrameVersion {
+			return data[:total], ErrFrameVersion
+		}
+		n2 := binary.LittleEndian.Uint32(header[1:5])
+		checksum := binary.LittleEndian.Uint32(header[5:9])
+		_, _ = reader.Discard(frameHeaderSize) // header is invalid from now on
+		more, n := n2&frameMore != 0, int(n2&^frameMore)
+		if Conf.MaxFrameSize > 0 && n > Conf.MaxFrameSize {
+			return data[:total], ErrFrameTooLarge
+		}
+		if Conf.MaxMsgSize > 0 && total+n > Conf.MaxMsgSize {
+			return data[:total], ErrMsgTooLarge
+		}
+		if total+n > len(data) {
+			larger := make([]byte, total+n)
+			copy(larger, data[:total])
+			data = larger
+		}
+		n3, err := io.ReadFull(reader, data[total:total+n])
+		if err != nil {
+			return data[:total+n3], err
+		}
+		if crc32.Checksum(data[total:total+n], crcTable) != checksum {
+			return data[:total], ErrFrameChecksum
+		}
+		total += n
+		if !more {
+			return data[:total], nil
+		}
 	}
-	n2 := binary.LittleEndian.Uint32(lenBuf)
-	n3, err := io.ReadFull(reader, data[:n2])
-	if int(n2) != n3 {
-		panic(fmt.Sprint("should not happen", err, int(n2), n3))
-	}
-	return n3, nil
 }
 
 /*
 	Writes and flushes a serialized message -- writes its length and the data and then flush the writer
 */
-func WriteFlush(writer *bufio.Writer, data []byte) {
-	err := BufWrite(writer, data)
+func WriteFlush(writer *bufio.Writer, data []byte) error {
+	if err := BufWrite(writer, data); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+/*
+	Serializes a Command object with a codec and writes its bytes to a writer without flushing the writer, so that
+	several objects can be sent in one flush
+*/
+func (r *Command) EncodeWrite(codec Codec, writer *bufio.Writer) error {
+	b, err := codec.MarshalCommand(r)
 	if err != nil {
-		panic(fmt.Sprint("should not happen", err))
+		return err
 	}
-	err = writer.Flush()
+	return b.Write(writer)
+}
+
+// Serializes a Command object with a codec and flush its bytes to a writer
+func (r *Command) EncodeWriteFlush(codec Codec, writer *bufio.Writer) error {
+	b, err := codec.MarshalCommand(r)
 	if err != nil {
-		panic(fmt.Sprint("should not happen", err))
+		return err
 	}
+	return b.WriteFlush(writer)
 }
 
-// maybe: the error of BufWrite below may be ignored
-// Serializes a Command object and flush its bytes to a writer
+// Reads from a bufio.Reader and then de-serializes bytes to a Command object with a codec
+func (r *Command) ReadDecode(codec Codec, reader *bufio.Reader, readBuf []byte) error {
+	data, err := BufRead(reader, readBuf)
+	if err != nil {
+		return err
+	}
+	if err = codec.UnmarshalCommand(data, r); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return nil
+}
+
+// Serializes a Command object with gogo-protobuf and flush its bytes to a writer (e.g., for handshakes)
 func (r *Command) MarshalWriteFlush(writer *bufio.Writer) error {
-	data, err := r.Marshal() // gogo-protobuf
-	//data, err := proto.Marshal(r) // vanilla protobuf
-	err = BufWrite(writer, data)
-	err = writer.Flush()
-	return err
+	return r.EncodeWriteFlush(GogoCodec, writer)
 }
 
-// Reads from a bufio.Reader and then de-serializes bytes to a Command object
+// Reads from a bufio.Reader and then de-serializes bytes to a Command object with gogo-protobuf
 func (r *Command) ReadUnmarshal(reader *bufio.Reader, readBuf []byte) error {
-	n, err := BufRead(reader, readBuf)
+	return r.ReadDecode(GogoCodec, reader, readBuf)
+}
+
+// Serializes a Msg object with a codec and flush its bytes to a writer
+func (r *Msg) EncodeWriteFlush(codec Codec, writer *bufio.Writer) error {
+	b, err := codec.MarshalMsg(r)
 	if err != nil {
 		return err
 	}
-	err = r.Unmarshal(readBuf[:n]) // gogo-protobuf
-	//err = proto.Unmarshal(readBuf[:n], r) // vanilla protobuf
-	return err
+	return b.WriteFlush(writer)
+}
+
+/*
+	Reads from a bufio.Reader and then de-serializes bytes to a Msg object with a codec. The message's ConsensusObj is
+	taken from the pool (see section 4 above), except for a ProposalRequest, which carries no object. (So a message of
+	another type without an object may be decoded as if it carries an empty object.)
+*/
+func (r *Msg) ReadDecode(codec Codec, reader *bufio.Reader, readBuf []byte) (error, int) {
+	data, err := BufRead(reader, readBuf)
+	if err != nil {
+		return err, len(data)
+	}
+	var obj *ConsensusObj
+	if r.Obj == nil {
+		obj = GetConsensusObj()
+		r.Obj = obj
+	}
+	err = codec.UnmarshalMsg(data, r)
+	if err == nil && r.Type == ProposalRequest {
+		r.Obj = nil
+	}
+	if obj != nil && r.Obj != obj { // the pooled object is not used
+		PutConsensusObj(obj)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err), len(data)
+	}
+	return nil, len(data)
 }
 
-// Serializes a Msg object and flush its bytes to a writer
+// Serializes a Msg object with gogo-protobuf and flush its bytes to a writer
 func (r *Msg) MarshalWriteFlush(writer *bufio.Writer) error {
-	data, err := r.Marshal() // gogo-protobuf
-	//data, err := proto.Marshal(r) // vanilla protobuf
-	err = BufWrite(writer, data)
-	err = writer.Flush()
-	return err
+	return r.EncodeWriteFlush(GogoCodec, writer)
 }
 
-// Reads from a bufio.Reader and then de-serializes bytes to a Msg object
+// Reads from a bufio.Reader and then de-serializes bytes to a Msg object with gogo-protobuf
 func (r *Msg) ReadUnmarshal(reader *bufio.Reader, readBuf []byte) (error, int) {
-	n, err := BufRead(reader, readBuf)
-	if err != nil {
-		return err, n
+	return r.ReadDecode(GogoCodec, reader, readBuf)
+}
+
+/*
+	Checks that a Msg received from a peer can be handled without indexing out of range: the message type is known,
+	each message type but ProposalRequest carries a consistent consensus object, and the server ids and the phase and
+	value of a binary consensus message are within their ranges. It returns an error that wraps ErrMalformed if not.
+*/
+func (r *Msg) Validate() error {
+	if _, ok := MsgType_name[int32(r.Type)]; !ok {
+		return fmt.Errorf("%w: unknown message type %d", ErrMalformed, r.Type)
+	}
+	if r.Dst > uint32(Conf.NServers) {
+		return fmt.Errorf("%w: destination %d out of range", ErrMalformed, r.Dst)
+	}
+	switch r.Type {
+	case ProposalRequest, ProposalReply: // Phase is a server id
+		if r.Phase >= uint32(Conf.NServers) {
+			return fmt.Errorf("%w: server id %d out of range", ErrMalformed, r.Phase)
+		}
+	case State, Vote:
+		if r.Phase >= uint32(Conf.LenBlockArray) || r.Value > 2 {
+			return fmt.Errorf("%w: phase %d or value %d out of range", ErrMalformed, r.Phase, r.Value)
+		}
+	}
+	if r.Type == ProposalRequest {
+		return nil
+	}
+	if r.Obj == nil {
+		return fmt.Errorf("%w: %v message without a consensus object", ErrMalformed, r.Type)
+	}
+	return r.Obj.Validate()
+}
+
+/*
+	Checks that the client ids, client sequences, client request lengths, and commands of a ConsensusObj match each
+	other (see message.proto), so that a proxy can apply the object. It returns an error that wraps ErrMalformed if not.
+*/
+func (r *ConsensusObj) Validate() error {
+	if len(r.CliSeqs) != len(r.CliIds) {
+		return fmt.Errorf("%w: %d client ids but %d client sequences", ErrMalformed, len(r.CliIds), len(r.CliSeqs))
+	}
+	cmds := len(r.CliIds) * Conf.ClientBatchSize
+	if len(r.CliLens) != 0 {
+		if len(r.CliLens) != len(r.CliIds) {
+			return fmt.Errorf("%w: %d client ids but %d client lengths", ErrMalformed, len(r.CliIds), len(r.CliLens))
+		}
+		cmds = 0
+		for _, n := range r.CliLens {
+			cmds += int(n)
+		}
+	}
+	if cmds != len(r.Commands) {
+		return fmt.Errorf("%w: %d commands but %d expected", ErrMalformed, len(r.Commands), cmds)
 	}
-	err = r.Unmarshal(readBuf[:n]) // gogo-protobuf
-	//err = proto.Unmarshal(readBuf[:n], r) // vanilla protobuf
-	return err, n
+	return nil
 }
@@ -52,8 +52,9 @@ const _ = proto.GoGoProtoPackageIsVersion3 // please upgrade the proto package
 //from consensus to network, among networks, from network to consensus
 //
 //ProposalRequest:
-//Phase: SvrId (the source server's id), Value: the sequence number of the proposal
-//from Executor to the local network layer then to another network layer (based on message.Value?)
+//Phase: SvrId (the source server's id), Value: the sequence number of the proposal, Dst: 0 if the request is
+//broadcast, otherwise the destination server's id + 1
+//from Executor to the local network layer then to other network layers (based on message.Dst)
 //
 //ProposalReply:
 //Phase: the destination server's id, Value: the sequence number of the proposal
@@ -109,9 +110,13 @@ func (MsgType) EnumDescriptor() ([]byte, []int) {
 //CliId:  the from/to client id
 //CliSeq: the client sequence
 //SvrSeq: the decided slot # (from proxy to client only)
+//WatchId: non-zero if the object carries the changes of a decided slot to a watch rather than a reply, see watch.go in
+//the kvs package (from proxy to client only)
 //Commands:
 //each command in the array looks is of the form <operation type><key>[<value>], e.g., 0key1val1 and 1key2 are
 //both valid. Regarding the operation type, 0 stands for a write operation and 1 stands for a read operation.
+//Other operation types (delete, compare-and-swap, increment, and set-if-absent) and their reply formats are
+//defined in the kvs package.
 //
 //Each command is a string of 17 bytes (modifiable through Conf.KeyLen and Conf.ValLen)
 //[0:1]   (1 byte): "0" == a write operation,  "1" == a read operation
@@ -122,6 +127,7 @@ type Command struct {
 	CliSeq   uint32   `protobuf:"varint,2,opt,name=CliSeq,proto3" json:"CliSeq,omitempty"`
 	SvrSeq   uint32   `protobuf:"varint,3,opt,name=SvrSeq,proto3" json:"SvrSeq,omitempty"`
 	Commands []string `protobuf:"bytes,4,rep,name=Commands,proto3" json:"Commands,omitempty"`
+	WatchId  uint32   `protobuf:"varint,5,opt,name=WatchId,proto3" json:"WatchId,omitempty"`
 }
 
 func (m *Command) Reset()      { *m = Command{} }
@@ -181,14 +187,22 @@ var xxx_messageInfo_Command proto.InternalMessageInfo
 //CliIds:   the client id's that are associated with commands
 //CliSeqs:  the client sequences that are associated with commands
 //Commands: the clients' commands
+//CliLens:  the number of commands in each client request, in the order of CliIds. If it is empty, each client request
+//has Conf.ClientBatchSize commands. (A client request may have fewer commands when the client splits a
+//request among Rabia groups, see the shard package.)
+//Timestamp: the time (ns since the Unix epoch) when the proxy creates this object. Proxies' clocks are only loosely
+//synchronized, so replicas that order objects by timestamps (see Conf.Ordering) hold an object for a while
+//before proposing it, see TimeQueue in the queue package.
 type ConsensusObj struct {
-	ProId    uint32   `protobuf:"varint,1,opt,name=ProId,proto3" json:"ProId,omitempty"`
-	ProSeq   uint32   `protobuf:"varint,2,opt,name=ProSeq,proto3" json:"ProSeq,omitempty"`
-	SvrSeq   uint32   `protobuf:"varint,3,opt,name=SvrSeq,proto3" json:"SvrSeq,omitempty"`
-	IsNull   bool     `protobuf:"varint,4,opt,name=IsNull,proto3" json:"IsNull,omitempty"`
-	CliIds   []uint32 `protobuf:"varint,5,rep,packed,name=CliIds,proto3" json:"CliIds,omitempty"`
-	CliSeqs  []uint32 `protobuf:"varint,6,rep,packed,name=CliSeqs,proto3" json:"CliSeqs,omitempty"`
-	Commands []string `protobuf:"bytes,7,rep,name=Commands,proto3" json:"Commands,omitempty"`
+	ProId     uint32   `protobuf:"varint,1,opt,name=ProId,proto3" json:"ProId,omitempty"`
+	ProSeq    uint32   `protobuf:"varint,2,opt,name=ProSeq,proto3" json:"ProSeq,omitempty"`
+	SvrSeq    uint32   `protobuf:"varint,3,opt,name=SvrSeq,proto3" json:"SvrSeq,omitempty"`
+	IsNull    bool     `protobuf:"varint,4,opt,name=IsNull,proto3" json:"IsNull,omitempty"`
+	CliIds    []uint32 `protobuf:"varint,5,rep,packed,name=CliIds,proto3" json:"CliIds,omitempty"`
+	CliSeqs   []uint32 `protobuf:"varint,6,rep,packed,name=CliSeqs,proto3" json:"CliSeqs,omitempty"`
+	Commands  []string `protobuf:"bytes,7,rep,name=Commands,proto3" json:"Commands,omitempty"`
+	CliLens   []uint32 `protobuf:"varint,8,rep,packed,name=CliLens,proto3" json:"CliLens,omitempty"`
+	Timestamp int64    `protobuf:"varint,9,opt,name=Timestamp,proto3" json:"Timestamp,omitempty"`
 }
 
 func (m *ConsensusObj) Reset()      { *m = ConsensusObj{} }
@@ -231,6 +245,9 @@ var xxx_messageInfo_ConsensusObj proto.InternalMessageInfo
 //Phase:  the phase of the message
 //Value: reserved for special occasions, see below
 //Obj: a pointer to a consensus object, could be null for binary consensus messages and other cases
+//Dst: the unicast peer's id + 1 (0: none). When a message is sent, the destination of a ProposalRequest, see above,
+//or of a Decision that answers a lagging peer (see answerOldMsg); when a message is received from a peer, the
+//sender, as NetTCP's RecvHandler sets it
 //
 //The usages of the Value field:
 //State, and Vote messages: my binary consensus message of phase P round R
@@ -242,6 +259,7 @@ type Msg struct {
 	Phase uint32        `protobuf:"varint,2,opt,name=Phase,proto3" json:"Phase,omitempty"`
 	Value uint32        `protobuf:"varint,3,opt,name=Value,proto3" json:"Value,omitempty"`
 	Obj   *ConsensusObj `protobuf:"bytes,4,opt,name=Obj,proto3" json:"Obj,omitempty"`
+	Dst   uint32        `protobuf:"varint,5,opt,name=Dst,proto3" json:"Dst,omitempty"`
 }
 
 func (m *Msg) Reset()      { *m = Msg{} }
@@ -286,36 +304,39 @@ func init() {
 func init() { proto.RegisterFile("message.proto", fileDescriptor_33c57e4bae7b9afd) }
 
 var fileDescriptor_33c57e4bae7b9afd = []byte{
-	// 451 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x92, 0x31, 0x6f, 0xd3, 0x40,
-	0x18, 0x86, 0x7d, 0xb5, 0x63, 0xa7, 0x1f, 0x0d, 0x98, 0x03, 0x2a, 0xab, 0xc3, 0xa7, 0xa8, 0x42,
-	0x22, 0x42, 0x22, 0x95, 0xca, 0x3f, 0xc0, 0x5d, 0x32, 0x94, 0x46, 0x0e, 0xea, 0x6e, 0x37, 0x87,
-	0xeb, 0xe2, 0xf8, 0x52, 0x9f, 0x8d, 0xd4, 0xad, 0x3f, 0x81, 0x9f, 0xc1, 0x4f, 0x40, 0x4c, 0x8c,
-	0x1d, 0x33, 0x76, 0xc4, 0x97, 0x85, 0xb1, 0x23, 0x23, 0xba, 0xf3, 0xb9, 0x0d, 0x48, 0x6c, 0x7e,
-	0xde, 0xef, 0xee, 0x7d, 0xdf, 0xcf, 0x36, 0x0c, 0x16, 0x4c, 0x88, 0x38, 0x65, 0xe3, 0x65, 0xc9,
-	0x2b, 0x4e, 0x3d, 0x83, 0x7b, 0x6f, 0xd2, 0xac, 0x3a, 0xaf, 0x93, 0xf1, 0x19, 0x5f, 0x1c, 0xa4,
-	0x3c, 0xe5, 0x07, 0x7a, 0x9e, 0xd4, 0x1f, 0x35, 0x69, 0xd0, 0x4f, 0xed, 0xbd, 0xfd, 0x4f, 0xe0,
-	0x85, 0x7c, 0xb1, 0x88, 0x8b, 0x39, 0x7d, 0x0e, 0xbd, 0x30, 0xcf, 0x26, 0xf3, 0x80, 0x0c, 0xc9,
-	0x68, 0x10, 0xb5, 0x40, 0x77, 0xc1, 0x0d, 0xf3, 0x6c, 0xc6, 0x2e, 0x83, 0x2d, 0x2d, 0x1b, 0x52,
-	0xfa, 0xec, 0x73, 0xa9, 0x74, 0xbb, 0xd5, 0x5b, 0xa2, 0x7b, 0xd0, 0x37, 0x86, 0x22, 0x70, 0x86,
-	0xf6, 0x68, 0x3b, 0xba, 0xe7, 0xfd, 0xef, 0x04, 0x76, 0x42, 0x5e, 0x08, 0x56, 0x88, 0x5a, 0x9c,
-	0x24, 0x17, 0x2a, 0x72, 0x5a, 0xf2, 0x87, 0x48, 0x0d, 0xca, 0x7a, 0x5a, 0xf2, 0x8d, 0xc8, 0x96,
-	0xfe, 0x1b, 0xb9, 0x0b, 0xee, 0x44, 0xbc, 0xaf, 0xf3, 0x3c, 0x70, 0x86, 0x64, 0xd4, 0x8f, 0x0c,
-	0x99, 0xea, 0x93, 0xb9, 0x08, 0x7a, 0x43, 0xdb, 0x54, 0x9f, 0xcc, 0x05, 0x0d, 0xc0, 0x6b, 0x97,
-	0x10, 0x81, 0xab, 0x07, 0x1d, 0xfe, 0x55, 0xde, 0xfb, 0xa7, 0xfc, 0x35, 0x01, 0xfb, 0x58, 0xa4,
-	0xf4, 0x25, 0x38, 0x1f, 0xae, 0x96, 0x4c, 0x57, 0x7e, 0x7c, 0xe8, 0x8f, 0xbb, 0xef, 0x70, 0x2c,
-	0x52, 0xa5, 0x47, 0x7a, 0xaa, 0x37, 0x3b, 0x8f, 0x05, 0x33, 0x2b, 0xb4, 0xa0, 0xd4, 0xd3, 0x38,
-	0xaf, 0x99, 0x59, 0xa0, 0x05, 0xfa, 0x0a, 0xec, 0x93, 0xe4, 0x42, 0x97, 0x7f, 0x74, 0xf8, 0xe2,
-	0xde, 0x70, 0xf3, 0x4d, 0x45, 0xea, 0xc4, 0xeb, 0x1a, 0x3c, 0x93, 0x42, 0x9f, 0xc2, 0x20, 0xcc,
-	0x33, 0x56, 0x54, 0x11, 0xbb, 0xac, 0x99, 0xa8, 0x7c, 0x8b, 0xee, 0x40, 0x7f, 0x5a, 0xf2, 0x25,
-	0x17, 0x71, 0xee, 0x13, 0xba, 0x0d, 0xbd, 0x59, 0x15, 0x57, 0xcc, 0xdf, 0xa2, 0x7d, 0x70, 0x4e,
-	0x79, 0xc5, 0x7c, 0x9b, 0x3e, 0x83, 0x27, 0xdd, 0x91, 0xee, 0x9e, 0xa3, 0xac, 0x1e, 0xc4, 0x65,
-	0x7e, 0xe5, 0xf7, 0x94, 0xd5, 0x11, 0x3b, 0xcb, 0x44, 0xc6, 0x0b, 0xdf, 0x7d, 0x77, 0x74, 0xd3,
-	0xa0, 0xb5, 0x6a, 0xd0, 0xba, 0x6d, 0xd0, 0xba, 0x6b, 0x90, 0xfc, 0x6e, 0x90, 0x5c, 0x4b, 0x24,
-	0x5f, 0x25, 0x92, 0x6f, 0x12, 0xc9, 0x0f, 0x89, 0xe4, 0x46, 0x22, 0x59, 0x49, 0x24, 0x3f, 0x25,
-	0x92, 0x5f, 0x12, 0xad, 0x3b, 0x89, 0xe4, 0xcb, 0x1a, 0xad, 0xd5, 0x1a, 0xad, 0xdb, 0x35, 0x5a,
-	0x89, 0xab, 0x7f, 0xb8, 0xb7, 0x7f, 0x02, 0x00, 0x00, 0xff, 0xff, 0xf1, 0xe6, 0xd5, 0x35, 0xb9,
-	0x02, 0x00, 0x00,
+	// 502 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x92, 0x4f, 0x6f, 0xd3, 0x30,
+	0x18, 0xc6, 0xe3, 0xa5, 0x7f, 0x52, 0xb3, 0x42, 0x30, 0x30, 0x59, 0x13, 0xb2, 0xa2, 0x0a, 0x89,
+	0x0a, 0x89, 0x4e, 0x1a, 0xdf, 0x80, 0xf4, 0x12, 0x89, 0xb1, 0x2a, 0x9d, 0xc6, 0x39, 0x69, 0x4d,
+	0x9a, 0x29, 0x89, 0xb3, 0xd8, 0x41, 0xda, 0x8d, 0x0b, 0x77, 0xc4, 0xa7, 0xe0, 0x23, 0x70, 0xe4,
+	0xb8, 0x63, 0x8f, 0x3b, 0x92, 0xf4, 0xc2, 0x71, 0xe2, 0xc4, 0x11, 0xd9, 0x71, 0xda, 0x21, 0xc4,
+	0xcd, 0xbf, 0xe7, 0xf5, 0xfb, 0xfa, 0x79, 0x6c, 0xc3, 0x61, 0x4a, 0x39, 0x0f, 0x22, 0x3a, 0xc9,
+	0x0b, 0x26, 0x18, 0xea, 0x6b, 0x3c, 0x7c, 0x19, 0xc5, 0x62, 0x55, 0x86, 0x93, 0x05, 0x4b, 0x8f,
+	0x22, 0x16, 0xb1, 0x23, 0x55, 0x0f, 0xcb, 0xf7, 0x8a, 0x14, 0xa8, 0x55, 0xd3, 0x37, 0xfa, 0x04,
+	0x60, 0xdf, 0x65, 0x69, 0x1a, 0x64, 0x4b, 0xf4, 0x18, 0x76, 0xdd, 0x24, 0xf6, 0x96, 0x18, 0x38,
+	0x60, 0x3c, 0xf4, 0x1b, 0x40, 0x07, 0xb0, 0xe7, 0x26, 0xf1, 0x9c, 0x5e, 0xe2, 0x3d, 0x25, 0x6b,
+	0x92, 0xfa, 0xfc, 0x43, 0x21, 0x75, 0xb3, 0xd1, 0x1b, 0x42, 0x87, 0xd0, 0xd2, 0x03, 0x39, 0xee,
+	0x38, 0xe6, 0x78, 0xe0, 0x6f, 0x19, 0x61, 0xd8, 0x7f, 0x17, 0x88, 0xc5, 0xca, 0x5b, 0xe2, 0xae,
+	0x6a, 0x6a, 0x71, 0xf4, 0x0b, 0xc0, 0x7d, 0x97, 0x65, 0x9c, 0x66, 0xbc, 0xe4, 0xa7, 0xe1, 0x85,
+	0x34, 0x33, 0x2b, 0xd8, 0xce, 0x8c, 0x02, 0x79, 0xe8, 0xac, 0x60, 0x77, 0xcc, 0x34, 0xf4, 0x5f,
+	0x33, 0x07, 0xb0, 0xe7, 0xf1, 0xb7, 0x65, 0x92, 0xe0, 0x8e, 0x03, 0xc6, 0x96, 0xaf, 0x49, 0x87,
+	0xf2, 0x96, 0x1c, 0x77, 0x1d, 0x53, 0x87, 0xf2, 0x1a, 0x83, 0x4d, 0x3c, 0x8e, 0x7b, 0xaa, 0xd0,
+	0xe2, 0x5f, 0xb1, 0xfa, 0xff, 0xc6, 0x72, 0x93, 0xf8, 0x0d, 0xcd, 0x38, 0xb6, 0xb6, 0x5d, 0x12,
+	0xd1, 0x53, 0x38, 0x38, 0x8b, 0x53, 0xca, 0x45, 0x90, 0xe6, 0x78, 0xe0, 0x80, 0xb1, 0xe9, 0xef,
+	0x84, 0xd1, 0x17, 0x00, 0xcd, 0x13, 0x1e, 0xa1, 0x67, 0xb0, 0x73, 0x76, 0x95, 0x53, 0x15, 0xf5,
+	0xfe, 0xb1, 0x3d, 0x69, 0x9f, 0xf6, 0x84, 0x47, 0x52, 0xf7, 0x55, 0x55, 0xdd, 0xc8, 0x2a, 0xe0,
+	0x54, 0x47, 0x6f, 0x40, 0xaa, 0xe7, 0x41, 0x52, 0x52, 0x1d, 0xbc, 0x01, 0xf4, 0x1c, 0x9a, 0xa7,
+	0xe1, 0x85, 0x0a, 0x7d, 0xef, 0xf8, 0xc9, 0x76, 0xe0, 0xdd, 0x1b, 0xf6, 0xe5, 0x0e, 0x64, 0x43,
+	0x73, 0xca, 0x85, 0x7e, 0x0d, 0xb9, 0x7c, 0x51, 0xc2, 0xbe, 0x3e, 0x17, 0x3d, 0x84, 0x43, 0x37,
+	0x89, 0x69, 0x26, 0x7c, 0x7a, 0x59, 0x52, 0x2e, 0x6c, 0x03, 0xed, 0x43, 0x6b, 0x56, 0xb0, 0x9c,
+	0xf1, 0x20, 0xb1, 0x01, 0x1a, 0xc0, 0xee, 0x5c, 0x04, 0x82, 0xda, 0x7b, 0xc8, 0x82, 0x9d, 0x73,
+	0x26, 0xa8, 0x6d, 0xa2, 0x47, 0xf0, 0x41, 0xbb, 0xa5, 0xed, 0xeb, 0xc8, 0x51, 0x3b, 0x31, 0x4f,
+	0xae, 0xec, 0xae, 0x1c, 0x35, 0xa5, 0x8b, 0x98, 0xc7, 0x2c, 0xb3, 0x7b, 0xaf, 0xa7, 0xd7, 0x15,
+	0x31, 0xd6, 0x15, 0x31, 0x6e, 0x2a, 0x62, 0xdc, 0x56, 0x04, 0xfc, 0xae, 0x08, 0xf8, 0x58, 0x13,
+	0xf0, 0xb5, 0x26, 0xe0, 0x5b, 0x4d, 0xc0, 0xf7, 0x9a, 0x80, 0xeb, 0x9a, 0x80, 0x75, 0x4d, 0xc0,
+	0x8f, 0x9a, 0x80, 0x9f, 0x35, 0x31, 0x6e, 0x6b, 0x02, 0x3e, 0x6f, 0x88, 0xb1, 0xde, 0x10, 0xe3,
+	0x66, 0x43, 0x8c, 0xb0, 0xa7, 0x7e, 0xf5, 0xab, 0x3f, 0x01, 0x00, 0x00, 0xff, 0xff, 0xf9, 0x3f,
+	0x71, 0x94, 0x1e, 0x03, 0x00, 0x00,
 }
 
 func (x MsgType) String() string {
@@ -361,6 +382,9 @@ func (this *Command) Equal(that interface{}) bool {
 			return false
 		}
 	}
+	if this.WatchId != that1.WatchId {
+		return false
+	}
 	return true
 }
 func (this *ConsensusObj) Equal(that interface{}) bool {
@@ -418,6 +442,17 @@ func (this *ConsensusObj) Equal(that interface{}) bool {
 			return false
 		}
 	}
+	if len(this.CliLens) != len(that1.CliLens) {
+		return false
+	}
+	for i := range this.CliLens {
+		if this.CliLens[i] != that1.CliLens[i] {
+			return false
+		}
+	}
+	if this.Timestamp != that1.Timestamp {
+		return false
+	}
 	return true
 }
 func (this *Msg) Equal(that interface{}) bool {
@@ -451,18 +486,22 @@ func (this *Msg) Equal(that interface{}) bool {
 	if !this.Obj.Equal(that1.Obj) {
 		return false
 	}
+	if this.Dst != that1.Dst {
+		return false
+	}
 	return true
 }
 func (this *Command) GoString() string {
 	if this == nil {
 		return "nil"
 	}
-	s := make([]string, 0, 8)
+	s := make([]string, 0, 9)
 	s = append(s, "&message.Command{")
 	s = append(s, "CliId: "+fmt.Sprintf("%#v", this.CliId)+",\n")
 	s = append(s, "CliSeq: "+fmt.Sprintf("%#v", this.CliSeq)+",\n")
 	s = append(s, "SvrSeq: "+fmt.Sprintf("%#v", this.SvrSeq)+",\n")
 	s = append(s, "Commands: "+fmt.Sprintf("%#v", this.Commands)+",\n")
+	s = append(s, "WatchId: "+fmt.Sprintf("%#v", this.WatchId)+",\n")
 	s = append(s, "}")
 	return strings.Join(s, "")
 }
@@ -470,7 +509,7 @@ func (this *ConsensusObj) GoString() string {
 	if this == nil {
 		return "nil"
 	}
-	s := make([]string, 0, 11)
+	s := make([]string, 0, 13)
 	s = append(s, "&message.ConsensusObj{")
 	s = append(s, "ProId: "+fmt.Sprintf("%#v", this.ProId)+",\n")
 	s = append(s, "ProSeq: "+fmt.Sprintf("%#v", this.ProSeq)+",\n")
@@ -479,6 +518,8 @@ func (this *ConsensusObj) GoString() string {
 	s = append(s, "CliIds: "+fmt.Sprintf("%#v", this.CliIds)+",\n")
 	s = append(s, "CliSeqs: "+fmt.Sprintf("%#v", this.CliSeqs)+",\n")
 	s = append(s, "Commands: "+fmt.Sprintf("%#v", this.Commands)+",\n")
+	s = append(s, "CliLens: "+fmt.Sprintf("%#v", this.CliLens)+",\n")
+	s = append(s, "Timestamp: "+fmt.Sprintf("%#v", this.Timestamp)+",\n")
 	s = append(s, "}")
 	return strings.Join(s, "")
 }
@@ -486,7 +527,7 @@ func (this *Msg) GoString() string {
 	if this == nil {
 		return "nil"
 	}
-	s := make([]string, 0, 8)
+	s := make([]string, 0, 9)
 	s = append(s, "&message.Msg{")
 	s = append(s, "Type: "+fmt.Sprintf("%#v", this.Type)+",\n")
 	s = append(s, "Phase: "+fmt.Sprintf("%#v", this.Phase)+",\n")
@@ -494,6 +535,7 @@ func (this *Msg) GoString() string {
 	if this.Obj != nil {
 		s = append(s, "Obj: "+fmt.Sprintf("%#v", this.Obj)+",\n")
 	}
+	s = append(s, "Dst: "+fmt.Sprintf("%#v", this.Dst)+",\n")
 	s = append(s, "}")
 	return strings.Join(s, "")
 }
@@ -525,6 +567,11 @@ func (m *Command) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.WatchId != 0 {
+		i = encodeVarintMessage(dAtA, i, uint64(m.WatchId))
+		i--
+		dAtA[i] = 0x28
+	}
 	if len(m.Commands) > 0 {
 		for iNdEx := len(m.Commands) - 1; iNdEx >= 0; iNdEx-- {
 			i -= len(m.Commands[iNdEx])
@@ -572,19 +619,15 @@ func (m *ConsensusObj) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
-	if len(m.Commands) > 0 {
-		for iNdEx := len(m.Commands) - 1; iNdEx >= 0; iNdEx-- {
-			i -= len(m.Commands[iNdEx])
-			copy(dAtA[i:], m.Commands[iNdEx])
-			i = encodeVarintMessage(dAtA, i, uint64(len(m.Commands[iNdEx])))
-			i--
-			dAtA[i] = 0x3a
-		}
+	if m.Timestamp != 0 {
+		i = encodeVarintMessage(dAtA, i, uint64(m.Timestamp))
+		i--
+		dAtA[i] = 0x48
 	}
-	if len(m.CliSeqs) > 0 {
-		dAtA2 := make([]byte, len(m.CliSeqs)*10)
+	if len(m.CliLens) > 0 {
+		dAtA2 := make([]byte, len(m.CliLens)*10)
 		var j1 int
-		for _, num := range m.CliSeqs {
+		for _, num := range m.CliLens {
 			for num >= 1<<7 {
 				dAtA2[j1] = uint8(uint64(num)&0x7f | 0x80)
 				num >>= 7
@@ -597,12 +640,21 @@ func (m *ConsensusObj) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		copy(dAtA[i:], dAtA2[:j1])
 		i = encodeVarintMessage(dAtA, i, uint64(j1))
 		i--
-		dAtA[i] = 0x32
+		dAtA[i] = 0x42
 	}
-	if len(m.CliIds) > 0 {
-		dAtA4 := make([]byte, len(m.CliIds)*10)
+	if len(m.Commands) > 0 {
+		for iNdEx := len(m.Commands) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.Commands[iNdEx])
+			copy(dAtA[i:], m.Commands[iNdEx])
+			i = encodeVarintMessage(dAtA, i, uint64(len(m.Commands[iNdEx])))
+			i--
+			dAtA[i] = 0x3a
+		}
+	}
+	if len(m.CliSeqs) > 0 {
+		dAtA4 := make([]byte, len(m.CliSeqs)*10)
 		var j3 int
-		for _, num := range m.CliIds {
+		for _, num := range m.CliSeqs {
 			for num >= 1<<7 {
 				dAtA4[j3] = uint8(uint64(num)&0x7f | 0x80)
 				num >>= 7
@@ -615,6 +667,24 @@ func (m *ConsensusObj) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		copy(dAtA[i:], dAtA4[:j3])
 		i = encodeVarintMessage(dAtA, i, uint64(j3))
 		i--
+		dAtA[i] = 0x32
+	}
+	if len(m.CliIds) > 0 {
+		dAtA6 := make([]byte, len(m.CliIds)*10)
+		var j5 int
+		for _, num := range m.CliIds {
+			for num >= 1<<7 {
+				dAtA6[j5] = uint8(uint64(num)&0x7f | 0x80)
+				num >>= 7
+				j5++
+			}
+			dAtA6[j5] = uint8(num)
+			j5++
+		}
+		i -= j5
+		copy(dAtA[i:], dAtA6[:j5])
+		i = encodeVarintMessage(dAtA, i, uint64(j5))
+		i--
 		dAtA[i] = 0x2a
 	}
 	if m.IsNull {
@@ -665,6 +735,11 @@ func (m *Msg) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.Dst != 0 {
+		i = encodeVarintMessage(dAtA, i, uint64(m.Dst))
+		i--
+		dAtA[i] = 0x28
+	}
 	if m.Obj != nil {
 		{
 			size, err := m.Obj.MarshalToSizedBuffer(dAtA[:i])
@@ -716,6 +791,7 @@ func NewPopulatedCommand(r randyMessage, easy bool) *Command {
 	for i := 0; i < v1; i++ {
 		this.Commands[i] = string(randStringMessage(r))
 	}
+	this.WatchId = uint32(r.Uint32())
 	if !easy && r.Intn(10) != 0 {
 	}
 	return this
@@ -742,6 +818,15 @@ func NewPopulatedConsensusObj(r randyMessage, easy bool) *ConsensusObj {
 	for i := 0; i < v4; i++ {
 		this.Commands[i] = string(randStringMessage(r))
 	}
+	v5 := r.Intn(10)
+	this.CliLens = make([]uint32, v5)
+	for i := 0; i < v5; i++ {
+		this.CliLens[i] = uint32(r.Uint32())
+	}
+	this.Timestamp = int64(r.Int63())
+	if r.Intn(2) == 0 {
+		this.Timestamp *= -1
+	}
 	if !easy && r.Intn(10) != 0 {
 	}
 	return this
@@ -755,6 +840,7 @@ func NewPopulatedMsg(r randyMessage, easy bool) *Msg {
 	if r.Intn(5) != 0 {
 		this.Obj = NewPopulatedConsensusObj(r, easy)
 	}
+	this.Dst = uint32(r.Uint32())
 	if !easy && r.Intn(10) != 0 {
 	}
 	return this
@@ -779,9 +865,9 @@ func randUTF8RuneMessage(r randyMessage) rune {
 	return rune(ru + 61)
 }
 func randStringMessage(r randyMessage) string {
-	v5 := r.Intn(100)
-	tmps := make([]rune, v5)
-	for i := 0; i < v5; i++ {
+	v6 := r.Intn(100)
+	tmps := make([]rune, v6)
+	for i := 0; i < v6; i++ {
 		tmps[i] = randUTF8RuneMessage(r)
 	}
 	return string(tmps)
@@ -803,11 +889,11 @@ func randFieldMessage(dAtA []byte, r randyMessage, fieldNumber int, wire int) []
 	switch wire {
 	case 0:
 		dAtA = encodeVarintPopulateMessage(dAtA, uint64(key))
-		v6 := r.Int63()
+		v7 := r.Int63()
 		if r.Intn(2) == 0 {
-			v6 *= -1
+			v7 *= -1
 		}
-		dAtA = encodeVarintPopulateMessage(dAtA, uint64(v6))
+		dAtA = encodeVarintPopulateMessage(dAtA, uint64(v7))
 	case 1:
 		dAtA = encodeVarintPopulateMessage(dAtA, uint64(key))
 		dAtA = append(dAtA, byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)))
@@ -853,6 +939,9 @@ func (m *Command) Size() (n int) {
 			n += 1 + l + sovMessage(uint64(l))
 		}
 	}
+	if m.WatchId != 0 {
+		n += 1 + sovMessage(uint64(m.WatchId))
+	}
 	return n
 }
 
@@ -894,6 +983,16 @@ func (m *ConsensusObj) Size() (n int) {
 			n += 1 + l + sovMessage(uint64(l))
 		}
 	}
+	if len(m.CliLens) > 0 {
+		l = 0
+		for _, e := range m.CliLens {
+			l += sovMessage(uint64(e))
+		}
+		n += 1 + sovMessage(uint64(l)) + l
+	}
+	if m.Timestamp != 0 {
+		n += 1 + sovMessage(uint64(m.Timestamp))
+	}
 	return n
 }
 
@@ -916,6 +1015,9 @@ func (m *Msg) Size() (n int) {
 		l = m.Obj.Size()
 		n += 1 + l + sovMessage(uint64(l))
 	}
+	if m.Dst != 0 {
+		n += 1 + sovMessage(uint64(m.Dst))
+	}
 	return n
 }
 
@@ -934,6 +1036,7 @@ func (this *Command) String() string {
 		`CliSeq:` + fmt.Sprintf("%v", this.CliSeq) + `,`,
 		`SvrSeq:` + fmt.Sprintf("%v", this.SvrSeq) + `,`,
 		`Commands:` + fmt.Sprintf("%v", this.Commands) + `,`,
+		`WatchId:` + fmt.Sprintf("%v", this.WatchId) + `,`,
 		`}`,
 	}, "")
 	return s
@@ -950,6 +1053,8 @@ func (this *ConsensusObj) String() string {
 		`CliIds:` + fmt.Sprintf("%v", this.CliIds) + `,`,
 		`CliSeqs:` + fmt.Sprintf("%v", this.CliSeqs) + `,`,
 		`Commands:` + fmt.Sprintf("%v", this.Commands) + `,`,
+		`CliLens:` + fmt.Sprintf("%v", this.CliLens) + `,`,
+		`Timestamp:` + fmt.Sprintf("%v", this.Timestamp) + `,`,
 		`}`,
 	}, "")
 	return s
@@ -963,6 +1068,7 @@ func (this *Msg) String() string {
 		`Phase:` + fmt.Sprintf("%v", this.Phase) + `,`,
 		`Value:` + fmt.Sprintf("%v", this.Value) + `,`,
 		`Obj:` + strings.Replace(this.Obj.String(), "ConsensusObj", "ConsensusObj", 1) + `,`,
+		`Dst:` + fmt.Sprintf("%v", this.Dst) + `,`,
 		`}`,
 	}, "")
 	return s
@@ -1093,6 +1199,25 @@ func (m *Command) Unmarshal(dAtA []byte) error {
 			}
 			m.Commands = append(m.Commands, string(dAtA[iNdEx:postIndex]))
 			iNdEx = postIndex
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field WatchId", wireType)
+			}
+			m.WatchId = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.WatchId |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipMessage(dAtA[iNdEx:])
@@ -1404,6 +1529,101 @@ func (m *ConsensusObj) Unmarshal(dAtA []byte) error {
 			}
 			m.Commands = append(m.Commands, string(dAtA[iNdEx:postIndex]))
 			iNdEx = postIndex
+		case 8:
+			if wireType == 0 {
+				var v uint32
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowMessage
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					v |= uint32(b&0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				m.CliLens = append(m.CliLens, v)
+			} else if wireType == 2 {
+				var packedLen int
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowMessage
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					packedLen |= int(b&0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				if packedLen < 0 {
+					return ErrInvalidLengthMessage
+				}
+				postIndex := iNdEx + packedLen
+				if postIndex < 0 {
+					return ErrInvalidLengthMessage
+				}
+				if postIndex > l {
+					return io.ErrUnexpectedEOF
+				}
+				var elementCount int
+				var count int
+				for _, integer := range dAtA[iNdEx:postIndex] {
+					if integer < 128 {
+						count++
+					}
+				}
+				elementCount = count
+				if elementCount != 0 && len(m.CliLens) == 0 {
+					m.CliLens = make([]uint32, 0, elementCount)
+				}
+				for iNdEx < postIndex {
+					var v uint32
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowMessage
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						v |= uint32(b&0x7F) << shift
+						if b < 0x80 {
+							break
+						}
+					}
+					m.CliLens = append(m.CliLens, v)
+				}
+			} else {
+				return fmt.Errorf("proto: wrong wireType = %d for field CliLens", wireType)
+			}
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Timestamp", wireType)
+			}
+			m.Timestamp = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Timestamp |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipMessage(dAtA[iNdEx:])
@@ -1547,6 +1767,25 @@ func (m *Msg) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Dst", wireType)
+			}
+			m.Dst = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Dst |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipMessage(dAtA[iNdEx:])
@@ -0,0 +1,255 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	. "rabia/internal/config"
+	"testing"
+)
+
+func TestBufWriteRead_Chunks(t *testing.T) {
+	Conf.MaxFrameSize, Conf.MaxMsgSize = 16, 1024
+	var wire bytes.Buffer
+	writer := bufio.NewWriter(&wire)
+	msgs := [][]byte{bytes.Repeat([]byte("v"), 100), []byte("small"), bytes.Repeat([]byte("w"), 32), {}}
+	for _, m := range msgs {
+		if err := BufWrite(writer, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(&wire)
+	readBuf := make([]byte, 20) // shorter than the first message
+	for i, m := range msgs {
+		data, err := BufRead(reader, readBuf)
+		if err != nil || !bytes.Equal(data, m) {
+			t.Fatalf("message %d: got %q, %v, want %q", i, data, err, m)
+		}
+	}
+}
+
+func TestBufRead_Limits(t *testing.T) {
+	Conf.MaxFrameSize, Conf.MaxMsgSize = 16, 40
+	frame := func(n uint32) []byte {
+		b := make([]byte, frameHeaderSize+n&^frameMore)
+		b[0] = FrameVersion
+		binary.LittleEndian.PutUint32(b[1:5], n)
+		binary.LittleEndian.PutUint32(b[5:9], crc32.Checksum(b[frameHeaderSize:], crcTable))
+		return b
+	}
+
+	// a frame longer than Conf.MaxFrameSize is rejected before its data is read
+	_, err := BufRead(bufio.NewReader(bytes.NewReader(frame(17))), nil)
+	if err != ErrFrameTooLarge {
+		t.Errorf("got %v, want ErrFrameTooLarge", err)
+	}
+
+	// so are chunks that add up to more than Conf.MaxMsgSize
+	var wire []byte
+	for i := 0; i < 3; i++ {
+		wire = append(wire, frame(16|frameMore)...)
+	}
+	_, err = BufRead(bufio.NewReader(bytes.NewReader(wire)), nil)
+	if err != ErrMsgTooLarge {
+		t.Errorf("got %v, want ErrMsgTooLarge", err)
+	}
+}
+
+func TestBufRead_Corrupt(t *testing.T) {
+	Conf.MaxFrameSize, Conf.MaxMsgSize = 0, 0
+	var wire bytes.Buffer
+	writer := bufio.NewWriter(&wire)
+	if err := BufWrite(writer, []byte("0key1val1")); err != nil || writer.Flush() != nil {
+		t.Fatal(err)
+	}
+	good := wire.Bytes()
+
+	for name, tc := range map[string]struct {
+		pos  int
+		want error
+	}{"version": {0, ErrFrameVersion}, "length": {1, ErrFrameChecksum}, "checksum": {5, ErrFrameChecksum},
+		"data": {frameHeaderSize + 2, ErrFrameChecksum}} {
+		bad := append([]byte(nil), good...)
+		bad[tc.pos] ^= 0x01
+		if tc.pos == 1 { // a shorter frame that is still complete
+			bad = bad[:len(bad)-1]
+		}
+		_, err := BufRead(bufio.NewReader(bytes.NewReader(bad)), nil)
+		if err != tc.want || !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: got %v, want %v", name, err, tc.want)
+		}
+	}
+}
+
+func TestMsg_Validate(t *testing.T) {
+	Conf.NServers, Conf.LenBlockArray, Conf.ClientBatchSize = 3, 10, 2
+	obj := &ConsensusObj{CliIds: []uint32{0, 1}, CliSeqs: []uint32{5, 6}, Commands: []string{"a", "b", "c"},
+		CliLens: []uint32{1, 2}}
+	valid := []Msg{{Type: ClientRequest, Obj: obj}, {Type: ProposalRequest, Phase: 2, Dst: 3},
+		{Type: Vote, Phase: 9, Value: 2, Obj: &ConsensusObj{IsNull: true}}}
+	for _, m := range valid {
+		if err := m.Validate(); err != nil {
+			t.Errorf("%v: %v", m, err)
+		}
+	}
+	invalid := []Msg{{Type: 7, Obj: obj}, {Type: Proposal}, {Type: ProposalRequest, Phase: 3},
+		{Type: ProposalRequest, Dst: 4}, {Type: State, Phase: 10, Obj: obj}, {Type: Vote, Value: 3, Obj: obj},
+		{Type: Decision, Obj: &ConsensusObj{CliIds: []uint32{0}}},
+		{Type: Decision, Obj: &ConsensusObj{CliIds: []uint32{0}, CliSeqs: []uint32{0}, Commands: []string{"a"}}}}
+	for _, m := range invalid {
+		if err := m.Validate(); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%v: got %v, want ErrMalformed", m, err)
+		}
+	}
+}
+
+func TestMsg_WriteReadPooled(t *testing.T) {
+	Conf.MaxFrameSize, Conf.MaxMsgSize = 1<<20, 1<<20
+	var wire bytes.Buffer
+	writer := bufio.NewWriter(&wire)
+	msgs := []Msg{{Type: ProposalRequest, Phase: 1, Value: 7}, {Type: State, Phase: 2, Value: 1,
+		Obj: &ConsensusObj{SvrSeq: 7}}, {Type: Proposal, Obj: &ConsensusObj{ProId: 1, ProSeq: 2, SvrSeq: 7,
+		CliIds: []uint32{0}, CliSeqs: []uint32{3}, Commands: []string{"0key1val1"}}}}
+	for _, m := range msgs {
+		if err := m.MarshalWriteFlush(writer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader := bufio.NewReader(&wire)
+	readBuf := make([]byte, 64)
+	for _, want := range msgs {
+		var m Msg
+		if err, _ := m.ReadUnmarshal(reader, readBuf); err != nil {
+			t.Fatal(err)
+		}
+		if !m.Equal(&want) {
+			t.Errorf("got %v, want %v", m, want)
+		}
+		PutConsensusObj(m.Obj)
+	}
+}
+
+func BenchmarkMsg_WriteRead(b *testing.B) {
+	Conf.MaxFrameSize, Conf.MaxMsgSize = 1<<20, 1<<20
+	writer := bufio.NewWriter(ioutil.Discard)
+	var wire bytes.Buffer
+	m := Msg{Type: Vote, Phase: 1, Value: 2, Obj: &ConsensusObj{SvrSeq: 1000}}
+	_ = m.MarshalWriteFlush(bufio.NewWriter(&wire))
+	frame := wire.Bytes()
+	src := bytes.NewReader(frame)
+	reader := bufio.NewReader(src)
+	readBuf := make([]byte, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := m.MarshalWriteFlush(writer); err != nil {
+			b.Fatal(err)
+		}
+		src.Reset(frame)
+		reader.Reset(src)
+		var r Msg
+		if err, _ := r.ReadUnmarshal(reader, readBuf); err != nil {
+			b.Fatal(err)
+		}
+		PutConsensusObj(r.Obj)
+	}
+}
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	msgs := []Msg{{Type: ProposalRequest, Phase: 1, Value: 7, Dst: 2}, {Type: Vote, Phase: 2, Value: 1,
+		Obj: &ConsensusObj{SvrSeq: 1<<32 - 1}}, {Type: ClientRequest, Obj: &ConsensusObj{ProId: 1, ProSeq: 2,
+		IsNull: true, Timestamp: -5, CliIds: []uint32{0, 3}, CliSeqs: []uint32{3, 4}, CliLens: []uint32{1, 1},
+		Commands: []string{"0key1val1", ""}}}}
+	cmds := []Command{{CliId: 1, CliSeq: 2, SvrSeq: 3, WatchId: 4, Commands: []string{"gogo"}}, {}}
+	for _, name := range []string{"gogo", "proto", "binary"} {
+		codec, err := CodecByName(name)
+		if err != nil || codec.Name() != name {
+			t.Fatal(name, err)
+		}
+		for _, want := range msgs {
+			b, err := codec.MarshalMsg(&want)
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			var m Msg
+			if err := codec.UnmarshalMsg(b.Data, &m); err != nil || !m.Equal(&want) {
+				t.Errorf("%s: got %v (%v), want %v", name, m, err, want)
+			}
+			b.Release()
+		}
+		for _, want := range cmds {
+			b, err := codec.MarshalCommand(&want)
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			var c Command
+			if err := codec.UnmarshalCommand(b.Data, &c); err != nil || !c.Equal(&want) {
+				t.Errorf("%s: got %v (%v), want %v", name, c, err, want)
+			}
+			b.Release()
+		}
+	}
+	if _, err := CodecByName("gob"); err == nil {
+		t.Error("got nil, want an error for an unknown codec")
+	}
+}
+
+func TestBinaryCodec_Truncated(t *testing.T) {
+	m := Msg{Type: Proposal, Obj: &ConsensusObj{CliIds: []uint32{1}, CliSeqs: []uint32{2}, Commands: []string{"ab"}}}
+	b, _ := BinaryCodec.MarshalMsg(&m)
+	for i := 0; i < len(b.Data); i++ {
+		var r Msg
+		if err := BinaryCodec.UnmarshalMsg(b.Data[:i], &r); err == nil {
+			t.Errorf("%d of %d bytes: got nil, want an error", i, len(b.Data))
+		}
+	}
+	var r Msg
+	if err := BinaryCodec.UnmarshalMsg(append(b.Data, 0), &r); err == nil {
+		t.Error("trailing byte: got nil, want an error")
+	}
+}
+
+func BenchmarkCodecs(b *testing.B) {
+	m := Msg{Type: Proposal, Obj: &ConsensusObj{ProId: 1, ProSeq: 1000, SvrSeq: 1000, Timestamp: 1 << 60,
+		CliIds: []uint32{0, 1, 2, 3, 4}, CliSeqs: []uint32{10, 11, 12, 13, 14}, CliLens: []uint32{2, 2, 2, 2, 2},
+		Commands: []string{"0key1val1", "1key2", "0key3val3", "1key4", "0key5val5", "1key6", "0key7val7", "1key8",
+			"0key9val9", "1key0"}}}
+	for _, codec := range []Codec{GogoCodec, ProtoCodec, BinaryCodec} {
+		b.Run(codec.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf, err := codec.MarshalMsg(&m)
+				if err != nil {
+					b.Fatal(err)
+				}
+				var r Msg
+				if err := codec.UnmarshalMsg(buf.Data, &r); err != nil {
+					b.Fatal(err)
+				}
+				buf.Release()
+			}
+		})
+	}
+}
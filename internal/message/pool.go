@@ -0,0 +1,108 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package message
+
+import (
+	"bufio"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	pool.go defines the buffer and object pools that let servers send and receive messages without allocating memory for
+	each message (see section 4 of the package comment in message.go). Codecs serialize messages into pooled buffers,
+	see codec.go.
+*/
+
+/*
+	A pooled byte array that holds a serialized message. A Buf may be shared by several routines (e.g., the SendHandlers
+	of all peers), so it counts its references: GetBuf and the Marshal methods of codecs return a Buf with one
+	reference, Retain adds references, and Release drops one. The last Release returns the Buf to the pool, after which
+	its Data must not be accessed.
+*/
+type Buf struct {
+	Data []byte
+	refs int32
+}
+
+var bufPool = sync.Pool{New: func() interface{} { return &Buf{Data: make([]byte, 0, 4096)} }}
+
+/*
+	Returns a Buf of size bytes with one reference
+*/
+func GetBuf(size int) *Buf {
+	b := bufPool.Get().(*Buf)
+	if cap(b.Data) < size {
+		b.Data = make([]byte, size)
+	}
+	b.Data = b.Data[:size]
+	b.refs = 1
+	return b
+}
+
+// Adds n references to a Buf
+func (b *Buf) Retain(n int) {
+	atomic.AddInt32(&b.refs, int32(n))
+}
+
+// Drops a reference to a Buf, and returns the Buf to the pool if it is the last reference
+func (b *Buf) Release() {
+	if refs := atomic.AddInt32(&b.refs, -1); refs == 0 {
+		bufPool.Put(b)
+	} else if refs < 0 {
+		panic("should not happen, a Buf is released more times than it is referenced")
+	}
+}
+
+/*
+	Writes a pooled Buf to a writer as a frame (see BufWrite) without flushing the writer, and releases the Buf
+*/
+func (b *Buf) Write(writer *bufio.Writer) error {
+	err := BufWrite(writer, b.Data)
+	b.Release()
+	return err
+}
+
+/*
+	Writes a pooled Buf to a writer as a frame (see BufWrite) and releases the Buf, then flushes the writer
+*/
+func (b *Buf) WriteFlush(writer *bufio.Writer) error {
+	if err := b.Write(writer); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+var objPool = sync.Pool{New: func() interface{} { return &ConsensusObj{} }}
+
+/*
+	Returns a zeroed ConsensusObj from the pool
+*/
+func GetConsensusObj() *ConsensusObj {
+	return objPool.Get().(*ConsensusObj)
+}
+
+/*
+	Returns a ConsensusObj to the pool. Call it only if no routine holds the pointer anymore (copies of the object are
+	fine, the object's slices are not reused).
+*/
+func PutConsensusObj(obj *ConsensusObj) {
+	if obj == nil {
+		return
+	}
+	obj.Reset()
+	objPool.Put(obj)
+}
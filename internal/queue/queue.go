@@ -24,41 +24,288 @@
 	2. Each consensus instance has its pending request queue, which means a server can have more than one queue when
 	Concurrency is greater than 1.
 	3. The priority queue follows the example at https://golang.org/pkg/container/heap
+	4. The queue indexes its objects by their ids (see ConsensusObj.GetIdSeq), so that the consensus instance removes
+	an object in O(log n) time as soon as a slot decides it, instead of skipping it when it is popped later.
+	5. There are three orders of pending requests, see the Queue interface below: PQueue orders objects by the less-than
+	relation of the message package, FairQueue serves proxies in a round-robin way, and TimeQueue (see timequeue.go)
+	orders objects by their timestamps.
 */
 package queue
 
-import "rabia/internal/message"
+import (
+	"container/heap"
+	"rabia/internal/message"
+	"sort"
+	"time"
+)
 
-type PQueue []message.ConsensusObj
+/*
+	The pending request queue of a consensus instance. Every replica must pop the same object when it holds the same
+	objects and has decided the same slots, so that replicas propose the same object for a slot.
+*/
+type Queue interface {
+	Len() int
+	Push(obj message.ConsensusObj)
+	Pop() (message.ConsensusObj, bool)
+	Remove(obj *message.ConsensusObj)             // removes a decided object, see PQueue.Remove
+	Forget(obj *message.ConsensusObj)             // cancels an earlier Remove call, see PQueue.Forget
+	Served(obj *message.ConsensusObj, seq uint32) // records that slot seq has decided obj
+	Hold() time.Duration                          // how long Pop holds the head object back, 0 if it does not
+}
+
+// A queued consensus object and its id
+type item struct {
+	obj message.ConsensusObj
+	id  string
+}
+
+/*
+	items implements heap.Interface, and it keeps the index (id -> position) up to date whenever it moves an item.
+
+	Note: do not call its Push and Pop directly, instead, call heap.Push and heap.Pop, which call them and perform
+	sorting.
+*/
+type items struct {
+	list  []item
+	index map[string]int
+	less  func(c1, c2 *message.ConsensusObj) bool
+}
+
+func (h *items) Len() int {
+	return len(h.list)
+}
+
+//  The priority is defined by the less function, e.g., ProxySeqIdLessThan (see that function's comment)
+func (h *items) Less(i, j int) bool {
+	return h.less(&h.list[i].obj, &h.list[j].obj)
+}
+
+func (h *items) Swap(i, j int) {
+	h.list[i], h.list[j] = h.list[j], h.list[i]
+	h.index[h.list[i].id] = i
+	h.index[h.list[j].id] = j
+}
+
+func (h *items) Push(x interface{}) {
+	it := x.(item)
+	h.index[it.id] = len(h.list)
+	h.list = append(h.list, it)
+}
+
+func (h *items) Pop() interface{} {
+	n := len(h.list)
+	it := h.list[n-1]
+	h.list[n-1] = item{} // avoid memory leak
+	h.list = h.list[0 : n-1]
+	delete(h.index, it.id)
+	return it
+}
+
+/*
+	A PQueue is an indexed priority queue of consensus objects. It is not safe for concurrent use.
+
+	removed: the ids of objects that are removed before they are pushed, e.g., another server's object may be decided
+	before its ClientRequest message arrives, or while this server is proposing the object in another slot. Such an
+	object is dropped when it is pushed. An object may never be pushed, e.g., its proxy fails before the object's
+	ClientRequest message reaches this server, so ids expire by age: every Expiry calls of Remove (i.e., Expiry decided
+	objects), the ids in expiring are dropped, and the ids in removed move to expiring. So an id is kept for at least
+	Expiry calls, and removed and expiring hold at most 2 * Expiry ids.
+*/
+type PQueue struct {
+	items    items
+	removed  map[string]bool
+	expiring map[string]bool
+	removals int // the num. of Remove calls since the ids in removed moved to expiring
+	Expiry   int
+}
+
+// The default Expiry of a PQueue, far more decided objects than a slow ClientRequest message lets pass
+const DefaultExpiry = 1 << 16
+
+/*
+	Initialize a PQueue ordered by ProxySeqIdLessThan, capacity is the initial capacity of the queue
+*/
+func PQueueInit(capacity int) *PQueue {
+	return pqueueInit(capacity, message.ProxySeqIdLessThan)
+}
+
+func pqueueInit(capacity int, less func(c1, c2 *message.ConsensusObj) bool) *PQueue {
+	return &PQueue{
+		items:    items{list: make([]item, 0, capacity), index: make(map[string]int, capacity), less: less},
+		removed:  make(map[string]bool),
+		expiring: make(map[string]bool),
+		Expiry:   DefaultExpiry,
+	}
+}
+
+// Returns the num. of objects in the queue
+func (q *PQueue) Len() int {
+	return q.items.Len()
+}
+
+/*
+	Pushes an object, unless the object is in the queue already or it has been removed (see Remove)
+*/
+func (q *PQueue) Push(obj message.ConsensusObj) {
+	id := obj.GetIdSeq()
+	if q.removed[id] || q.expiring[id] {
+		delete(q.removed, id)
+		delete(q.expiring, id)
+		return
+	}
+	if _, ok := q.items.index[id]; ok {
+		return
+	}
+	heap.Push(&q.items, item{obj: obj, id: id})
+}
+
+// Returns the object with the highest priority without popping it, returns nil if the queue is empty
+func (q *PQueue) peek() *message.ConsensusObj {
+	if q.items.Len() == 0 {
+		return nil
+	}
+	return &q.items.list[0].obj
+}
+
+/*
+	Pops the object with the highest priority, returns false if the queue is empty
+*/
+func (q *PQueue) Pop() (message.ConsensusObj, bool) {
+	if q.items.Len() == 0 {
+		return message.ConsensusObj{}, false
+	}
+	return heap.Pop(&q.items).(item).obj, true
+}
 
-func (q PQueue) Len() int {
-	return len(q)
+/*
+	Removes an object from the queue. If the object is not in the queue, the object is dropped when it is pushed later,
+	unless its id has expired by then (see PQueue).
+*/
+func (q *PQueue) Remove(obj *message.ConsensusObj) {
+	id := obj.GetIdSeq()
+	if i, ok := q.items.index[id]; ok {
+		heap.Remove(&q.items, i)
+	} else {
+		q.removed[id] = true
+	}
+	q.removals++
+	if q.removals >= q.Expiry {
+		q.expiring, q.removed = q.removed, make(map[string]bool)
+		q.removals = 0
+	}
 }
 
-//  The priority is defined by the ProxySeqIdLessThan function (see that function's comment)
-func (q PQueue) Less(i, j int) bool {
-	return message.ProxySeqIdLessThan(&q[i], &q[j])
+/*
+	Cancels an earlier Remove call of an object that has not been pushed since then, e.g., the object is this server's
+	proposal of a slot, and the slot decides it after another slot has decided it
+*/
+func (q *PQueue) Forget(obj *message.ConsensusObj) {
+	id := obj.GetIdSeq()
+	delete(q.removed, id)
+	delete(q.expiring, id)
 }
 
-func (q PQueue) Swap(i, j int) {
-	q[i], q[j] = q[j], q[i]
+// The order of a PQueue does not depend on decided slots
+func (q *PQueue) Served(obj *message.ConsensusObj, seq uint32) {}
+
+// A PQueue never holds objects back
+func (q *PQueue) Hold() time.Duration {
+	return 0
 }
 
 /*
-	Note: suppose q is a PQueue object, do not call q.Push and q.Pop directly, instead, call heap.Push and heap.Pop,
-	which calls q.Push or q.Pop and performs sorting.
+	A FairQueue keeps the pending objects of each proxy in a PQueue, and it pops the lowest object of the proxy that has
+	been served least recently, i.e., the proxy whose latest decided object is in the oldest slot (ties are broken by
+	the proxy id). So every proxy that has pending objects takes a turn before a proxy takes its second turn, no matter
+	how fast each proxy batches requests. The decided slots are the same on all replicas, so replicas that hold the
+	same objects pop the same object. It is not safe for concurrent use.
+*/
+type FairQueue struct {
+	queues     map[uint32]*PQueue // proxy id -> the proxy's pending objects
+	ids        []uint32           // proxy ids in ascending order
+	lastServed map[uint32]int64   // proxy id -> the slot that decided the proxy's latest object
+	capacity   int
+}
 
-	Push and Pop use pointer receivers because they modify the slice's length, not just its contents.
+/*
+	Initialize a FairQueue, capacity is the initial capacity of each proxy's queue
+*/
+func FairQueueInit(capacity int) *FairQueue {
+	return &FairQueue{
+		queues:     make(map[uint32]*PQueue),
+		lastServed: make(map[uint32]int64),
+		capacity:   capacity,
+	}
+}
+
+// Returns the queue of a proxy, and allocates the queue on the proxy's first object
+func (q *FairQueue) queue(proId uint32) *PQueue {
+	if pq, ok := q.queues[proId]; ok {
+		return pq
+	}
+	pq := PQueueInit(q.capacity)
+	q.queues[proId] = pq
+	q.lastServed[proId] = -1
+	i := sort.Search(len(q.ids), func(i int) bool { return q.ids[i] >= proId })
+	q.ids = append(q.ids, 0)
+	copy(q.ids[i+1:], q.ids[i:])
+	q.ids[i] = proId
+	return pq
+}
+
+// Returns the num. of objects in the queue
+func (q *FairQueue) Len() int {
+	n := 0
+	for _, pq := range q.queues {
+		n += pq.Len()
+	}
+	return n
+}
+
+// Pushes an object to its proxy's queue, see PQueue.Push
+func (q *FairQueue) Push(obj message.ConsensusObj) {
+	q.queue(obj.ProId).Push(obj)
+}
+
+/*
+	Pops the lowest object of the least recently served proxy, returns false if the queue is empty
+*/
+func (q *FairQueue) Pop() (message.ConsensusObj, bool) {
+	var next *PQueue
+	var nextServed int64
+	for _, id := range q.ids {
+		if pq := q.queues[id]; pq.Len() > 0 && (next == nil || q.lastServed[id] < nextServed) {
+			next, nextServed = pq, q.lastServed[id]
+		}
+	}
+	if next == nil {
+		return message.ConsensusObj{}, false
+	}
+	return next.Pop()
+}
+
+// Removes an object from its proxy's queue, see PQueue.Remove
+func (q *FairQueue) Remove(obj *message.ConsensusObj) {
+	q.queue(obj.ProId).Remove(obj)
+}
+
+// Cancels an earlier Remove call, see PQueue.Forget
+func (q *FairQueue) Forget(obj *message.ConsensusObj) {
+	q.queue(obj.ProId).Forget(obj)
+}
+
+/*
+	Records that slot seq has decided an object of a proxy. Slots may be decided out of order (see the window in the
+	consensus package), so only a later slot moves the proxy's turn.
 */
-func (q *PQueue) Push(x interface{}) {
-	*q = append(*q, x.(message.ConsensusObj))
+func (q *FairQueue) Served(obj *message.ConsensusObj, seq uint32) {
+	q.queue(obj.ProId)
+	if int64(seq) > q.lastServed[obj.ProId] {
+		q.lastServed[obj.ProId] = int64(seq)
+	}
 }
 
-func (q *PQueue) Pop() interface{} {
-	old := *q
-	n := len(old)
-	x := old[n-1]
-	//old[n-1] = nil // avoid memory leak (only used if PQueue is defined as []*ConsensusObj)
-	*q = old[0 : n-1]
-	return x
+// A FairQueue never holds objects back
+func (q *FairQueue) Hold() time.Duration {
+	return 0
 }
@@ -0,0 +1,186 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package queue
+
+import (
+	"rabia/internal/message"
+	"testing"
+	"time"
+)
+
+func obj(proId, proSeq uint32) message.ConsensusObj {
+	return message.ConsensusObj{ProId: proId, ProSeq: proSeq}
+}
+
+func TestPQueue_PushPop(t *testing.T) {
+	q := PQueueInit(0)
+	for _, o := range []message.ConsensusObj{obj(1, 3), obj(0, 5), obj(2, 1), obj(0, 5), obj(1, 2)} {
+		q.Push(o)
+	}
+	if q.Len() != 4 {
+		t.Errorf("Len() = %d, want 4 (a duplicate object is pushed)", q.Len())
+	}
+	prev, _ := q.Pop()
+	for q.Len() > 0 {
+		o, _ := q.Pop()
+		if message.ProxySeqIdLessThan(&o, &prev) {
+			t.Errorf("popped %v after %v", o, prev)
+		}
+		prev = o
+	}
+	if _, ok := q.Pop(); ok {
+		t.Errorf("popped an object from an empty queue")
+	}
+}
+
+func TestPQueue_Remove(t *testing.T) {
+	q := PQueueInit(0)
+	for i := uint32(0); i < 100; i++ {
+		q.Push(obj(i%3, i))
+	}
+	for i := uint32(0); i < 100; i += 2 {
+		o := obj(i%3, i)
+		q.Remove(&o)
+	}
+	if q.Len() != 50 || len(q.removed) != 0 {
+		t.Fatalf("Len() = %d, len(removed) = %d, want 50 and 0", q.Len(), len(q.removed))
+	}
+	for q.Len() > 0 {
+		if o, _ := q.Pop(); o.ProSeq%2 == 0 {
+			t.Errorf("popped a removed object %v", o)
+		}
+	}
+	if len(q.items.index) != 0 {
+		t.Errorf("the index keeps %d ids of popped objects", len(q.items.index))
+	}
+
+	// an object removed before it is pushed is dropped, unless the removal is forgotten
+	a, b := obj(4, 1), obj(4, 2)
+	q.Remove(&a)
+	q.Remove(&b)
+	q.Forget(&b)
+	q.Push(a)
+	q.Push(b)
+	if o, ok := q.Pop(); !ok || !message.ProxySeqIdEqual(&o, &b) || q.Len() != 0 || len(q.removed) != 0 {
+		t.Errorf("Pop() = %v, Len() = %d, len(removed) = %d, want %v, 0, and 0", o, q.Len(), len(q.removed), b)
+	}
+}
+
+func TestPQueue_RemoveExpiry(t *testing.T) {
+	q := PQueueInit(0)
+	q.Expiry = 10
+	// ids of objects that are never pushed expire, so removed and expiring stay bounded
+	for i := uint32(0); i < 1000; i++ {
+		o := obj(1, i)
+		q.Remove(&o)
+		if n := len(q.removed) + len(q.expiring); n > 2*q.Expiry {
+			t.Fatalf("removed and expiring hold %d ids after %d removals, want <= %d", n, i+1, 2*q.Expiry)
+		}
+	}
+	// an id is kept for at least Expiry removals
+	late, expired := obj(2, 0), obj(2, 1)
+	q.Remove(&expired)
+	q.Remove(&late)
+	for i := uint32(0); i < uint32(q.Expiry)-1; i++ {
+		o := obj(3, i)
+		q.Remove(&o)
+	}
+	q.Push(late)
+	if q.Len() != 0 {
+		t.Errorf("an object removed %d removals ago is pushed", q.Expiry)
+	}
+	for i := uint32(0); i < uint32(2*q.Expiry); i++ {
+		o := obj(3, i+100)
+		q.Remove(&o)
+	}
+	q.Push(expired)
+	if o, ok := q.Pop(); !ok || !message.ProxySeqIdEqual(&o, &expired) {
+		t.Errorf("Pop() = %v, %v, want the object whose removal has expired", o, ok)
+	}
+}
+
+func TestFairQueue_RoundRobin(t *testing.T) {
+	q := FairQueueInit(0)
+	// proxy 0 batches faster than proxies 1 and 2, so its sequence numbers are ahead
+	for i := uint32(0); i < 6; i++ {
+		q.Push(obj(0, 10+i))
+	}
+	for i := uint32(0); i < 3; i++ {
+		q.Push(obj(1, i))
+		q.Push(obj(2, i))
+	}
+	want := []message.ConsensusObj{obj(0, 10), obj(1, 0), obj(2, 0), obj(0, 11), obj(1, 1), obj(2, 1),
+		obj(0, 12), obj(1, 2), obj(2, 2), obj(0, 13), obj(0, 14), obj(0, 15)}
+	for seq, w := range want {
+		o, ok := q.Pop()
+		if !ok || !message.ProxySeqIdEqual(&o, &w) {
+			t.Fatalf("slot %d: Pop() = %v, want %v", seq, o, w)
+		}
+		q.Served(&o, uint32(seq))
+	}
+	if q.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", q.Len())
+	}
+}
+
+func TestFairQueue_Remove(t *testing.T) {
+	q := FairQueueInit(0)
+	a, b := obj(1, 0), obj(2, 0)
+	q.Push(a)
+	q.Remove(&a)
+	q.Remove(&b) // b is decided before it arrives
+	q.Push(b)
+	if _, ok := q.Pop(); ok || q.Len() != 0 {
+		t.Errorf("popped a removed object")
+	}
+}
+
+func TestTimeQueue_Hold(t *testing.T) {
+	now := time.Unix(100, 0)
+	q := TimeQueueInit(0, 10*time.Millisecond)
+	q.Now = func() time.Time { return now }
+	stamped := func(proId, proSeq uint32, ts time.Time) message.ConsensusObj {
+		o := obj(proId, proSeq)
+		o.Timestamp = ts.UnixNano()
+		return o
+	}
+	// the messages arrive out of their timestamps' order, and proxy 0's sequence numbers are ahead
+	late := stamped(0, 7, now.Add(-2*time.Millisecond))
+	early := stamped(1, 0, now.Add(-5*time.Millisecond))
+	q.Push(late)
+	q.Push(early)
+
+	if _, ok := q.Pop(); ok {
+		t.Fatalf("popped an object that is held back")
+	}
+	if h := q.Hold(); h != 5*time.Millisecond {
+		t.Fatalf("Hold() = %v, want 5ms", h)
+	}
+	now = now.Add(5 * time.Millisecond)
+	if o, ok := q.Pop(); !ok || !message.ProxySeqIdEqual(&o, &early) {
+		t.Fatalf("Pop() = %v, %v, want %v", o, ok, early)
+	}
+	if _, ok := q.Pop(); ok {
+		t.Fatalf("popped an object that is held back")
+	}
+	now = now.Add(3 * time.Millisecond)
+	if o, ok := q.Pop(); !ok || !message.ProxySeqIdEqual(&o, &late) {
+		t.Fatalf("Pop() = %v, %v, want %v", o, ok, late)
+	}
+	if q.Hold() != 0 {
+		t.Errorf("Hold() of an empty queue = %v, want 0", q.Hold())
+	}
+}
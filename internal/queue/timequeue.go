@@ -0,0 +1,95 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package queue
+
+import (
+	"rabia/internal/message"
+	"time"
+)
+
+/*
+	A TimeQueue orders objects by the timestamps that their proxies stamp (see TimestampLessThan), and it holds each
+	object back for Delay after its timestamp before Pop returns it. Within Delay, the object's ClientRequest message is
+	likely to have reached all replicas, and so have the messages of the objects with earlier timestamps. So the
+	replicas likely see the same head object when they start a slot, even if the messages arrive in different orders,
+	which raises the num. of matched slots at the cost of Delay more latency. Delay should cover the proxies' clock
+	skew and the network delay. It is not safe for concurrent use.
+
+	Now: returns the current time, it is time.Now unless a test replaces it
+*/
+type TimeQueue struct {
+	pq    *PQueue
+	Delay time.Duration
+	Now   func() time.Time
+}
+
+/*
+	Initialize a TimeQueue, capacity is the initial capacity of the queue
+*/
+func TimeQueueInit(capacity int, delay time.Duration) *TimeQueue {
+	return &TimeQueue{
+		pq:    pqueueInit(capacity, message.TimestampLessThan),
+		Delay: delay,
+		Now:   time.Now,
+	}
+}
+
+// Returns the num. of objects in the queue, including the objects that are held back
+func (q *TimeQueue) Len() int {
+	return q.pq.Len()
+}
+
+// Pushes an object, see PQueue.Push
+func (q *TimeQueue) Push(obj message.ConsensusObj) {
+	q.pq.Push(obj)
+}
+
+/*
+	Pops the object with the earliest timestamp, returns false if the queue is empty or the object is held back
+*/
+func (q *TimeQueue) Pop() (message.ConsensusObj, bool) {
+	if q.Hold() > 0 {
+		return message.ConsensusObj{}, false
+	}
+	return q.pq.Pop()
+}
+
+// Removes an object from the queue, see PQueue.Remove
+func (q *TimeQueue) Remove(obj *message.ConsensusObj) {
+	q.pq.Remove(obj)
+}
+
+// Cancels an earlier Remove call, see PQueue.Forget
+func (q *TimeQueue) Forget(obj *message.ConsensusObj) {
+	q.pq.Forget(obj)
+}
+
+// The order of a TimeQueue does not depend on decided slots
+func (q *TimeQueue) Served(obj *message.ConsensusObj, seq uint32) {}
+
+/*
+	Returns how long the object with the earliest timestamp is still held back, 0 if the queue is empty
+*/
+func (q *TimeQueue) Hold() time.Duration {
+	head := q.pq.peek()
+	if head == nil {
+		return 0
+	}
+	if d := time.Unix(0, head.Timestamp).Add(q.Delay).Sub(q.Now()); d > 0 {
+		return d
+	}
+	return 0
+}
@@ -0,0 +1,101 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+/*
+	The shard package defines the ShardMap object, which assigns key ranges to Rabia groups. A Rabia group is an
+	independent cluster of Conf.NServers servers with its own peers and ledger, and each group decides its own sequence
+	of slots, so the throughput of a deployment grows with the number of groups.
+
+	Note:
+
+	1. Clients route commands: a client connects to one proxy per group and sends each command to the group that owns
+	the command's key (see Route). A client-batched request whose commands belong to different groups is split into one
+	request per group, and the client waits for all of them to be replied.
+
+	2. Proxies check ownership: a proxy rejects a command that accesses a key owned by another group (see Owns), so a
+	misrouted command or a transaction that spans multiple groups never changes the store of a group.
+
+	3. The shard map is static -- it is loaded from Conf.ShardBounds and must be identical on all servers and clients.
+
+	4. Watches are not supported across groups: a watch command has no key, so Route sends it to group 0, and every
+	proxy rejects watch and unwatch commands if there is more than one group (a group only sees the changes of the keys
+	that it owns). Clients of a sharded deployment should read the keys instead.
+*/
+package shard
+
+import (
+	"fmt"
+	"rabia/internal/kvs"
+	"sort"
+)
+
+/*
+	A ShardMap splits the key space into len(Bounds) + 1 key ranges. Group 0 owns the keys less than Bounds[0], group i
+	owns the keys in [Bounds[i-1], Bounds[i]), and the last group owns the keys no less than Bounds[len(Bounds)-1].
+*/
+type ShardMap struct {
+	Bounds []string
+}
+
+/*
+	Initialize a shard map, bounds must be in strictly ascending order (an empty array means a single group that owns
+	every key)
+*/
+func ShardMapInit(bounds []string) *ShardMap {
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i-1] >= bounds[i] {
+			panic(fmt.Sprint("should not happen, shard bounds are not in ascending order ", bounds))
+		}
+	}
+	return &ShardMap{Bounds: bounds}
+}
+
+// Returns the num. of groups
+func (m *ShardMap) NGroups() int {
+	return len(m.Bounds) + 1
+}
+
+// Returns the id of the group that owns a key
+func (m *ShardMap) Lookup(key string) int {
+	return sort.Search(len(m.Bounds), func(i int) bool {
+		return key < m.Bounds[i]
+	})
+}
+
+/*
+	Returns the id of the group a command should be sent to, i.e., the owner of the command's first key. A malformed
+	command is sent to group 0, which rejects it as every group does, and so is a watch command (see note 4 above).
+*/
+func (m *ShardMap) Route(cmd string) int {
+	keys := kvs.Keys(cmd)
+	if len(keys) == 0 {
+		return 0
+	}
+	return m.Lookup(keys[0])
+}
+
+// Returns true if the group owns every key that the command accesses
+func (m *ShardMap) Owns(cmd string, group int) bool {
+	keys := kvs.Keys(cmd)
+	if keys == nil {
+		return false
+	}
+	for _, key := range keys {
+		if m.Lookup(key) != group {
+			return false
+		}
+	}
+	return true
+}
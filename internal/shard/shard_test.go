@@ -0,0 +1,52 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package shard
+
+import (
+	"rabia/internal/config"
+	"rabia/internal/kvs"
+	"testing"
+)
+
+func TestShardMap(t *testing.T) {
+	config.Conf.KeyLen = 2
+
+	m := ShardMapInit([]string{"g0", "p0"})
+	if m.NGroups() != 3 {
+		t.Errorf("NGroups() = %d, want 3", m.NGroups())
+	}
+	for key, group := range map[string]int{"a0": 0, "fz": 0, "g0": 1, "oz": 1, "p0": 2, "zz": 2} {
+		if g := m.Lookup(key); g != group {
+			t.Errorf("Lookup(%q) = %d, want %d", key, g, group)
+		}
+	}
+
+	if g := m.Route(kvs.Write("h1", "v1")); g != 1 {
+		t.Errorf("Route(write h1) = %d, want 1", g)
+	}
+	local := kvs.Txn([]kvs.Guard{{Key: "h1", Target: kvs.GuardVersion, Cmp: kvs.CmpEqual, Operand: "0"}},
+		[]string{kvs.Write("h2", "v2")})
+	if !m.Owns(local, 1) || m.Owns(local, 0) {
+		t.Errorf("a transaction within group 1 is not owned by group 1 only")
+	}
+	spanning := kvs.Txn(nil, []string{kvs.Write("h1", "v1"), kvs.Write("q1", "v1")})
+	if m.Owns(spanning, 1) || m.Owns(spanning, 2) {
+		t.Errorf("a transaction that spans groups 1 and 2 is owned by a group")
+	}
+	if m.Owns("9", 0) {
+		t.Errorf("a malformed command is owned by a group")
+	}
+}
@@ -0,0 +1,260 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+/*
+	handshake.go defines the handshake that opens each connection (see note 6 in tcp.go). The end that dials sends its
+	Handshake, and the end that accepts checks it and replies with its own Handshake, which carries the reason if the
+	connection is rejected. Each end checks the other's Handshake, so both ends close a connection whose ends do not
+	match, and each end records the result in a Link.
+
+	A Handshake is sent as a Command serialized with gogo-protobuf (whatever the codecs of the ends are):
+
+		CliId       the node id (a client id or a server id)
+		CliSeq      the protocol version (0 for the handshakes of older versions, which are rejected)
+		SvrSeq      the node role, RoleClient or RoleServer
+		WatchId     the Rabia group (Conf.GroupId), see the shard package
+		Commands[0] the cluster id (Conf.ClusterId)
+		Commands[1] the name of the codec, see codec.go in the message package
+		Commands[2] replies only, the reason why the connection is rejected (missing if it is accepted)
+*/
+package tcp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	. "rabia/internal/config"
+	. "rabia/internal/message"
+	"strings"
+	"time"
+)
+
+// The roles of the ends of a connection
+const (
+	RoleClient uint32 = 1 // a client, which dials a proxy
+	RoleServer uint32 = 2 // a server's proxy layer, which accepts clients, or its network layer
+)
+
+const (
+	ProtocolVersion    uint32 = 1 // the protocol version of this node
+	MinProtocolVersion uint32 = 1 // the min. protocol version of the other end that this node accepts
+
+	handshakeSize = 128 // the size of the buffer that reads a handshake, a larger handshake is read into a new buffer
+)
+
+/*
+	The errors of a handshake that refuses a connection. All of them wrap ErrRefused, i.e., errors.Is(err, ErrRefused)
+	is true, and the other end usually refuses the connection too.
+*/
+var (
+	ErrRefused         = errors.New("the connection is refused")
+	ErrClusterMismatch = fmt.Errorf("%w: the ends belong to different clusters or groups", ErrRefused)
+	ErrVersionMismatch = fmt.Errorf("%w: the ends use incompatible protocol versions", ErrRefused)
+	ErrRoleMismatch    = fmt.Errorf("%w: the other end has an unexpected role", ErrRefused)
+	ErrCodecMismatch   = fmt.Errorf("%w: the ends use different codecs", ErrRefused)
+	ErrIdMismatch      = fmt.Errorf("%w: the other end has an unexpected id", ErrRefused)
+	ErrDuplicateId     = fmt.Errorf("%w: the id of the other end is connected", ErrRefused)
+	ErrRejected        = fmt.Errorf("%w: the other end rejects the connection", ErrRefused)
+)
+
+// The error of a handshake whose other end has closed the connection before the reply, which does not refuse the end
+var ErrGone = errors.New("the other end has closed the connection during the handshake")
+
+/*
+	The handshake of a node, see the comment at the top of this file
+*/
+type Handshake struct {
+	Version uint32
+	Role    uint32
+	Id      uint32
+	Group   uint32
+	Cluster string
+	Codec   string
+	Reject  string // replies only, the reason why the connection is rejected ("" if it is accepted)
+}
+
+/*
+	The result of a handshake, which each endpoint records for each of its connections
+*/
+type Link struct {
+	Peer    uint32 // the id of the other end
+	Role    uint32 // the role of the other end
+	Version uint32 // the negotiated protocol version, i.e., the smaller one of the two ends' versions
+	Codec   string // the codec of the connection
+}
+
+// Returns the handshake of this node in a role
+func localHandshake(role, id, group uint32, codec Codec) Handshake {
+	return Handshake{Version: ProtocolVersion, Role: role, Id: id, Group: group, Cluster: Conf.ClusterId,
+		Codec: codec.Name()}
+}
+
+// Serializes a handshake with gogo-protobuf and flush its bytes to a writer
+func (h *Handshake) writeFlush(writer *bufio.Writer) error {
+	c := &Command{CliId: h.Id, CliSeq: h.Version, SvrSeq: h.Role, WatchId: h.Group,
+		Commands: []string{h.Cluster, h.Codec}}
+	if h.Reject != "" {
+		c.Commands = append(c.Commands, h.Reject)
+	}
+	return c.MarshalWriteFlush(writer)
+}
+
+// Reads a handshake, a handshake that cannot be read or that misses fields is malformed
+func readHandshake(reader *bufio.Reader) (Handshake, error) {
+	var c Command
+	readBuf := GetBuf(handshakeSize) // pooled, so that accepting a connection does not allocate a buffer
+	err := c.ReadUnmarshal(reader, readBuf.Data)
+	readBuf.Release()
+	if err != nil {
+		if !errors.Is(err, ErrMalformed) && !errors.Is(err, os.ErrDeadlineExceeded) { // a silent end is not malformed
+			err = fmt.Errorf("%w: %v", ErrMalformed, err)
+		}
+		return Handshake{}, err
+	}
+	h := Handshake{Version: c.CliSeq, Role: c.SvrSeq, Id: c.CliId, Group: c.WatchId}
+	if h.Version == 0 { // older versions send a Command with an id only (or with the name of the codec)
+		return h, nil
+	}
+	if len(c.Commands) < 2 || len(c.Commands) > 3 {
+		return h, fmt.Errorf("%w: a handshake has %d strings", ErrMalformed, len(c.Commands))
+	}
+	h.Cluster, h.Codec = c.Commands[0], c.Commands[1]
+	if len(c.Commands) == 3 {
+		h.Reject = c.Commands[2]
+	}
+	return h, nil
+}
+
+/*
+	Checks the handshake h of the other end against the handshake own of this end, where role is the expected role of
+	the other end. Returns an error that wraps ErrRefused if they do not match, or the Link of the connection.
+*/
+func (own *Handshake) check(h *Handshake, role uint32) (Link, error) {
+	switch {
+	case h.Version == 0: // the cluster of an older version is unknown
+		return Link{}, fmt.Errorf("%w: %d here, an older version there", ErrVersionMismatch, own.Version)
+	case h.Cluster != own.Cluster || h.Group != own.Group:
+		return Link{}, fmt.Errorf("%w: %s/%d here, %s/%d there", ErrClusterMismatch, own.Cluster, own.Group,
+			h.Cluster, h.Group)
+	case h.Version < MinProtocolVersion:
+		return Link{}, fmt.Errorf("%w: %d here (min. %d), %d there", ErrVersionMismatch, own.Version,
+			MinProtocolVersion, h.Version)
+	case h.Role != role:
+		return Link{}, fmt.Errorf("%w: %d, want %d", ErrRoleMismatch, h.Role, role)
+	case h.Codec != own.Codec:
+		return Link{}, fmt.Errorf("%w: %s here, %s there", ErrCodecMismatch, own.Codec, h.Codec)
+	}
+	version := own.Version
+	if h.Version < version {
+		version = h.Version
+	}
+	return Link{Peer: h.Id, Role: h.Role, Version: version, Codec: h.Codec}, nil
+}
+
+/*
+	Runs handshake, dialHandshake or acceptHandshake on conn, within Conf.HandshakeTimeout, so that an end that does not
+	send (or read) its handshake cannot block the routine that accepts or dials connections. The deadline is cleared
+	once the handshake succeeds.
+*/
+func withDeadline(conn net.Conn, handshake func() (Link, error)) (Link, error) {
+	if err := conn.SetDeadline(time.Now().Add(Conf.HandshakeTimeout)); err != nil {
+		return Link{}, err
+	}
+	link, err := handshake()
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	return link, err
+}
+
+/*
+	The handshake at the end that dials, where own is the handshake of this end, and peer is the id of the other end
+	(-1 if it is unknown). Returns the Link of the connection, or a ConnError that wraps ErrRefused if the ends do not
+	match or if the other end rejects the connection.
+*/
+func dialHandshake(reader *bufio.Reader, writer *bufio.Writer, own Handshake, peer int) (Link, error) {
+	if err := own.writeFlush(writer); err != nil {
+		return Link{}, &ConnError{Op: "handshake", Peer: peer, Err: err}
+	}
+	rep, err := readHandshake(reader)
+	if err != nil {
+		return Link{}, &ConnError{Op: "handshake", Peer: peer, Err: err}
+	}
+	link, err := own.check(&rep, RoleServer) // only servers accept connections
+	if err == nil && peer >= 0 && rep.Id != uint32(peer) {
+		err = fmt.Errorf("%w: %d, want %d", ErrIdMismatch, rep.Id, peer)
+	}
+	if err == nil && rep.Reject != "" {
+		err = fmt.Errorf("%w: %s", ErrRejected, rep.Reject)
+	}
+	if err != nil {
+		return Link{}, &ConnError{Op: "handshake", Peer: peer, Err: err}
+	}
+	return link, nil
+}
+
+/*
+	Returns true if the end that dials has closed conn after sending its handshake, e.g., the end has timed out and is
+	dialing again while this end was busy with another connection. The end sends nothing else until it reads the reply,
+	so conn has no more input unless it is closed. Called by the end that accepts before it replies, so that it does not
+	take a connection that the other end has given up for a connected one.
+*/
+func dialerGone(conn net.Conn, reader *bufio.Reader) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return true
+	}
+	_, err := reader.Peek(1)
+	_ = conn.SetReadDeadline(time.Now().Add(Conf.HandshakeTimeout))
+	return err != nil && !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+/*
+	Returns true if err is the error of dialHandshake when the other end rejects the connection because the id of this
+	end is connected (see ErrDuplicateId), e.g., the other end has not found the previous connection of this end failed
+*/
+func rejectedAsDuplicate(err error) bool {
+	return errors.Is(err, ErrRejected) && strings.Contains(err.Error(), ErrDuplicateId.Error())
+}
+
+/*
+	The handshake at the end that accepts, where own is the handshake of this end, role is the expected role of the
+	other end, and admit checks the id of the other end (e.g., whether it is connected). The reply carries the reason
+	if the connection is rejected. Returns the Link of the connection, or a ConnError that wraps ErrMalformed if the
+	handshake of the other end is malformed (no reply is sent), or one that wraps ErrRefused if the connection is
+	rejected.
+*/
+func acceptHandshake(reader *bufio.Reader, writer *bufio.Writer, own Handshake, role uint32,
+	admit func(id uint32) error) (Link, error) {
+	h, err := readHandshake(reader)
+	if err != nil {
+		return Link{}, &ConnError{Op: "handshake", Peer: -1, Err: err}
+	}
+	link, err := own.check(&h, role)
+	if err == nil {
+		err = admit(h.Id)
+	}
+	if err != nil {
+		own.Reject = err.Error()
+	}
+	if err2 := own.writeFlush(writer); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return Link{}, &ConnError{Op: "handshake", Peer: int(h.Id), Err: err}
+	}
+	return link, nil
+}
@@ -0,0 +1,302 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package tcp
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"rabia/internal/config"
+	. "rabia/internal/message"
+	"testing"
+	"time"
+)
+
+/*
+	Runs a handshake over a pipe between a node that dials with handshake dial and expects server peer, and a node that
+	accepts with handshake accept and expects role. Returns the Links and the errors of the two ends.
+*/
+func pipeHandshake(dial, accept Handshake, peer int, role uint32, admit func(uint32) error) (Link, error, Link,
+	error) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	done := make(chan error)
+	var dLink Link
+	go func() {
+		var err error
+		dLink, err = dialHandshake(bufio.NewReader(c1), bufio.NewWriter(c1), dial, peer)
+		done <- err
+	}()
+	aLink, aErr := acceptHandshake(bufio.NewReader(c2), bufio.NewWriter(c2), accept, role, admit)
+	c2.Close() // the dialer reads EOF if no reply is sent
+	dErr := <-done
+	return dLink, dErr, aLink, aErr
+}
+
+func admitAll(uint32) error {
+	return nil
+}
+
+func TestHandshake(t *testing.T) {
+	config.Conf.ClusterId = "c1"
+	cli := localHandshake(RoleClient, 3, 1, GogoCodec)
+	svr := localHandshake(RoleServer, 2, 1, GogoCodec)
+
+	dLink, dErr, aLink, aErr := pipeHandshake(cli, svr, 2, RoleClient, admitAll)
+	if dErr != nil || aErr != nil {
+		t.Fatalf("got %v and %v, want nil", dErr, aErr)
+	}
+	if want := (Link{Peer: 2, Role: RoleServer, Version: ProtocolVersion, Codec: "gogo"}); dLink != want {
+		t.Errorf("the dialer's link = %+v, want %+v", dLink, want)
+	}
+	if want := (Link{Peer: 3, Role: RoleClient, Version: ProtocolVersion, Codec: "gogo"}); aLink != want {
+		t.Errorf("the acceptor's link = %+v, want %+v", aLink, want)
+	}
+
+	newer := cli
+	newer.Version = ProtocolVersion + 1
+	dLink, _, aLink, _ = pipeHandshake(newer, svr, -1, RoleClient, admitAll)
+	if dLink.Version != ProtocolVersion || aLink.Version != ProtocolVersion {
+		t.Errorf("negotiated versions = %d and %d, want %d", dLink.Version, aLink.Version, ProtocolVersion)
+	}
+
+	for _, c := range []struct {
+		name         string
+		dial, accept func(h *Handshake)
+		peer         int
+		admit        func(uint32) error
+		dErr, aErr   error
+	}{
+		{"cluster", func(h *Handshake) { h.Cluster = "c2" }, nil, -1, admitAll, ErrClusterMismatch,
+			ErrClusterMismatch},
+		{"group", nil, func(h *Handshake) { h.Group = 0 }, -1, admitAll, ErrClusterMismatch, ErrClusterMismatch},
+		{"version", func(h *Handshake) { h.Version = 0 }, nil, -1, admitAll, ErrRejected, ErrVersionMismatch},
+		{"role", func(h *Handshake) { h.Role = RoleServer }, nil, -1, admitAll, ErrRejected, ErrRoleMismatch},
+		{"codec", nil, func(h *Handshake) { h.Codec = "binary" }, -1, admitAll, ErrCodecMismatch, ErrCodecMismatch},
+		{"peer id", nil, nil, 1, admitAll, ErrIdMismatch, nil},
+		{"duplicate id", nil, nil, -1, func(uint32) error { return ErrDuplicateId }, ErrRejected, ErrDuplicateId},
+	} {
+		dial, accept := cli, svr
+		if c.dial != nil {
+			c.dial(&dial)
+		}
+		if c.accept != nil {
+			c.accept(&accept)
+		}
+		_, dErr, _, aErr := pipeHandshake(dial, accept, c.peer, RoleClient, c.admit)
+		if !errors.Is(dErr, c.dErr) || !errors.Is(dErr, ErrRefused) {
+			t.Errorf("%s: the dialer's error = %v, want %v", c.name, dErr, c.dErr)
+		}
+		if (c.aErr == nil && aErr != nil) || (c.aErr != nil && !errors.Is(aErr, c.aErr)) {
+			t.Errorf("%s: the acceptor's error = %v, want %v", c.name, aErr, c.aErr)
+		}
+		if dup := errors.Is(c.aErr, ErrDuplicateId); rejectedAsDuplicate(dErr) != dup {
+			t.Errorf("%s: rejectedAsDuplicate(%v) = %v, want %v", c.name, dErr, !dup, dup)
+		}
+	}
+}
+
+func TestHandshake_OlderOrMalformed(t *testing.T) {
+	config.Conf.ClusterId = "c1"
+	svr := localHandshake(RoleServer, 2, 0, GogoCodec)
+	for _, c := range []struct {
+		name string
+		send func(w *bufio.Writer) error
+		err  error
+	}{
+		{"older", func(w *bufio.Writer) error { return (&Command{CliId: 1}).MarshalWriteFlush(w) }, ErrVersionMismatch},
+		{"no strings", func(w *bufio.Writer) error { return (&Command{CliId: 1, CliSeq: 1}).MarshalWriteFlush(w) },
+			ErrMalformed},
+		{"garbage", func(w *bufio.Writer) error {
+			_, _ = w.WriteString("garbage-garbage-garbage")
+			return w.Flush()
+		}, ErrMalformed},
+	} {
+		c1, c2 := net.Pipe()
+		go func() {
+			_ = c.send(bufio.NewWriter(c1))
+			_, _ = bufio.NewReader(c1).ReadByte() // reads the reply if any, so that the acceptor does not block
+			c1.Close()
+		}()
+		_, err := acceptHandshake(bufio.NewReader(c2), bufio.NewWriter(c2), svr, RoleClient, admitAll)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+		}
+		c2.Close()
+	}
+}
+
+func TestProxyTCP_SilentConn(t *testing.T) {
+	config.Conf.ClusterId, config.Conf.GroupId, config.Conf.Codec = "c1", 0, "gogo"
+	config.Conf.NClients, config.Conf.IoBufSize, config.Conf.TcpBufSize = 2, 4096, 1<<16
+	config.Conf.HandshakeTimeout = 100 * time.Millisecond
+	p := ProxyTcpInit(0, "127.0.0.1:0", make(chan Command))
+	p.Connect()
+	defer func() { // not Close, which reads Conns while connect may still write them
+		close(p.Done)
+		_ = p.Listener.Close()
+	}()
+	addr := p.Listener.Addr().String()
+
+	silent, err := net.Dial("tcp", addr) // never sends its handshake
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	own := localHandshake(RoleClient, 1, 0, GogoCodec)
+	if _, err := dialHandshake(bufio.NewReader(conn), bufio.NewWriter(conn), own, 0); err != nil {
+		t.Fatalf("the connection after a silent one: got %v, want nil", err)
+	}
+	if err := <-p.Errs; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("the silent connection's error = %v, want a timeout", err)
+	}
+}
+
+// Dials a proxy as client id and performs the handshake, the connection is returned even if the handshake fails
+func dialProxy(t *testing.T, addr string, id uint32) (net.Conn, *bufio.Reader, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	_, err = dialHandshake(reader, bufio.NewWriter(conn), localHandshake(RoleClient, id, 0, GogoCodec), 0)
+	return conn, reader, err
+}
+
+// Waits until cond is true, fails the test if it is still false after 5 seconds
+func waitFor(t *testing.T, cond func() bool, what string) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestProxyTCP_Reconnect(t *testing.T) {
+	config.Conf.ClusterId, config.Conf.GroupId, config.Conf.Codec = "c1", 0, "gogo"
+	config.Conf.NClients, config.Conf.IoBufSize, config.Conf.TcpBufSize = 2, 4096, 1<<16
+	config.Conf.HandshakeTimeout, config.Conf.LenChannel = time.Second, 10
+	p := ProxyTcpInit(0, "127.0.0.1:0", make(chan Command))
+	p.Connect()
+	defer func() { // not Close, which reads Conns while connect may still write them
+		close(p.Done)
+		_ = p.Listener.Close()
+	}()
+	addr := p.Listener.Addr().String()
+
+	first, _, err := dialProxy(t, addr, 0)
+	if err != nil {
+		t.Fatalf("the first connection: got %v, want nil", err)
+	}
+	waitFor(t, func() bool { return p.IsConnected(0) }, "client 0 to connect")
+	dup, _, err := dialProxy(t, addr, 0)
+	if !rejectedAsDuplicate(err) {
+		t.Errorf("a connection of a connected id: got %v, want a rejection of a duplicate id", err)
+	}
+	dup.Close()
+
+	first.Close()
+	waitFor(t, func() bool { return !p.IsConnected(0) }, "client 0 to be disconnected")
+	p.SendChan[0] <- Command{CliId: 0, CliSeq: 1} // a reply to the failed connection, which is dropped
+
+	again, reader, err := dialProxy(t, addr, 0)
+	if err != nil {
+		t.Fatalf("the connection after a failed one: got %v, want nil", err)
+	}
+	defer again.Close()
+	waitFor(t, func() bool { return p.IsConnected(0) }, "client 0 to connect again")
+	p.SendChan[0] <- Command{CliId: 0, CliSeq: 2}
+	var c Command
+	if err := c.ReadDecode(GogoCodec, reader, make([]byte, 4096)); err != nil || c.CliSeq != 2 {
+		t.Errorf("the reply on the new connection: got %v (CliSeq %d), want CliSeq 2", err, c.CliSeq)
+	}
+}
+
+func TestNetTCP_RedialAfterTimeout(t *testing.T) {
+	config.Conf.ClusterId, config.Conf.GroupId, config.Conf.Codec = "c1", 0, "gogo"
+	config.Conf.NServers, config.Conf.Peers = 3, []string{"", "", ""}
+	config.Conf.IoBufSize, config.Conf.TcpBufSize, config.Conf.LenChannel = 4096, 1<<16, 10
+	config.Conf.HandshakeTimeout = 100 * time.Millisecond
+	dial := func(addr string, id uint32) (net.Conn, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		own := localHandshake(RoleServer, id, 0, GogoCodec)
+		_, err = dialHandshake(bufio.NewReader(conn), bufio.NewWriter(conn), own, 2)
+		return conn, err
+	}
+
+	/*
+		Server 2 is busy with a silent connection, so the handshake of server 0 times out, and server 0 dials again.
+		Server 2 then takes the connection that server 0 has given up from the backlog.
+	*/
+	n := NetTCPInit(2, "127.0.0.1:0")
+	defer n.Listener.Close()
+	addr := n.Listener.Addr().String()
+	errs := make(chan error, 1)
+	go func() { errs <- n.accepting() }()
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	stale, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	own := localHandshake(RoleServer, 0, 0, GogoCodec)
+	if err := own.writeFlush(bufio.NewWriter(stale)); err != nil {
+		t.Fatal(err)
+	}
+	stale.Close() // server 0 times out
+	redial, err := dial(addr, 0)
+	if err != nil {
+		t.Fatalf("the redial of server 0: got %v, want nil", err)
+	}
+	defer redial.Close()
+
+	// server 0 dials again after server 2 has taken its connection, which replaces the older one
+	again, err := dial(addr, 0)
+	if err != nil {
+		t.Fatalf("the second redial of server 0: got %v, want nil", err)
+	}
+	defer again.Close()
+	peer1, err := dial(addr, 1)
+	if err != nil {
+		t.Fatalf("the connection of server 1: got %v, want nil", err)
+	}
+	defer peer1.Close()
+
+	if err := <-errs; err != nil {
+		t.Fatalf("accepting() = %v, want nil", err)
+	}
+	if got, want := (*n.Conns[0]).RemoteAddr().String(), again.LocalAddr().String(); got != want {
+		t.Errorf("the connection of server 0 is from %s, want the latest one from %s", got, want)
+	}
+	if (*n.Conns[1]).RemoteAddr().String() != peer1.LocalAddr().String() {
+		t.Errorf("the connection of server 1 is not registered")
+	}
+}
@@ -25,46 +25,119 @@
 
 	2. This version of TCP endpoints does no support reconfiguration. Reconfiguring a server requires having multiple
 	TCP endpoint objects
+
+	3. A RecvHandler that reads a malformed frame or message (see section 3 of the message package's comment) closes the
+	connection and exits, and the endpoint counts the connection in its Malformed field. So do the routines that accept
+	connections if a handshake is malformed, and they go on accepting connections.
+
+	4. Failures of connections do not panic. The functions that set up connections return a ConnError (or retry if a
+	handshake fails), and a SendHandler or a RecvHandler that fails reports a ConnError to the endpoint's Errs channel
+	and closes its connection, so the layer that owns the endpoint logs the error, and the other connections go on. A
+	SendHandler whose connection is closed keeps draining its SendChan, so that the routines that send to the channel do
+	not block on it. ProxyTCP instead marks the client disconnected (see IsConnected), so that the proxy stops sending
+	to the client, and its handlers exit, so that the client can connect again and replace the failed connection.
+
+	5. The SendHandlers of ProxyTCP and NetTCP coalesce writes: after writing a message, a handler also writes the
+	messages that are already in its SendChan (at most coalesceLimit messages in all) and then flushes its writer once,
+	so a burst of messages costs one syscall instead of one per message. A handler never waits for more messages
+	before flushing, so a message is not delayed when the load is low.
+
+	6. Messages are serialized with the endpoint's Codec (see codec.go in the message package), which is chosen through
+	Conf.Codec. Each connection opens with a handshake (see handshake.go), in which the ends exchange their cluster ids,
+	Rabia groups, protocol versions, roles, ids, and codecs. A connection is closed at both ends if its ends belong to
+	different clusters or groups, use incompatible versions or different codecs, or if the end that dials has an
+	unexpected role or an id that is out of range or connected. The result of a successful handshake is recorded in a
+	Link. A client gives up on a refused connection; a server's network layer fails to connect if it dials a peer that
+	refuses the connection, or if a peer that dials it uses another version or codec (the servers of a cluster must use
+	the same ones), and otherwise it goes on accepting connections, as a proxy does. A handshake that does not finish
+	within Conf.HandshakeTimeout fails, so that a silent connection does not block the connections after it. (A server's
+	network layer does not refuse a peer that dials again, it replaces the peer's older connection, see accepting.)
 */
 package tcp
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"net"
 	. "rabia/internal/config"
 	. "rabia/internal/message"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 /*
-	Generates a reader and a writer from a connection.
+	The error of a connection, see note 4 above
 
-	Note: I suspect that if we call this function twice, the newly generated reader and writer will replace the
-	previously allocated reader and writer. Be aware of any side-effects.
+	Op: the operation that fails, i.e., "setup", "accept", "dial", "handshake", "read", or "write"
+	Peer: the id of the client or the server at the other end, -1 if it is unknown
 */
-func GetReaderWriter(conn *net.Conn) (*bufio.Reader, *bufio.Writer) {
-	var err error
-	err = (*conn).(*net.TCPConn).SetWriteBuffer(Conf.TcpBufSize)
-	if err != nil {
-		panic(fmt.Sprint("should not happen", err))
-	}
-	err = (*conn).(*net.TCPConn).SetReadBuffer(Conf.TcpBufSize)
-	if err != nil {
-		panic(fmt.Sprint("should not happen", err))
+type ConnError struct {
+	Op   string
+	Peer int
+	Err  error
+}
+
+func (e *ConnError) Error() string {
+	return fmt.Sprintf("tcp %s error (peer %d): %v", e.Op, e.Peer, e.Err)
+}
+
+func (e *ConnError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	lenErrs       = 64 // the length of an endpoint's Errs channel
+	coalesceLimit = 64 // the max. num. of messages that a SendHandler writes in one flush, see note 5 above
+)
+
+/*
+	Reports an error to an Errs channel unless the endpoint is closing (done is closed), in which case connections are
+	expected to fail. If the channel is full, the error is dropped, so a handler never blocks on reporting.
+*/
+func report(errs chan error, done chan struct{}, err error) {
+	select {
+	case <-done:
+		return
+	default:
 	}
-	err = (*conn).(*net.TCPConn).SetKeepAlive(true)
-	if err != nil {
-		panic(fmt.Sprint("should not happen", err))
+	select {
+	case errs <- err:
+	default:
 	}
-	err = (*conn).(*net.TCPConn).SetKeepAlivePeriod(20 * time.Second)
-	if err != nil {
-		panic(fmt.Sprint("should not happen", err))
+}
+
+/*
+	Generates a reader and a writer from a connection, returns a ConnError if the connection's options cannot be set.
+
+	Note: I suspect that if we call this function twice, the newly generated reader and writer will replace the
+	previously allocated reader and writer. Be aware of any side-effects.
+*/
+func GetReaderWriter(conn *net.Conn) (*bufio.Reader, *bufio.Writer, error) {
+	tcpConn := (*conn).(*net.TCPConn)
+	for _, err := range []error{
+		tcpConn.SetWriteBuffer(Conf.TcpBufSize),
+		tcpConn.SetReadBuffer(Conf.TcpBufSize),
+		tcpConn.SetKeepAlive(true),
+		tcpConn.SetKeepAlivePeriod(20 * time.Second),
+	} {
+		if err != nil {
+			return nil, nil, &ConnError{Op: "setup", Peer: -1, Err: err}
+		}
 	}
 	reader := bufio.NewReaderSize(*conn, Conf.IoBufSize)
 	writer := bufio.NewWriterSize(*conn, Conf.IoBufSize)
-	return reader, writer
+	return reader, writer, nil
+}
+
+// Returns the codec that Conf.Codec names
+func confCodec() Codec {
+	codec, err := CodecByName(Conf.Codec)
+	if err != nil {
+		panic(fmt.Sprint("should not happen, ", err)) // Conf.Codec is checked when it is loaded
+	}
+	return codec
 }
 
 /*
@@ -82,6 +155,12 @@ type ClientTCP struct {
 	Conn   *net.Conn     // the connection to a proxy
 	Reader *bufio.Reader // the reader that binds to the Conn object
 	Writer *bufio.Writer // the writer that binds to the Conn object
+
+	Malformed int64      // the num. of connections closed because of malformed input, accessed atomically
+	Errs      chan error // the errors of the connection, see note 4 above
+	Codec     Codec      // the wire codec, see note 6 above
+	Group     uint32     // the Rabia group of the proxy, Conf.GroupId by default, see note 6 above
+	Link      Link       // the result of the handshake with the proxy, see note 6 above
 }
 
 /*
@@ -96,25 +175,43 @@ func ClientTcpInit(Id uint32, ProxyIp string) *ClientTCP {
 		ProxyAddr: ProxyIp,
 		RecvChan:  make(chan Command, Conf.LenChannel),
 		SendChan:  make(chan Command, Conf.LenChannel),
+		Errs:      make(chan error, lenErrs),
+		Codec:     confCodec(),
+		Group:     uint32(Conf.GroupId),
 	}
 	return c
 }
 
+/*
+	Dials the proxy and performs the handshake (see note 6 above) until the handshake succeeds, then starts the
+	handlers. A failed handshake is reported, and the connection is closed before dialing again, unless the connection
+	is refused (e.g., the proxy belongs to another cluster), in which case the client gives up. A client whose id is
+	connected dials again, since the proxy may not have found the client's previous connection failed yet.
+*/
 func (c *ClientTCP) connect() {
 	for {
 		conn, err := net.Dial("tcp", c.ProxyAddr)
+		if err != nil {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		c.Reader, c.Writer, err = GetReaderWriter(&conn)
 		if err == nil {
-			c.Conn = &conn
-			break
+			c.Link, err = withDeadline(conn, func() (Link, error) {
+				return dialHandshake(c.Reader, c.Writer, localHandshake(RoleClient, c.Id, c.Group, c.Codec), -1)
+			})
 		}
-		time.Sleep(100 * time.Millisecond)
-	}
-	c.Reader, c.Writer = GetReaderWriter(c.Conn)
-
-	cmd := &Command{CliId: c.Id}
-	err := cmd.MarshalWriteFlush(c.Writer)
-	if err != nil {
-		panic(err)
+		if err != nil {
+			report(c.Errs, c.Done, err)
+			_ = conn.Close()
+			if errors.Is(err, ErrRefused) && !rejectedAsDuplicate(err) {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		c.Conn = &conn
+		break
 	}
 	c.Wg.Add(2)
 	go c.RecvHandler()
@@ -134,8 +231,13 @@ func (c *ClientTCP) RecvHandler() {
 	readBuf := make([]byte, 4096*100)
 	for {
 		var cmd Command
-		err := cmd.ReadUnmarshal(c.Reader, readBuf)
-		if err != nil { // TCP connection closed
+		err := cmd.ReadDecode(c.Codec, c.Reader, readBuf)
+		if errors.Is(err, ErrMalformed) {
+			atomic.AddInt64(&c.Malformed, 1)
+		}
+		if err != nil { // TCP connection closed or a malformed message
+			report(c.Errs, c.Done, &ConnError{Op: "read", Peer: -1, Err: err})
+			_ = (*c.Conn).Close()
 			return
 		}
 		c.RecvChan <- cmd
@@ -151,18 +253,24 @@ func (c *ClientTCP) RecvHandler() {
 	some messages are remained in the channel but not sent.
 
 	2. if the receiver has closed its connection, it is likely that no error msg is produced here at the sender; if the
-	sender has closed its connection, error indeed happens.
+	sender has closed its connection, error indeed happens. The error is reported (see note 4 above), and the messages
+	in SendChan are dropped from then on.
 */
 func (c *ClientTCP) SendHandler() {
 	defer c.Wg.Done()
+	failed := false
 	for {
 		select {
 		case <-c.Done:
 			return
 		case req := <-c.SendChan:
-			err := req.MarshalWriteFlush(c.Writer)
-			if err != nil {
-				panic(err)
+			if failed {
+				continue
+			}
+			if err := req.EncodeWriteFlush(c.Codec, c.Writer); err != nil {
+				report(c.Errs, c.Done, &ConnError{Op: "write", Peer: -1, Err: err})
+				_ = (*c.Conn).Close()
+				failed = true
 			}
 		}
 	}
@@ -172,16 +280,16 @@ func (c *ClientTCP) SendHandler() {
 	Prints the connection status.
 */
 func (c *ClientTCP) PrintStatus() {
-	fmt.Printf("ClientTcp, SvrId=%d, ProxyAddr=%s, Conns.local=%s, Conns.remote=%s\n",
-		c.Id, c.ProxyAddr, (*c.Conn).LocalAddr(), (*c.Conn).RemoteAddr())
+	fmt.Printf("ClientTcp, SvrId=%d, ProxyAddr=%s, Conns.local=%s, Conns.remote=%s, Link=%+v\n",
+		c.Id, c.ProxyAddr, (*c.Conn).LocalAddr(), (*c.Conn).RemoteAddr(), c.Link)
 }
 
 /*
 	Closes the connection and waits SendHandler and RecvHandler to exit.
 */
 func (c *ClientTCP) Close() {
+	close(c.Done) // first, so that the handlers do not report the errors of the closed connection
 	_ = (*c.Conn).Close()
-	close(c.Done)
 	c.Wg.Wait()
 }
 
@@ -201,6 +309,17 @@ type ProxyTCP struct {
 	Conns    []*net.Conn
 	Readers  []*bufio.Reader
 	Writers  []*bufio.Writer
+
+	Malformed int64      // the num. of connections closed because of malformed input, accessed atomically
+	Errs      chan error // the errors of connections, see note 4 above
+	Sent      int64      // the num. of messages sent by SendHandlers, accessed atomically
+	Flushes   int64      // the num. of flushes by SendHandlers (about one syscall each), accessed atomically
+	Codec     Codec      // the wire codec, see note 6 above
+	Links     []Link     // Links[i] is the result of the handshake with client i, see note 6 above
+	Connected []int32    // Connected[i] is 1 while the connection of client i is up, accessed atomically
+
+	gone     []chan struct{}  // gone[i] is closed when the connection of client i fails, see disconnect
+	handlers []sync.WaitGroup // handlers[i] waits the handlers of client i's connection
 }
 
 // Allocates the ProxyTCP object without accepting connections from its clients
@@ -223,40 +342,83 @@ func ProxyTcpInit(Id uint32, ProxyIp string, ToProxy chan Command) *ProxyTCP {
 		Conns:    make([]*net.Conn, Conf.NClients),
 		Readers:  make([]*bufio.Reader, Conf.NClients),
 		Writers:  make([]*bufio.Writer, Conf.NClients),
+
+		Errs:      make(chan error, lenErrs),
+		Codec:     confCodec(),
+		Links:     make([]Link, Conf.NClients),
+		Connected: make([]int32, Conf.NClients),
+
+		gone:     make([]chan struct{}, Conf.NClients),
+		handlers: make([]sync.WaitGroup, Conf.NClients),
 	}
 	/*
 		Note: SendChan, Conns, Readers, and Writers entries are not initialized at this points.
 		Why arrays are of length NClients but not Clients[id]?
-		Because the proxy needs to perform quick lookups of clients, see "if p.TCP.Conns[cid] != nil" on proxy.go
+		Because the proxy needs to perform quick lookups of clients, see IsConnected
 	*/
 	return p
 }
 
-// Waits all its clients to connect
+/*
+	Accepts the connections of clients until the listener is closed. A client whose connection has failed may connect
+	again, and its new connection replaces the failed one once the handlers of the failed one exit. The replies that
+	are queued to the failed connection are dropped.
+*/
 func (p *ProxyTCP) connect() {
 	// Conf.NClients is an upper bound, but in common cases,
 	// a proxy is connected to (Conf.NClients / Conf.NServers) clients
-	for i := 0; i < Conf.NClients; i++ {
+	for {
 		conn, err := p.Listener.Accept()
 		if err != nil {
 			//fmt.Printf("ProxyTCP%d: connection accept thread exits\n", Conf.SvrId)
 			return
 		}
 
-		reader, writer := GetReaderWriter(&conn)
-		var req Command
-		readBuf := make([]byte, 20)
-		err = req.ReadUnmarshal(reader, readBuf)
+		reader, writer, err := GetReaderWriter(&conn)
 		if err != nil {
-			panic(err)
+			report(p.Errs, p.Done, err)
+			_ = conn.Close()
+			continue
+		}
+		own := localHandshake(RoleServer, p.Id, uint32(Conf.GroupId), p.Codec)
+		link, err := withDeadline(conn, func() (Link, error) {
+			return acceptHandshake(reader, writer, own, RoleClient, func(id uint32) error {
+				if id >= uint32(Conf.NClients) {
+					return fmt.Errorf("%w: client id %d is out of range", ErrIdMismatch, id)
+				}
+				if p.IsConnected(id) {
+					return fmt.Errorf("%w: client id %d", ErrDuplicateId, id)
+				}
+				return nil
+			})
+		})
+		if err != nil { // the client is rejected
+			if errors.Is(err, ErrMalformed) {
+				atomic.AddInt64(&p.Malformed, 1)
+			} else {
+				report(p.Errs, p.Done, err)
+			}
+			_ = conn.Close()
+			continue
 		}
 
-		CliId := req.CliId
+		CliId := link.Peer
+		if p.Conns[CliId] == nil {
+			p.SendChan[CliId] = make(chan Command, Conf.LenChannel)
+		} else { // the client connects again
+			p.handlers[CliId].Wait()
+			for len(p.SendChan[CliId]) > 0 {
+				<-p.SendChan[CliId]
+			}
+		}
+		p.Links[CliId] = link
 		p.Conns[CliId] = &conn
-		p.SendChan[CliId] = make(chan Command, Conf.LenChannel)
 		p.Writers[CliId] = writer
 		p.Readers[CliId] = reader
+		p.gone[CliId] = make(chan struct{})
+		atomic.StoreInt32(&p.Connected[CliId], 1)
 		p.Wg.Add(2)
+		p.handlers[CliId].Add(2)
 		go p.SendHandler(int(CliId))
 		go p.RecvHandler(int(CliId))
 	}
@@ -274,65 +436,128 @@ func (p *ProxyTCP) Connect() {
 
 func (p *ProxyTCP) RecvHandler(from int) {
 	defer p.Wg.Done()
+	defer p.handlers[from].Done()
 	readBuf := make([]byte, 4096*100)
 	for {
 		var c Command
-		err := c.ReadUnmarshal(p.Readers[from], readBuf)
-		if err != nil {
-			// maybe: TCP connection is closed or receives an ill-formed message
+		err := c.ReadDecode(p.Codec, p.Readers[from], readBuf)
+		if err == nil && c.CliId != uint32(from) { // the proxy replies to c.CliId
+			err = fmt.Errorf("%w: client %d sends a request of client %d", ErrMalformed, from, c.CliId)
+		}
+		if errors.Is(err, ErrMalformed) {
+			atomic.AddInt64(&p.Malformed, 1)
+		}
+		if err != nil { // maybe: TCP connection is closed, or a malformed message
+			report(p.Errs, p.Done, &ConnError{Op: "read", Peer: from, Err: err})
+			p.disconnect(from)
 			return
 		}
 		p.RecvChan <- c
 	}
 }
 
+/*
+	Sends replies to a client, see note 5 above. If a write fails, the handler reports the error, marks the client
+	disconnected, and exits, so does the handler if the client's RecvHandler fails (see note 4 above). The proxy does
+	not send to a disconnected client, so its KVSExecutor does not block on the client's SendChan.
+*/
 func (p *ProxyTCP) SendHandler(to int) {
 	defer p.Wg.Done()
+	defer p.handlers[to].Done()
+	gone := p.gone[to]
 	for {
 		select {
 		case <-p.Done:
 			return
+		case <-gone:
+			return
 		case c := <-p.SendChan[to]:
-			err := c.MarshalWriteFlush(p.Writers[to])
-			if err != nil {
+			if err := p.sendQueued(to, c); err != nil {
+				report(p.Errs, p.Done, &ConnError{Op: "write", Peer: to, Err: err})
+				p.disconnect(to)
 				return
 			}
 		}
 	}
 }
 
+/*
+	Writes c and the replies that are already in SendChan[to], then flushes the writer once
+*/
+func (p *ProxyTCP) sendQueued(to int, c Command) error {
+	writer := p.Writers[to]
+	for i := 1; ; i++ {
+		if err := c.EncodeWrite(p.Codec, writer); err != nil {
+			return err
+		}
+		atomic.AddInt64(&p.Sent, 1)
+		if i == coalesceLimit {
+			break
+		}
+		select {
+		case c = <-p.SendChan[to]:
+			continue
+		default:
+		}
+		break
+	}
+	atomic.AddInt64(&p.Flushes, 1)
+	return writer.Flush()
+}
+
+/*
+	Marks client id disconnected, stops the handlers of its connection, and closes the connection, called by the
+	handler of the client that fails
+*/
+func (p *ProxyTCP) disconnect(id int) {
+	if atomic.CompareAndSwapInt32(&p.Connected[id], 1, 0) {
+		close(p.gone[id])
+	}
+	_ = (*p.Conns[id]).Close()
+}
+
+/*
+	Returns true if client id is connected to this proxy, i.e., its handshake has succeeded and its handlers have not
+	failed since then. Safe to call from other routines.
+*/
+func (p *ProxyTCP) IsConnected(id uint32) bool {
+	return int(id) < len(p.Connected) && atomic.LoadInt32(&p.Connected[id]) == 1
+}
+
 func (p *ProxyTCP) PrintStatus() {
 	fmt.Printf("proxyTcp, SvrId=%d, ProxyAddr=%s\n", p.Id, p.ProxyAddr)
 	for i := 0; i < Conf.NClients; i++ {
 		if p.Conns[i] != nil {
-			fmt.Printf("\t client id=%d, ip=%s\n", i, (*p.Conns[i]).RemoteAddr())
+			fmt.Printf("\t client id=%d, ip=%s, link=%+v\n", i, (*p.Conns[i]).RemoteAddr(), p.Links[i])
 		}
 	}
 }
 
 func (p *ProxyTCP) Close() {
+	close(p.Done) // first, so that the handlers do not report the errors of the closed connections
 	for i := 0; i < Conf.NClients; i++ {
 		if p.Conns[i] != nil {
 			_ = (*p.Conns[i]).Close()
 		}
 	}
-	close(p.Done)
 	_ = p.Listener.Close()
 	p.Wg.Wait()
 }
 
 /*
 	Network Layer TCP endpoints, each Rabia server has exactly one NetTCP struct and one network address (NetAddr
-	below). Each server needs to dial to all peers (including itself) to establish send TCP channels, and needs to
-	accept connections from all peers (and itself) to establish receive TCP channels.
+	below). Each pair of servers shares a single TCP connection, which carries messages in both directions: the server
+	with the smaller id dials, and the server with the larger id accepts. A server does not connect to itself, the
+	network layer delivers the messages a server sends to itself without the NetTCP object (see the network package).
 
 	For example, when N = 3, each server does the following in Connect initially:
-		waits server 0-2 to connect
-		connects to server 0-2
+		server 0: connects to server 1-2
+		server 1: waits server 0 to connect, connects to server 2
+		server 2: waits server 0-1 to connect
 
-	For example, when N = 5, each server does the following in Connect initially:
-		waits server 0-4 to connect
-		connects to server 0-4
+	For example, when N = 5, server 2 does the following in Connect initially:
+		waits server 0-1 to connect
+		connects to server 3-4
 */
 type NetTCP struct {
 	Id   uint32
@@ -341,17 +566,24 @@ type NetTCP struct {
 
 	NetAddr  string
 	RecvChan chan Msg
-	SendChan []chan []byte
+	SendChan []chan *Buf // SendChan[Id] is nil
 	/*
-		Note: each SendChan is of type "chan []byte" but not "chan Command" because for each message to be broadcasted,
-		we only need to serialize once and let each SendHandler sends the serialized array of bytes.
+		Note: each SendChan is of type "chan *Buf" but not "chan Msg" because for each message to be broadcasted,
+		we only need to serialize once and let each SendHandler sends the serialized array of bytes. Each Buf sent to a
+		SendChan should hold a reference for the SendHandler, which releases the Buf after sending it.
 	*/
 
 	Listener net.Listener
-	RecvConn []*net.Conn
-	SendConn []*net.Conn
+	Conns    []*net.Conn // Conns[i] is the connection to server i, Conns[Id] is nil
 	Readers  []*bufio.Reader
 	Writers  []*bufio.Writer
+
+	Malformed int64      // the num. of connections closed because of malformed input, accessed atomically
+	Errs      chan error // the errors of connections, see note 4 above
+	Sent      int64      // the num. of messages sent by SendHandlers, accessed atomically
+	Flushes   int64      // the num. of flushes by SendHandlers (about one syscall each), accessed atomically
+	Codec     Codec      // the wire codec, see note 6 above
+	Links     []Link     // Links[i] is the result of the handshake with server i, see note 6 above
 }
 
 func NetTCPInit(Id uint32, NetIp string) *NetTCP {
@@ -370,89 +602,173 @@ func NetTCPInit(Id uint32, NetIp string) *NetTCP {
 
 		NetAddr:  NetIp,
 		RecvChan: make(chan Msg, Conf.LenChannel),
-		SendChan: make([]chan []byte, Conf.NServers),
+		SendChan: make([]chan *Buf, Conf.NServers),
 
 		Listener: listener,
-		RecvConn: make([]*net.Conn, Conf.NServers),
-		SendConn: make([]*net.Conn, Conf.NServers),
+		Conns:    make([]*net.Conn, Conf.NServers),
 		Readers:  make([]*bufio.Reader, Conf.NServers),
 		Writers:  make([]*bufio.Writer, Conf.NServers),
+
+		Errs:  make(chan error, lenErrs),
+		Codec: confCodec(),
+		Links: make([]Link, Conf.NServers),
 	}
 
 	/*
-		Note: SendChan, RecvConn, SendConn, Readers, Writers entries are not initialized at this points.
+		Note: SendChan, Conns, Readers, Writers entries are not initialized at this points.
 	*/
 	return n
 }
 
-// Listens to all peers (and itself), fill in the respective entries in RecvConn and Readers.
-func (n *NetTCP) accepting() {
-	for i := 0; i < Conf.NServers; i++ {
+/*
+	Sets up a connection to a server, fill in the respective entries in SendChan, Conns, Readers, Writers, and Links.
+*/
+func (n *NetTCP) register(link Link, conn net.Conn, reader *bufio.Reader, writer *bufio.Writer) {
+	id := link.Peer
+	n.Links[id] = link
+	n.SendChan[id] = make(chan *Buf, Conf.LenChannel)
+	n.Conns[id] = &conn
+	n.Readers[id] = reader
+	n.Writers[id] = writer
+}
+
+/*
+	Listens to the peers whose ids are smaller than this server's. Returns a ConnError if the listener fails or if a
+	peer uses another protocol version or codec. Other nodes that are refused (e.g., the servers of another cluster)
+	are reported.
+
+	A peer whose handshake times out (e.g., this server was busy with a silent connection, see withDeadline) dials
+	again, so a connection may wait in the listener's backlog after its dialer has given up on it. Such a connection is
+	dropped before the reply (see dialerGone), and if a peer dials again after its connection is taken anyway, the new
+	connection replaces the older one, so that the peer is not refused as a duplicate.
+*/
+func (n *NetTCP) accepting() error {
+	for i := uint32(0); i < n.Id; i++ {
 		conn, err := n.Listener.Accept()
 		if err != nil {
-			panic(err)
+			return &ConnError{Op: "accept", Peer: -1, Err: err}
 		}
 
-		reader, _ := GetReaderWriter(&conn)
-		var c Command
-		readBuf := make([]byte, 20)
-		err = c.ReadUnmarshal(reader, readBuf)
+		reader, writer, err := GetReaderWriter(&conn)
 		if err != nil {
-			panic(err)
+			report(n.Errs, n.Done, err)
+			_ = conn.Close()
+			i--
+			continue
 		}
-
-		id := c.CliId
-		n.RecvConn[id] = &conn
-		n.Readers[id] = reader
-	}
-}
-
-// Dials to all peers (and itself), fill in the respective entries in SendChan, SendConn, and Writers.
-func (n *NetTCP) dialing() {
-	if len(Conf.Peers) != Conf.NServers {
-		panic(fmt.Sprint("should not happen, len(Conf.Peers) != Conf.NServers"))
-	}
-	for i := 0; i < Conf.NServers; i++ {
-		var conn net.Conn
-		var err error
-		conn, err = net.Dial("tcp", Conf.Peers[i])
+		own := localHandshake(RoleServer, n.Id, uint32(Conf.GroupId), n.Codec)
+		link, err := withDeadline(conn, func() (Link, error) {
+			return acceptHandshake(reader, writer, own, RoleServer, func(id uint32) error {
+				if id >= n.Id { // only a smaller id dials this server
+					return fmt.Errorf("%w: server id %d is out of range", ErrIdMismatch, id)
+				}
+				if dialerGone(conn, reader) {
+					return fmt.Errorf("%w: server id %d", ErrGone, id)
+				}
+				return nil
+			})
+		})
 		if err != nil {
-			time.Sleep(100 * time.Millisecond)
+			_ = conn.Close()
+			if errors.Is(err, ErrVersionMismatch) || errors.Is(err, ErrCodecMismatch) {
+				return err
+			}
+			if errors.Is(err, ErrMalformed) {
+				atomic.AddInt64(&n.Malformed, 1)
+			} else {
+				report(n.Errs, n.Done, err)
+			}
 			i--
 			continue
 		}
 
-		n.SendChan[i] = make(chan []byte, Conf.LenChannel)
-		n.SendConn[i] = &conn
-
-		_, n.Writers[i] = GetReaderWriter(&conn)
+		if old := n.Conns[link.Peer]; old != nil { // the peer has dialed again, see above
+			_ = (*old).Close()
+			i--
+		}
+		n.register(link, conn, reader, writer)
+	}
+	return nil
+}
 
-		c := &Command{CliId: n.Id}
-		err = c.MarshalWriteFlush(n.Writers[i])
-		if err != nil {
-			panic(err)
+/*
+	Dials to the peers whose ids are larger than this server's. A peer is dialed again if the dial or the handshake
+	fails. Returns a ConnError if stop is closed before all peers are connected, or if a peer refuses the connection.
+*/
+func (n *NetTCP) dialing(stop chan struct{}) error {
+	for i := int(n.Id) + 1; i < Conf.NServers; i++ {
+		conn, err := net.Dial("tcp", Conf.Peers[i])
+		if err == nil {
+			var reader *bufio.Reader
+			var writer *bufio.Writer
+			reader, writer, err = GetReaderWriter(&conn)
+			var link Link
+			if err == nil {
+				own := localHandshake(RoleServer, n.Id, uint32(Conf.GroupId), n.Codec)
+				link, err = withDeadline(conn, func() (Link, error) {
+					return dialHandshake(reader, writer, own, i)
+				})
+			}
+			if err == nil {
+				n.register(link, conn, reader, writer)
+				continue
+			}
+			_ = conn.Close()
+			if errors.Is(err, ErrRefused) {
+				return err
+			}
+			report(n.Errs, n.Done, err)
+		}
+		select {
+		case <-stop:
+			return &ConnError{Op: "dial", Peer: i, Err: err}
+		case <-time.After(100 * time.Millisecond):
+			i--
 		}
 	}
+	return nil
 }
 
-func (n *NetTCP) Connect() {
-	var wg sync.WaitGroup
-	wg.Add(2)
+/*
+	Accepts connections from and dials to all peers, then starts the handlers. Returns a ConnError if the listener
+	fails or if a handshake is refused, see accepting and dialing (the first error if both of them fail).
+*/
+func (n *NetTCP) Connect() error {
+	errs := make(chan error, 2)
+	stop := make(chan struct{})
 	go func() {
-		n.accepting()
-		wg.Done()
+		err := n.accepting()
+		errs <- err
+		if err != nil {
+			close(stop) // no peer can connect to this server, so it stops dialing
+		}
 	}()
 	go func() {
-		n.dialing()
-		wg.Done()
+		err := n.dialing(stop)
+		errs <- err
+		if err != nil {
+			_ = n.Listener.Close() // this server fails to connect, so it stops accepting
+		}
 	}()
-	wg.Wait()
+	var first error
+	for i := 0; i < 2; i++ {
+		if err := <-errs; first == nil {
+			first = err
+		}
+	}
+	if first != nil {
+		return first
+	}
 
-	n.Wg.Add(Conf.NServers * 2)
+	n.Wg.Add((Conf.NServers - 1) * 2)
 	for i := 0; i < Conf.NServers; i++ {
+		if i == int(n.Id) {
+			continue
+		}
 		go n.RecvHandler(i)
 		go n.SendHandler(i)
 	}
+	return nil
 }
 
 func (n *NetTCP) RecvHandler(from int) {
@@ -460,46 +776,91 @@ func (n *NetTCP) RecvHandler(from int) {
 	readBuf := make([]byte, Conf.IoBufSize)
 	for {
 		var m Msg
-		err, _ := m.ReadUnmarshal(n.Readers[from], readBuf)
-		if err != nil {
-			// maybe: TCP connection is closed or receives an ill-formed message
+		err, _ := m.ReadDecode(n.Codec, n.Readers[from], readBuf)
+		if err == nil {
+			err = m.Validate()
+		}
+		if errors.Is(err, ErrMalformed) {
+			atomic.AddInt64(&n.Malformed, 1)
+		}
+		if err != nil { // maybe: TCP connection is closed, or a malformed message
+			report(n.Errs, n.Done, &ConnError{Op: "read", Peer: from, Err: err})
+			_ = (*n.Conns[from]).Close()
 			return
 		}
+		m.Dst = uint32(from) + 1 // the sender, see Msg.Dst
 		n.RecvChan <- m
 	}
 }
 
+/*
+	Sends messages to a peer, see note 5 above. If a write fails, the handler reports the error, closes the connection,
+	and drops the messages to the peer from then on, so that MsgSerializer never blocks on a full SendChan. (Rabia
+	tolerates the loss of a minority of peers.)
+*/
 func (n *NetTCP) SendHandler(to int) {
 	defer n.Wg.Done()
+	failed := false
 	for {
 		select {
 		case <-n.Done:
 			return
 		case m := <-n.SendChan[to]:
-			WriteFlush(n.Writers[to], m)
+			if failed {
+				m.Release()
+				continue
+			}
+			if err := n.sendQueued(to, m); err != nil {
+				report(n.Errs, n.Done, &ConnError{Op: "write", Peer: to, Err: err})
+				_ = (*n.Conns[to]).Close()
+				failed = true
+			}
+		}
+	}
+}
+
+/*
+	Writes m and the messages that are already in SendChan[to], then flushes the writer once
+*/
+func (n *NetTCP) sendQueued(to int, m *Buf) error {
+	writer := n.Writers[to]
+	for i := 1; ; i++ {
+		if err := m.Write(writer); err != nil {
+			return err
+		}
+		atomic.AddInt64(&n.Sent, 1)
+		if i == coalesceLimit {
+			break
+		}
+		select {
+		case m = <-n.SendChan[to]:
+			continue
+		default:
 		}
+		break
 	}
+	atomic.AddInt64(&n.Flushes, 1)
+	return writer.Flush()
 }
 
 func (n *NetTCP) PrintStatus() {
 	fmt.Println("net layer id =", n.Id)
-	for _, c := range n.SendConn {
-		fmt.Println("\t ", (*c).LocalAddr(), "\tsend to  \t", (*c).RemoteAddr())
-	}
-	for _, c := range n.RecvConn {
-		fmt.Println("\t ", (*c).LocalAddr(), "\trecv from\t", (*c).RemoteAddr())
+	for i, c := range n.Conns {
+		if c != nil {
+			fmt.Println("\t ", (*c).LocalAddr(), "\tconnected to\t", (*c).RemoteAddr(), "\tserver", i,
+				fmt.Sprintf("\t%+v", n.Links[i]))
+		}
 	}
 	fmt.Println()
 }
 
 func (n *NetTCP) Close() {
-	for _, c := range n.SendConn {
-		_ = (*c).Close()
-	}
-	for _, c := range n.RecvConn {
-		_ = (*c).Close()
+	close(n.Done) // first, so that the handlers do not report the errors of the closed connections
+	for _, c := range n.Conns {
+		if c != nil {
+			_ = (*c).Close()
+		}
 	}
-	close(n.Done)
 	_ = n.Listener.Close()
 	n.Wg.Wait()
 }
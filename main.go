@@ -20,6 +20,8 @@
 package main
 
 import (
+	"fmt"
+	"os"
 	. "rabia/internal/config"
 	"rabia/roles/client"
 	"rabia/roles/controller"
@@ -36,7 +38,10 @@ import (
 func main() {
 	Conf.LoadConfigs()
 	if Conf.Role == "ctrl" {
-		controller.RunController()
+		if err := controller.RunController(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	} else if Conf.Role == "svr" {
 		idx, _ := strconv.Atoi(Conf.Id)
 		RunServer(uint32(idx))
@@ -54,17 +59,25 @@ func main() {
 func RunServer(idx uint32) {
 	// Initialization and establishing peer connections, see comments inside functions
 	svr := server.ServerInit(idx, Conf.SvrIp+":"+Conf.ProxyPort, Conf.SvrIp+":"+Conf.NetworkPort)
-	svr.Prologue()
+	if err := svr.Prologue(); err != nil {
+		fmt.Println("server", idx, "cannot connect to its peers:", err)
+		os.Exit(1)
+	}
 
-	// Initiate a command receiver that listens to the benchmark controller
-	receiver := controller.ReceiverInit(idx, false)
+	// Initiate a command receiver that listens to the benchmark controller (server ids are only unique within a group)
+	receiver := controller.ReceiverInit(uint32(Conf.GroupId*Conf.NServers)+idx, false)
 	receiver.Connect()
-	receiver.MsgToController() // Notify the controller this server is ready to benchmark
+	if err := receiver.MsgToController(); err != nil { // Notify the controller this server is ready to benchmark
+		fmt.Println("server", idx, err)
+	}
 
 	// The receiver does not run on the main server thread,
 	// since it interrupts the main server thread (to shutdown the server) when cluster benchmarking is done
+	// (or when the controller is gone)
 	go func() {
-		receiver.WaitController()
+		if err := receiver.WaitController(); err != nil {
+			fmt.Println("server", idx, err)
+		}
 		time.Sleep(2 * time.Second) // Wait inter-server messaging to be completed
 		_ = syscall.Kill(syscall.Getpid(), syscall.SIGINT)
 	}()
@@ -74,7 +87,9 @@ func RunServer(idx uint32) {
 	svr.Epilogue()
 
 	// Notify the controller that this server has exited
-	receiver.MsgToController()
+	if err := receiver.MsgToController(); err != nil {
+		fmt.Println("server", idx, err)
+	}
 }
 
 /*
@@ -82,14 +97,25 @@ func RunServer(idx uint32) {
 */
 func RunClient(idx uint32) {
 	// Initialization and proxy connection, see comments inside functions
-	cli := client.ClientInit(idx, Conf.ProxyAddr)
+	proxyAddrs := []string{Conf.ProxyAddr}
+	if Conf.NGroups > 1 {
+		proxyAddrs = Conf.ProxyAddrs // one proxy per Rabia group
+	}
+	cli := client.ClientInit(idx, proxyAddrs)
 	cli.Prologue()
 
 	// Initiate a command receiver that listens to the benchmark controller
 	receiver := controller.ReceiverInit(uint32(idx), true)
 	receiver.Connect()
-	receiver.MsgToController()
-	receiver.WaitController()
+	err := receiver.MsgToController()
+	if err == nil {
+		err = receiver.WaitController()
+	}
+	if err != nil { // the controller is gone, so the client exits without benchmarking
+		fmt.Println("client", idx, err)
+		cli.Epilogue()
+		return
+	}
 
 	// The client's main task and the exit actions
 	if Conf.ClosedLoop {
@@ -100,5 +126,7 @@ func RunClient(idx uint32) {
 	cli.Epilogue()
 
 	// Notify the controller that this client has exited
-	receiver.MsgToController()
+	if err := receiver.MsgToController(); err != nil {
+		fmt.Println("client", idx, err)
+	}
 }
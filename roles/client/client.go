@@ -44,6 +44,7 @@ import (
 	"rabia/internal/logger"
 	. "rabia/internal/message"
 	"rabia/internal/rstring"
+	"rabia/internal/shard"
 	"rabia/internal/system"
 	"rabia/internal/tcp"
 	"sort"
@@ -59,6 +60,7 @@ type BatchedCmdLog struct {
 	SendTime    time.Time     // the send time of this client-batched command
 	ReceiveTime time.Time     // the receive time of client-batched command
 	Duration    time.Duration // the calculate latency of this command (ReceiveTime - SendTime)
+	Parts       int           // the num. of per-group requests of this command that are not yet replied (sharding)
 }
 
 /*
@@ -69,10 +71,13 @@ type Client struct {
 	Wg       *sync.WaitGroup // wait any subroutines
 	Done     chan struct{}
 
-	TCP     *tcp.ClientTCP
-	Rand    *rand.Rand
-	Logger  zerolog.Logger // the real-time server log that help to track throughput and the number of connections
-	LogFile *os.File       // the log file that should be called .Sync() method before the routine exits
+	TCP      []*tcp.ClientTCP // one connection per Rabia group, TCP[i] connects to a proxy of group i
+	RecvChan chan Command     // the RecvChan shared by all connections
+	Errs     chan error       // the Errs channel shared by all connections
+	Shard    *shard.ShardMap  // routes commands to groups
+	Rand     *rand.Rand
+	Logger   zerolog.Logger // the real-time server log that help to track throughput and the number of connections
+	LogFile  *os.File       // the log file that should be called .Sync() method before the routine exits
 
 	CommandLog                             []BatchedCmdLog
 	SentSoFar, ReceivedSoFar               int
@@ -80,22 +85,34 @@ type Client struct {
 }
 
 /*
-	Initialize a Rabia client
+	Initialize a Rabia client, proxyIps[i] is the address of the proxy that the client connects to in Rabia group i
 */
-func ClientInit(clientId uint32, proxyIp string) *Client {
+func ClientInit(clientId uint32, proxyIps []string) *Client {
 	zerologger, logFile := logger.InitLogger("client", clientId, 0, "both")
 	c := &Client{
 		ClientId: clientId,
 		Wg:       &sync.WaitGroup{},
 		Done:     make(chan struct{}),
 
-		TCP:     tcp.ClientTcpInit(clientId, proxyIp),
+		TCP:     make([]*tcp.ClientTCP, len(proxyIps)),
+		Shard:   shard.ShardMapInit(Conf.ShardBounds),
 		Rand:    rand.New(rand.NewSource(time.Now().UnixNano() * int64(clientId))),
 		Logger:  zerologger,
 		LogFile: logFile,
 
 		CommandLog: make([]BatchedCmdLog, Conf.NClientRequests/Conf.ClientBatchSize),
 	}
+	if c.Shard.NGroups() != len(proxyIps) {
+		panic(fmt.Sprint("should not happen, one proxy per Rabia group is required ", proxyIps))
+	}
+	for i, proxyIp := range proxyIps {
+		c.TCP[i] = tcp.ClientTcpInit(clientId, proxyIp)
+		c.TCP[i].Group = uint32(i)            // proxyIps are in the order of group ids
+		c.TCP[i].RecvChan = c.TCP[0].RecvChan // replies from all groups are processed by a single routine
+		c.TCP[i].Errs = c.TCP[0].Errs
+	}
+	c.RecvChan = c.TCP[0].RecvChan
+	c.Errs = c.TCP[0].Errs
 	/*
 		SentSoFar, ReceivedSoFar are zeros are initialization
 		startSending, endSending, endReceiving retain their default values
@@ -105,12 +122,14 @@ func ClientInit(clientId uint32, proxyIp string) *Client {
 
 /*
 	1. start the OS signal listener
-	2. establish the TCP connection with a designated proxy
+	2. establish the TCP connection(s) with the designated proxy (or proxies)
 	3. starts a terminal logger
 */
 func (c *Client) Prologue() {
 	go system.SigListen(c.Done) //
-	c.TCP.Connect()
+	for _, t := range c.TCP {
+		t.Connect()
+	}
 	go c.terminalLogger()
 }
 
@@ -118,7 +137,7 @@ func (c *Client) Prologue() {
 	1. close the Done channel to inform other routines who listen to this signal to exit
 	2. write a concluding log to file
 	3. close the log file
-	4. close the TCP connection
+	4. close the TCP connection(s)
 */
 func (c *Client) Epilogue() {
 	close(c.Done)
@@ -126,7 +145,9 @@ func (c *Client) Epilogue() {
 	if err := c.LogFile.Sync(); err != nil {
 		panic(err)
 	}
-	c.TCP.Close()
+	for _, t := range c.TCP {
+		t.Close()
+	}
 }
 
 /*
@@ -141,11 +162,13 @@ func (c *Client) CloseLoopClient() {
 MainLoop:
 	for i := 0; i < Conf.NClientRequests/Conf.ClientBatchSize; i++ {
 		c.sendOneRequest(i)
-		select {
-		case rep := <-c.TCP.RecvChan:
-			c.processOneReply(rep)
-		case <-ticker.C:
-			break MainLoop
+		for replied := false; !replied; { // wait for the replies from all groups that the request is sent to
+			select {
+			case rep := <-c.RecvChan:
+				replied = c.processOneReply(rep)
+			case <-ticker.C:
+				break MainLoop
+			}
 		}
 	}
 	c.endSending = time.Now()
@@ -172,9 +195,11 @@ func (c *Client) OpenLoopClient() {
 		c.Wg.Done()
 	}()
 	go func() {
-		for i := 0; i < Conf.NClientRequests/Conf.ClientBatchSize; i++ {
-			rep := <-c.TCP.RecvChan
-			c.processOneReply(rep)
+		for i := 0; i < Conf.NClientRequests/Conf.ClientBatchSize; {
+			rep := <-c.RecvChan
+			if c.processOneReply(rep) {
+				i++
+			}
 		}
 		c.endReceiving = time.Now()
 		c.Wg.Done()
@@ -188,6 +213,8 @@ func (c *Client) OpenLoopClient() {
 	[0:1]   (1 byte): "0" == a write operation,  "1" == a read operation
 	[1:9]  (8 bytes): a string Key
 	[9:17] (8 bytes): a string Value
+
+	If the key space is sharded, the request is split into one request per group (see the shard package)
 */
 func (c *Client) sendOneRequest(i int) {
 	obj := Command{CliId: c.ClientId, CliSeq: uint32(i), Commands: make([]string, Conf.ClientBatchSize)}
@@ -201,20 +228,46 @@ func (c *Client) sendOneRequest(i int) {
 	time.Sleep(time.Duration(Conf.ClientThinkTime) * time.Millisecond)
 
 	c.CommandLog[i].SendTime = time.Now()
-	c.TCP.SendChan <- obj
+	if len(c.TCP) == 1 {
+		c.CommandLog[i].Parts = 1
+		c.TCP[0].SendChan <- obj
+	} else {
+		parts := make([]*Command, len(c.TCP))
+		for _, cmd := range obj.Commands {
+			g := c.Shard.Route(cmd)
+			if parts[g] == nil {
+				parts[g] = &Command{CliId: c.ClientId, CliSeq: uint32(i)}
+				c.CommandLog[i].Parts++
+			}
+			parts[g].Commands = append(parts[g].Commands, cmd)
+		}
+		for g, part := range parts {
+			if part != nil {
+				c.TCP[g].SendChan <- *part
+			}
+		}
+	}
 	c.SentSoFar += Conf.ClientBatchSize
 }
 
 /*
-	Processes on received reply
+	Processes on received reply, returns true if the replies from all groups that the request is sent to are received
 */
-func (c *Client) processOneReply(rep Command) {
-	if c.CommandLog[rep.CliSeq].Duration != time.Duration(0) {
+func (c *Client) processOneReply(rep Command) bool {
+	if rep.WatchId != 0 { // the benchmark client registers no watch
+		return false
+	}
+	if c.CommandLog[rep.CliSeq].Duration != time.Duration(0) || c.CommandLog[rep.CliSeq].Parts == 0 {
 		panic("already received")
 	}
+	c.ReceivedSoFar += len(rep.Commands)
+	c.CommandLog[rep.CliSeq].Parts--
+	if c.CommandLog[rep.CliSeq].Parts != 0 {
+		return false
+	}
 	c.CommandLog[rep.CliSeq].ReceiveTime = time.Now()
 	c.CommandLog[rep.CliSeq].Duration = c.CommandLog[rep.CliSeq].ReceiveTime.Sub(c.CommandLog[rep.CliSeq].SendTime)
-	c.ReceivedSoFar += Conf.ClientBatchSize
+	return true
 }
 
 /*
@@ -243,6 +296,8 @@ func (c *Client) terminalLogger() {
 				Int("Recv", thisRecv).
 				Float64("Interval Recv Tput (cmd/sec)", tho).Msg("")
 			lastRecv = thisRecv
+		case err := <-c.Errs: // a proxy connection fails
+			c.Logger.Warn().Err(err).Msg("proxy connection error")
 		}
 	}
 }
@@ -62,7 +62,6 @@ import (
 	. "rabia/internal/config"
 	. "rabia/internal/message"
 	"rabia/internal/tcp"
-	"time"
 )
 
 /*
@@ -78,11 +77,18 @@ type Controller struct {
 }
 
 /*
-	Controller's main function
+	Controller's main function, returns an error if the controller cannot listen to or accept connections. A client or a
+	server that fails after it connects is logged and skipped, so the controller goes on with the others.
 */
-func RunController() {
-	c := controllerInit()
-	c.connect()
+func RunController() error {
+	c, err := controllerInit()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Listener.Close() }()
+	if err = c.connect(); err != nil {
+		return err
+	}
 	fmt.Println("all servers and clients are connected")
 	c.MsgToClients() // start the clients
 	printArt()
@@ -93,72 +99,68 @@ func RunController() {
 	fmt.Println("sent to all servers")
 	c.waitServerReplies() // all servers are stopped
 	fmt.Println("received from all servers")
+	return nil
 }
 
 /*
 	Initialize the controller
 */
-func controllerInit() *Controller {
+func controllerInit() (*Controller, error) {
 	listener, err := net.Listen("tcp", Conf.ControllerAddr)
 	if err != nil {
-		panic(fmt.Sprint("should not happen", err))
+		return nil, &tcp.ConnError{Op: "setup", Peer: -1, Err: err}
 	}
 
 	return &Controller{
 		Listener: listener,
 
-		Servers:           make([]*net.Conn, Conf.NServers),
+		Servers:           make([]*net.Conn, Conf.NServers*Conf.NGroups), // the servers of all Rabia groups
 		Clients:           make([]*net.Conn, Conf.NClients),
-		ServerReadWriters: make([]*bufio.ReadWriter, Conf.NServers),
+		ServerReadWriters: make([]*bufio.ReadWriter, Conf.NServers*Conf.NGroups),
 		ClientReadWriters: make([]*bufio.ReadWriter, Conf.NClients),
-	}
+	}, nil
 	/*
 		Note: entries of the four arrays above are not initialized for now
 	*/
 }
 
 /*
-	Connect to other clients and servers
+	Connect to other clients and servers. A connection whose handshake fails (or names a client or a server that is out
+	of range or already connected) is logged and closed, and the controller goes on accepting connections. Returns an
+	error if the listener fails.
 */
-func (c *Controller) connect() {
-	for i := 0; i < Conf.NServers+Conf.NClients; i++ {
+func (c *Controller) connect() error {
+	for i := 0; i < Conf.NServers*Conf.NGroups+Conf.NClients; i++ {
 		conn, err := c.Listener.Accept()
 		if err != nil {
-			panic(fmt.Sprint("should not happen", err))
-		}
-		err = conn.(*net.TCPConn).SetKeepAlive(true)
-		if err != nil {
-			panic(fmt.Sprint("should not happen", err))
-		}
-		err = conn.(*net.TCPConn).SetKeepAlivePeriod(20 * time.Second)
-		if err != nil {
-			panic(fmt.Sprint("should not happen", err))
+			return &tcp.ConnError{Op: "accept", Peer: -1, Err: err}
 		}
-		reader, writer := tcp.GetReaderWriter(&conn)
+		reader, writer, err := tcp.GetReaderWriter(&conn)
 		r := Command{} // if CliSeq == 1: client, if CliSeq == 2: server
-		readBuf := make([]byte, 20)
-		err = r.ReadUnmarshal(reader, readBuf)
-		if err != nil {
-			panic(fmt.Sprint("should not happen", err))
+		if err == nil {
+			readBuf := make([]byte, 20)
+			err = r.ReadUnmarshal(reader, readBuf)
 		}
-		if r.CliSeq == uint32(1) {
-			if c.Clients[r.CliId] != nil {
-				panic(fmt.Sprint("should not happen", err))
+		if err == nil {
+			if r.CliSeq == uint32(1) && r.CliId < uint32(len(c.Clients)) && c.Clients[r.CliId] == nil {
+				c.Clients[r.CliId] = &conn
+				c.ClientReadWriters[r.CliId] = bufio.NewReadWriter(reader, writer)
+				//fmt.Println("controller: connected to a client", r.CliId)
+				continue
 			}
-			c.Clients[r.CliId] = &conn
-			c.ClientReadWriters[r.CliId] = bufio.NewReadWriter(reader, writer)
-			//fmt.Println("controller: connected to a client", r.CliId)
-		} else if r.CliSeq == uint32(2) {
-			if c.Servers[r.CliId] != nil {
-				panic(fmt.Sprint("should not happen", err))
+			if r.CliSeq == uint32(2) && r.CliId < uint32(len(c.Servers)) && c.Servers[r.CliId] == nil {
+				c.Servers[r.CliId] = &conn
+				c.ServerReadWriters[r.CliId] = bufio.NewReadWriter(reader, writer)
+				//fmt.Println("controller: connected to a server", r.CliId)
+				continue
 			}
-			c.Servers[r.CliId] = &conn
-			c.ServerReadWriters[r.CliId] = bufio.NewReadWriter(reader, writer)
-			//fmt.Println("controller: connected to a server", r.CliId)
-		} else {
-			panic(fmt.Sprint("should not happen", err))
+			err = fmt.Errorf("%w: id %d of role %d is out of range or connected", ErrMalformed, r.CliId, r.CliSeq)
 		}
+		fmt.Println("controller:", &tcp.ConnError{Op: "handshake", Peer: -1, Err: err})
+		_ = conn.Close()
+		i--
 	}
+	return nil
 }
 
 /*
@@ -177,11 +179,10 @@ func printArt() {
 	Send a message to all clients
 */
 func (c *Controller) MsgToClients() { // start clients
-	for _, rw := range c.ClientReadWriters {
+	for i, rw := range c.ClientReadWriters {
 		r := &Command{}
-		err := r.MarshalWriteFlush(rw.Writer)
-		if err != nil {
-			panic(fmt.Sprint("should not happen", err))
+		if err := r.MarshalWriteFlush(rw.Writer); err != nil {
+			fmt.Println("controller:", &tcp.ConnError{Op: "write", Peer: i, Err: err})
 		}
 	}
 }
@@ -190,15 +191,15 @@ func (c *Controller) MsgToClients() { // start clients
 	Wait each client to reply
 */
 func (c *Controller) waitClientReplies() { // clients stopped
-	for _, rw := range c.ClientReadWriters {
+	for i, rw := range c.ClientReadWriters {
 		r := Command{}
 		readBuf := make([]byte, 20)
 		err := r.ReadUnmarshal(rw.Reader, readBuf)
-		if err != nil {
-			panic(fmt.Sprint("should not happen", err))
+		if err == nil && r.CliSeq != 1 {
+			err = fmt.Errorf("%w: client %d replies as role %d", ErrMalformed, i, r.CliSeq)
 		}
-		if r.CliSeq != 1 {
-			panic(fmt.Sprint("should not happen", err))
+		if err != nil {
+			fmt.Println("controller:", &tcp.ConnError{Op: "read", Peer: i, Err: err})
 		}
 	}
 }
@@ -207,11 +208,10 @@ func (c *Controller) waitClientReplies() { // clients stopped
 	Send a message to all servers
 */
 func (c *Controller) MsgToServers() { // stop servers
-	for _, rw := range c.ServerReadWriters {
+	for i, rw := range c.ServerReadWriters {
 		r := Command{}
-		err := r.MarshalWriteFlush(rw.Writer)
-		if err != nil {
-			panic(fmt.Sprint("should not happen", err))
+		if err := r.MarshalWriteFlush(rw.Writer); err != nil {
+			fmt.Println("controller:", &tcp.ConnError{Op: "write", Peer: i, Err: err})
 		}
 	}
 }
@@ -220,15 +220,15 @@ func (c *Controller) MsgToServers() { // stop servers
 	Wait each server to reply
 */
 func (c *Controller) waitServerReplies() { // server stopped
-	for _, rw := range c.ServerReadWriters {
+	for i, rw := range c.ServerReadWriters {
 		r := Command{}
 		readBuf := make([]byte, 20)
 		err := r.ReadUnmarshal(rw.Reader, readBuf)
-		if err != nil {
-			panic(fmt.Sprint("should not happen", err))
+		if err == nil && r.CliSeq != 2 {
+			err = fmt.Errorf("%w: server %d replies as role %d", ErrMalformed, i, r.CliSeq)
 		}
-		if r.CliSeq != 2 {
-			panic(fmt.Sprint("should not happen", err))
+		if err != nil {
+			fmt.Println("controller:", &tcp.ConnError{Op: "read", Peer: i, Err: err})
 		}
 	}
 }
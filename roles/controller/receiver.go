@@ -49,50 +49,46 @@ func ReceiverInit(id uint32, isClient bool) *Receiver {
 }
 
 /*
-	Connect to the controller
+	Connect to the controller, dials again until the connection is set up
 */
 func (c *Receiver) Connect() {
-	var conn net.Conn
-	var err error
 	for {
-		conn, err = net.Dial("tcp", Conf.ControllerAddr)
+		conn, err := net.Dial("tcp", Conf.ControllerAddr)
 		if err == nil {
-			err = conn.(*net.TCPConn).SetKeepAlive(true)
-			if err != nil {
-				panic(fmt.Sprint("should not happen", err))
+			var reader *bufio.Reader
+			var writer *bufio.Writer
+			reader, writer, err = tcp.GetReaderWriter(&conn)
+			if err == nil {
+				c.Controller = &conn
+				c.ReadWriter = bufio.NewReadWriter(reader, writer)
+				return
 			}
-			err = conn.(*net.TCPConn).SetKeepAlivePeriod(20 * time.Second)
-			if err != nil {
-				panic(fmt.Sprint("should not happen", err))
-			}
-			break
+			fmt.Println("receiver:", err)
+			_ = conn.Close()
 		}
 		time.Sleep(100 * time.Millisecond)
 	}
-	c.Controller = &conn
-	reader, writer := tcp.GetReaderWriter(&conn)
-	c.ReadWriter = bufio.NewReadWriter(reader, writer)
 }
 
 /*
-	Send a message to the controller
+	Send a message to the controller, returns a ConnError if the message cannot be sent
 */
-func (c *Receiver) MsgToController() {
+func (c *Receiver) MsgToController() error {
 	r := Command{CliId: c.Id, CliSeq: c.ServerClient}
-	err := r.MarshalWriteFlush(c.ReadWriter.Writer)
-	if err != nil {
-		panic(fmt.Sprint("should not happen", err))
+	if err := r.MarshalWriteFlush(c.ReadWriter.Writer); err != nil {
+		return &tcp.ConnError{Op: "write", Peer: -1, Err: err}
 	}
+	return nil
 }
 
 /*
-	Wait the controller to send a message
+	Wait the controller to send a message, returns a ConnError if the connection fails
 */
-func (c *Receiver) WaitController() {
+func (c *Receiver) WaitController() error {
 	r := Command{}
 	readBuf := make([]byte, 20)
-	err := r.ReadUnmarshal(c.ReadWriter.Reader, readBuf)
-	if err != nil {
-		panic(fmt.Sprint("should not happen", err))
+	if err := r.ReadUnmarshal(c.ReadWriter.Reader, readBuf); err != nil {
+		return &tcp.ConnError{Op: "read", Peer: -1, Err: err}
 	}
+	return nil
 }
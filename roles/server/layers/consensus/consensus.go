@@ -29,47 +29,40 @@
 package consensus
 
 import (
-	"container/heap"
 	"fmt"
 	"github.com/rs/zerolog"
-	"math/rand"
 	"os"
+	"rabia/internal/coin"
 	. "rabia/internal/config"
 	"rabia/internal/ledger"
 	"rabia/internal/logger"
 	. "rabia/internal/message"
 	"rabia/internal/queue"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /*
-	Race Conditions Documented
+	Concurrent Accesses to the Ledger
 
-	The correct execution of Rabia assumes a few timing issues documented below never occur. In fact, given the
-	right/default user parameters, these issues are extremely unlikely to happen and they never happened in any
-	testing or benchmarking runs.
+	The MsgHandler and the Executor of an instance, and the proxy's KVSExecutor, access the same ledger ring
+	concurrently, and a ring entry is reused for every LenLedger-th slot. If an entry were reset in place for its next
+	term, one routine could reset a slot while another one is still reading its Term, IsDone, or Decision fields, so
+	each term of an entry has its own Slot object instead (see section 4 of the ledger package's comment):
 
-	Why we claim they virtually cannot occur:
+	1. Renewing an entry (UpdateTermIfNecessary) atomically installs a new Slot, so a routine that still holds the Slot
+	of the previous term reads consistent (but stale) fields, and it checks the Slot's term before updating it.
 
-	These timing issues are there because we use a circular ring buffer, and when one of the MsgHandler/Executor resets
-	a slot while the other access to the slot, problematic results may get returned. Since our default configuration
-	assumes a long ledger (10000+ slots), slots are reset are far away from slots are currently accessed, those timing
-	issues never had a chance to occur.
+	2. The Executor publishes a decision with Slot.SetDecision, and KVSExecutor reads it with Slot.GetDecision, which
+	orders the accesses without a lock.
 
-	Two cases where race condition may occur (extremely unlikely by the default parameter):
+	3. Within a term, MsgHandler writes the received tallies of a round before it notifies the Executor through the
+	Slot's Queue, and never changes them afterwards.
 
-	1. In MsgHandler's function binConMsgHandling(), the routine may call UpdateTermIfNecessary(), which may reset the
-	slot X. However, the Executor may call putBackMyProposal() in the epilogue() function, which may access fields of
-	slot X.
-
-	2. In Executor's function getRequest(), the routine may call UpdateTermIfNecessary(), which may reset the slot X.
-	However, the MsgHandler may access slot X after when it receives a ProposalRequest.
-
-	How to eradicate this issue:
-
-	When modifying or reading Term, IsDone, and Decision fields, acquire Slot.lock first to avoid concurrent writing,
-	undesirable resetting or data overriding. The downside of this modification is this may slow down Rabia. In future
-	versions of Rabia, we will tackle this issue.
+	4. An entry is renewed only after the proxy has applied the entry's slot, so the Executor does not start a slot
+	until its entry is free (isNextSlotFree), and MsgHandler buffers messages of a term that the entry cannot advance
+	to yet (EarlyMsgs). The Executor publishes a decision at the end of epilogue, and it never accesses the slot afterwards.
 */
 
 /*
@@ -123,33 +116,60 @@ type Consensus struct {
 	Done  chan struct{}   // for the server to signal the instance (and other layers and instances) to exit
 
 	NetToMsgHandler  chan Msg // receives ClientRequest, Proposal, State, Vote, ProposalRequest, and Decision
-	MsgHandlerToNet  chan Msg // sends ProposalReply
-	NetToConExecutor chan Msg // receives ProposalReply
+	MsgHandlerToNet  chan Msg // sends ProposalReply, and Decision (to answer a message of an old term)
+	NetToConExecutor chan Msg // receives ProposalReply (read by MsgHandler, which forwards it to the slot's Queue)
 	ConExecutorToNet chan Msg // sends ProposalRequest, Proposal, State, Vote, and Decision
 
-	Queue queue.PQueue
-	QLock *sync.Mutex
+	Queue  queue.Queue // the pending request queue, a decided object is removed from it right away (see epilogue)
+	QLock  *sync.Mutex
+	QReady chan struct{} // notifies the executor that an object is pushed to Queue, see QPush
 
-	SvrSeq int // the slot # currently working on
+	SvrSeq int // the latest slot # that the executor has started
 	Ledger ledger.Ledger
-	Coin   *rand.Rand // the common coin used in the algorithm
+	Coin   coin.CommonCoin // the common coin used in the algorithm
 
 	/*
-		Discard: if it turns out that my proposal != the decision, the consensus object's proxy id and proxy sequence of
-		the decision is recorded in the Discard dictionary. The next time we see the consensus object in the pending
-		queue, we discard the decision.
+		The window of slots in progress, see Executor(): all slots < LowestUndecided are decided, and DecidedSlots
+		records the decided slots > LowestUndecided. WindowMoved notifies the executor that LowestUndecided has
+		increased.
+
+		ELock guards the window and the statistics below that the routines of slots update.
 	*/
-	Discard map[string]bool
-	Logger  zerolog.Logger // consensus layer level logger
-	LogFile *os.File       // the log file that should be called .Sync() method before the routine exits
-
-	NormalSlots, UnmatchedSlots, NullSlots    int    // num. of non-discarded, discarded, and null slots so far,
-	TotalRounds                               uint32 // num. of rounds so far,
-	TotalSlots                                int    // the sum of NormalSlots, UnmatchedSlots, NullSlots, calculated before exit
-	OlderThanTermMsg                          int    // num. of msgs that have terms older than the current slot's term
-	CurrConsecutiveNulls, MaxConsecutiveNulls int    //
-	MaxConsecutiveNullsEndSeq                 int    //
-	NumClientBatchedRequests                  int    // the number of client-batched requests that have been decided
+	LowestUndecided uint32
+	DecidedSlots    map[uint32]bool
+	WindowMoved     chan struct{}
+	ELock           *sync.Mutex
+	/*
+		EarlyMsgs: Proposal, State, Vote, and Decision messages whose terms are newer than the terms that their ledger
+		entries can advance to for now, indexed by ledger entry and kept in their arrival order (at most
+		Conf.LenEarlyMsgs messages per entry). MsgHandler replays them once their entries reach their terms, i.e., when
+		the proxy applies the slots that the entries store (see replayEarlyMsgs). Replayed is the num. of applied slots
+		whose entries have been replayed.
+		Answered: Answered[i] is 1 + the last old slot that MsgHandler has answered to server i (0: none), so that a
+		lagging peer's messages of an old slot are answered once, see answerOldMsg.
+	*/
+	EarlyMsgs map[uint32][]Msg
+	Replayed  uint32
+	Answered  []uint32
+	Logger    zerolog.Logger // consensus layer level logger
+	LogFile   *os.File       // the log file that should be called .Sync() method before the routine exits
+
+	NormalSlots, UnmatchedSlots, NullSlots    int            // num. of non-discarded, discarded, and null slots so far,
+	TotalRounds                               uint32         // num. of rounds so far,
+	TotalSlots                                int            // the sum of NormalSlots, UnmatchedSlots, NullSlots, calculated before exit
+	OlderThanTermMsg                          int            // num. of msgs that have terms older than the current slot's term
+	AnsweredOldMsg                            int            // num. of msgs above that are answered with known decisions
+	BufferedEarlyMsg, DroppedEarlyMsg         int            // num. of msgs of future terms that are buffered and dropped
+	CurrConsecutiveNulls, MaxConsecutiveNulls int            //
+	MaxConsecutiveNullsEndSeq                 int            //
+	NumClientBatchedRequests                  int            // the number of client-batched requests that have been decided
+	ProposalRequests, ProposalRequestRetries  int            // num. of times that the executor requests a proposal, and retries
+	ProxyShares                               map[uint32]int // proxy id -> num. of not-NULL slots that decided its objects
+
+	LedgerStalls    int           // num. of times that the executor waited for the proxy to apply a slot to be reused
+	LedgerStallTime time.Duration // the total time of these waits
+	StallStart      time.Time     // when the current wait started, zero if the executor is not waiting
+	IdleTime        int64         // the total time (ns) that the executor waits for work, accessed atomically
 
 	NumOfRoundsDist []int // index: num of rounds, element: frequency
 
@@ -177,15 +197,22 @@ func ConsensusInit(svrId, insId uint32, done chan struct{}, doneWg *sync.WaitGro
 		NetToConExecutor: netToConExecutor,
 		ConExecutorToNet: conExecutorToNet,
 
-		Queue: make(queue.PQueue, 0),
-		QLock: &sync.Mutex{},
+		Queue:  newQueue(),
+		QLock:  &sync.Mutex{},
+		QReady: make(chan struct{}, 1),
 
 		SvrSeq: -1,
 		Ledger: ledger,
+		Coin:   coin.HashCoinInit(Conf.CoinSecret),
 
-		Discard: make(map[string]bool),
-		Logger:  zerologger0,
-		LogFile: logFile0,
+		DecidedSlots: make(map[uint32]bool),
+		WindowMoved:  make(chan struct{}, 1),
+		ELock:        &sync.Mutex{},
+		EarlyMsgs:    make(map[uint32][]Msg),
+		Answered:     make([]uint32, Conf.NServers),
+		ProxyShares:  make(map[uint32]int),
+		Logger:       zerologger0,
+		LogFile:      logFile0,
 
 		NumOfRoundsDist: make([]int, Conf.LenBlockArray*2+2),
 		/*
@@ -197,7 +224,6 @@ func ConsensusInit(svrId, insId uint32, done chan struct{}, doneWg *sync.WaitGro
 		RoundDistLogger:  zerologger2,
 		RoundDistLogFile: logFile2,
 	}
-	heap.Init(&c.Queue)
 	return c
 }
 
@@ -214,17 +240,9 @@ func ConsensusInit(svrId, insId uint32, done chan struct{}, doneWg *sync.WaitGro
 func (c *Consensus) UpdateTermIfNecessary(seq uint32, pan bool) (ret bool) {
 	slot := seq % Conf.LenLedger
 	term := seq / Conf.LenLedger
-	if term == c.Ledger[slot].Term {
-		return true // same term, proceed
-	} else if term == c.Ledger[slot].Term+1 {
-		// 1 term higher than the current term, update term and then proceed
-		c.Ledger[slot].Lock.Lock()
-		if term == c.Ledger[slot].Term+1 {
-			c.Ledger[slot].Reset()
-			c.Ledger[slot].Term = term
-		}
-		c.Ledger[slot].Lock.Unlock()
-		return true // term updated, proceed
+	// same term, or 1 term higher than the current term (the slot is renewed), proceed
+	if c.Ledger.Renew(slot, term) {
+		return true
 	} else {
 		// message is older than or > 1 newer than the current term, don't proceed
 		if pan {
@@ -241,8 +259,8 @@ func (c *Consensus) PanicTermNotMatched(seq uint32) {
 	if !c.IsTermMatched(seq) {
 		slot := seq % Conf.LenLedger
 		term := seq / Conf.LenLedger
-		panic(fmt.Sprintf("should not happen: seq=%d, term=%d, c.Ledger[slot].Term=%d",
-			seq, term, c.Ledger[slot].Term))
+		panic(fmt.Sprintf("should not happen: seq=%d, term=%d, c.Ledger.Get(slot).Term=%d",
+			seq, term, c.Ledger.Get(slot).Term))
 	}
 }
 
@@ -253,19 +271,100 @@ func (c *Consensus) PanicTermNotMatched(seq uint32) {
 func (c *Consensus) IsTermMatched(seq uint32) bool {
 	slot := seq % Conf.LenLedger
 	term := seq / Conf.LenLedger
-	if term == c.Ledger[slot].Term {
+	if term == c.Ledger.Get(slot).Term {
 		return true
 	}
 	return false
 }
 
 /*
-	Pushes a ConsensusObj to the pending request queue
+	Allocates the pending request queue of the order in Conf.Ordering: "seq" (the default) orders objects by ProSeq and
+	then ProId (see ProxySeqIdLessThan), so a proxy that batches faster than the others gets fewer slots. "fair"
+	serves proxies in a round-robin way, see queue.FairQueue. "time" orders objects by their proxies' timestamps and
+	holds each object for Conf.HoldDelay, see queue.TimeQueue.
+*/
+func newQueue() queue.Queue {
+	switch Conf.Ordering {
+	case "fair":
+		return queue.FairQueueInit(Conf.LenPQueue)
+	case "time":
+		return queue.TimeQueueInit(Conf.LenPQueue, Conf.HoldDelay)
+	default:
+		return queue.PQueueInit(Conf.LenPQueue)
+	}
+}
+
+/*
+	Pushes a ConsensusObj to the pending request queue, and wakes up the executor if it waits for work. Notifications
+	that the executor has not received yet are merged into one.
 */
 func (c *Consensus) QPush(obj ConsensusObj) {
 	c.QLock.Lock()
-	heap.Push(&c.Queue, obj)
+	c.Queue.Push(obj)
 	c.QLock.Unlock()
+	select {
+	case c.QReady <- struct{}{}:
+	default:
+	}
+}
+
+/*
+	Returns the num. of objects in the pending request queue
+*/
+func (c *Consensus) QLen() int {
+	c.QLock.Lock()
+	defer c.QLock.Unlock()
+	return c.Queue.Len()
+}
+
+/*
+	Returns how long the pending request queue holds its head object back before QPop returns it, see queue.TimeQueue
+*/
+func (c *Consensus) QHold() time.Duration {
+	c.QLock.Lock()
+	defer c.QLock.Unlock()
+	return c.Queue.Hold()
+}
+
+/*
+	Returns the total time that the executor has waited for work so far, safe to call from other routines
+*/
+func (c *Consensus) Idle() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.IdleTime))
+}
+
+/*
+	Returns a copy of ProxyShares, safe to call from other routines
+*/
+func (c *Consensus) Shares() map[uint32]int {
+	c.ELock.Lock()
+	defer c.ELock.Unlock()
+	shares := make(map[uint32]int, len(c.ProxyShares))
+	for id, n := range c.ProxyShares {
+		shares[id] = n
+	}
+	return shares
+}
+
+/*
+	Returns the rates of NULL slots and unmatched slots among the decided slots so far, safe to call from other
+	routines. Both rates are 0 before any slot is decided.
+*/
+func (c *Consensus) SlotRates() (nullRate, unmatchedRate float64) {
+	c.ELock.Lock()
+	defer c.ELock.Unlock()
+	total := c.NormalSlots + c.UnmatchedSlots + c.NullSlots
+	return ratio(c.NullSlots, total), ratio(c.UnmatchedSlots, total)
+}
+
+/*
+	Returns n / total, or 0 if total is 0 (e.g., no slot is decided), instead of NaN
+*/
+func ratio(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
 }
 
 /*
@@ -274,11 +373,35 @@ func (c *Consensus) QPush(obj ConsensusObj) {
 func (c *Consensus) QPop() (ConsensusObj, bool) {
 	c.QLock.Lock()
 	defer c.QLock.Unlock()
-	if c.Queue.Len() == 0 {
-		return ConsensusObj{}, false
-	} else {
-		return heap.Pop(&c.Queue).(ConsensusObj), true
-	}
+	return c.Queue.Pop()
+}
+
+/*
+	Records that slot seq has decided a not-NULL ConsensusObj, which moves its proxy's turn in a fair queue
+*/
+func (c *Consensus) QServed(obj *ConsensusObj, seq uint32) {
+	c.QLock.Lock()
+	c.Queue.Served(obj, seq)
+	c.QLock.Unlock()
+}
+
+/*
+	Removes a decided ConsensusObj from the pending request queue, or drops it when it is pushed later if it is not in
+	the queue (see the queue package)
+*/
+func (c *Consensus) QRemove(obj *ConsensusObj) {
+	c.QLock.Lock()
+	c.Queue.Remove(obj)
+	c.QLock.Unlock()
+}
+
+/*
+	Cancels an earlier QRemove call of a ConsensusObj that has not been pushed since then
+*/
+func (c *Consensus) QForget(obj *ConsensusObj) {
+	c.QLock.Lock()
+	c.Queue.Forget(obj)
+	c.QLock.Unlock()
 }
 
 /*
@@ -321,10 +444,9 @@ func (c *Consensus) findRds(percentile int) int {
 	panic("should not happen, program's logic error")
 }
 
-func (c *Consensus) CommonCoinFlip() uint32 {
-	return uint32(c.Coin.Intn(2))
-}
-
-func (c *Consensus) ResetCommonCoin() {
-	c.Coin = rand.New(rand.NewSource(42))
+/*
+	Returns the common coin's bit of a slot's phase, the bit is the same on every server
+*/
+func (c *Consensus) CommonCoinFlip(seq, phase uint32) uint32 {
+	return c.Coin.Flip(seq, phase)
 }
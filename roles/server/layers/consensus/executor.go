@@ -18,13 +18,18 @@ package consensus
 import (
 	"fmt"
 	. "rabia/internal/config"
+	"rabia/internal/ledger"
 	. "rabia/internal/message"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 /*
-	The consensus executor's main function, mainly an event-driven (incoming messages) for-loop. See more comments in
-	called functions. After the for-loop, it counts statistics and write them to the log file.
+	The consensus executor's main function, a for-loop that assigns pending requests to slots. It keeps up to
+	Conf.Window slots in progress at once: each slot is decided by its own routine (see decide), and a new slot starts
+	only if it is less than the lowest undecided slot + Conf.Window. After the for-loop, it waits for the slots in
+	progress, counts statistics and write them to the log file.
 
 	Special notes on ProposalRequest and ProposalReply (again)
 	ProposalRequest:
@@ -36,6 +41,7 @@ func (c *Consensus) Executor() {
 	time.Sleep(Conf.ConsensusStartAfter)
 
 	defer c.Wg.Done()
+	slots := &sync.WaitGroup{} // the routines of the slots in progress
 MainLoop:
 	for {
 		select {
@@ -45,60 +51,74 @@ MainLoop:
 		}
 
 		if proceed := c.getRequest(); !proceed {
+			c.waitForWork()
 			continue
 		}
 
-		seq := uint32(c.SvrSeq)
-		c.phase0Round1BeforeWait(seq)
+		slots.Add(1)
+		go func(seq uint32) {
+			defer slots.Done()
+			c.decide(seq)
+		}(uint32(c.SvrSeq))
+	}
+
+	slots.Wait()
+	c.logExitStatus()
+	if err := c.LogFile.Sync(); err != nil {
+		panic(fmt.Sprint("should not happen", err))
+	}
+	if err := c.RoundDistLogFile.Sync(); err != nil {
+		panic(fmt.Sprint("should not happen", err))
+	}
+}
+
+/*
+	Decides a slot, an event-driven (incoming messages) state machine that follows Rabia's pseudo-code. The slot's phase
+	and round are kept in its ledger Slot, and the incoming messages come from the slot's Queue, so the slots in the
+	window do not interfere with each other. It returns when the slot is decided or when the server exits.
+*/
+func (c *Consensus) decide(seq uint32) {
+	c.phase0Round1BeforeWait(seq)
+	if !c.wait(seq) {
+		return
+	}
+	dec, ret := c.phase0Round1AfterWait(seq)
+	if ret {
+		c.epilogue(seq, dec)
+		return
+	}
+
+	c.phase0Round2BeforeWait(seq)
+	if !c.wait(seq) {
+		return
+	}
+	dec, ret = c.phase0Round2AfterWait(seq)
+	if ret {
+		c.epilogue(seq, dec)
+		return
+	}
+
+	for {
+		c.phaseNRound1BeforeWait(seq)
 		if !c.wait(seq) {
-			continue
+			return
 		}
-		dec, ret := c.phase0Round1AfterWait(seq)
+		dec, ret := c.phaseNRound1AfterWait(seq)
 		if ret {
 			c.epilogue(seq, dec)
-			continue
+			return
 		}
 
-		c.phase0Round2BeforeWait(seq)
+		c.phaseNRound2BeforeWait(seq)
 		if !c.wait(seq) {
-			continue
+			return
 		}
-		dec, ret = c.phase0Round2AfterWait(seq)
+		dec, ret = c.phaseNRound2AfterWait(seq)
 		if ret {
 			c.epilogue(seq, dec)
-			continue
-		}
-
-		for {
-			c.phaseNRound1BeforeWait(seq)
-			if !c.wait(seq) {
-				continue MainLoop
-			}
-			dec, ret := c.phaseNRound1AfterWait(seq)
-			if ret {
-				c.epilogue(seq, dec)
-				continue MainLoop
-			}
-
-			c.phaseNRound2BeforeWait(seq)
-			if !c.wait(seq) {
-				continue MainLoop
-			}
-			dec, ret = c.phaseNRound2AfterWait(seq)
-			if ret {
-				c.epilogue(seq, dec)
-				continue MainLoop
-			}
+			return
 		}
 	}
-
-	c.logExitStatus()
-	if err := c.LogFile.Sync(); err != nil {
-		panic(fmt.Sprint("should not happen", err))
-	}
-	if err := c.RoundDistLogFile.Sync(); err != nil {
-		panic(fmt.Sprint("should not happen", err))
-	}
 }
 
 /*
@@ -107,7 +127,7 @@ MainLoop:
 func (c *Consensus) genProposalMsg(seq uint32) Msg {
 	c.PanicTermNotMatched(seq)
 	slot := seq % Conf.LenLedger
-	obj := c.Ledger[slot].GetMyProposal()
+	obj := c.Ledger.Get(slot).GetMyProposal()
 	obj.SvrSeq = seq
 	msg := Msg{Type: Proposal, Obj: &obj}
 	return msg
@@ -120,11 +140,11 @@ func (c *Consensus) genBinConMsg(seq, pse, rod uint32) Msg {
 	c.PanicTermNotMatched(seq)
 	slot := seq % Conf.LenLedger
 	if rod == 1 {
-		msg := Msg{Phase: pse, Type: State, Value: c.Ledger[slot].GetMyBCMsgs(pse, rod)}
+		msg := Msg{Phase: pse, Type: State, Value: c.Ledger.Get(slot).GetMyBCMsgs(pse, rod)}
 		msg.Obj = &ConsensusObj{SvrSeq: seq}
 		return msg
 	} else if rod == 2 {
-		msg := Msg{Phase: pse, Type: Vote, Value: c.Ledger[slot].GetMyBCMsgs(pse, rod)}
+		msg := Msg{Phase: pse, Type: Vote, Value: c.Ledger.Get(slot).GetMyBCMsgs(pse, rod)}
 		msg.Obj = &ConsensusObj{SvrSeq: seq}
 		return msg
 	} else {
@@ -138,7 +158,7 @@ func (c *Consensus) genBinConMsg(seq, pse, rod uint32) Msg {
 func (c *Consensus) genDecMsgType1(seq uint32) Msg {
 	c.PanicTermNotMatched(seq)
 	slot := seq % Conf.LenLedger
-	obj := c.Ledger[slot].RecvProposalsMajV()
+	obj := c.Ledger.Get(slot).RecvProposalsMajV()
 	obj.SvrSeq = seq
 	msg := Msg{Type: Decision, Obj: &obj}
 	return msg
@@ -160,10 +180,8 @@ func (c *Consensus) genDecMsgType2(seq uint32, obj ConsensusObj) Msg {
 		1. the slot holds >= n - f proposal, and
 		2. the majority value's count >= n / 2 + 1
 */
-func (c *Consensus) genProposalReply(seq uint32, dst uint32) Msg {
-	c.PanicTermNotMatched(seq)
-	slot := seq % Conf.LenLedger
-	obj := c.Ledger[slot].RecvProposalsMajV()
+func (c *Consensus) genProposalReply(s *ledger.Slot, seq uint32, dst uint32) Msg {
+	obj := s.RecvProposalsMajV()
 	obj.SvrSeq = seq
 	msg := Msg{Phase: dst, Type: ProposalReply, Obj: &obj, Value: seq}
 	return msg
@@ -180,26 +198,26 @@ func (c *Consensus) wait(seq uint32) bool {
 		select {
 		case <-c.Done:
 			return false
-		case msg := <-c.Ledger[slot].Queue:
+		case msg := <-c.Ledger.Get(slot).Queue:
 			switch msg.Type {
 			case Proposal, State, Vote:
-				if c.Ledger[slot].HasRecvDec { // if has received a decision message, discard this message
+				if c.Ledger.Get(slot).HasRecvDec() { // if has received a decision message, discard this message
 					continue
 				}
-				if msg.Phase != c.Ledger[slot].Phase {
+				if msg.Phase != c.Ledger.Get(slot).Phase {
 					panic("should not happen 1 (reason see the if case)")
 				}
-				if c.Ledger[slot].Round == 1 && c.Ledger[slot].Phase == 0 && msg.Type != Proposal {
+				if c.Ledger.Get(slot).Round == 1 && c.Ledger.Get(slot).Phase == 0 && msg.Type != Proposal {
 					panic("should not happen 2 (reason see the if case)")
-				} else if c.Ledger[slot].Round == 1 && c.Ledger[slot].Phase != 0 && msg.Type != State {
+				} else if c.Ledger.Get(slot).Round == 1 && c.Ledger.Get(slot).Phase != 0 && msg.Type != State {
 					panic("should not happen 3 (reason see the if case)")
-				} else if c.Ledger[slot].Round == 2 && msg.Type != Vote {
+				} else if c.Ledger.Get(slot).Round == 2 && msg.Type != Vote {
 					panic("should not happen 4 (reason see the if case)")
 				}
 				return true // should continue the program execution
 
 			case Decision:
-				if c.Ledger[slot].IsDone {
+				if c.Ledger.Get(slot).IsDone() {
 					panic("should not happen 5 (reason see the if case)")
 				}
 				/*
@@ -228,17 +246,17 @@ func (c *Consensus) phase0Round1BeforeWait(seq uint32) {
 func (c *Consensus) phase0Round1AfterWait(seq uint32) (ConsensusObj, bool) {
 	c.PanicTermNotMatched(seq)
 	slot := seq % Conf.LenLedger
-	if c.Ledger[slot].RecvProposalsMajT() >= Conf.MajorityPlusF {
+	if c.Ledger.Get(slot).RecvProposalsMajT() >= Conf.MajorityPlusF {
 		msg := c.genDecMsgType1(seq)
 		c.toNet(msg)
-		c.Ledger[slot].Round++
-		return c.Ledger[slot].RecvProposalsMajV(), true
-	} else if c.Ledger[slot].RecvProposalsMajT() >= Conf.Majority {
-		c.Ledger[slot].SetMyBCMsgs(0, 2, 1) // Vote[0,2] = 1
+		c.Ledger.Get(slot).Round++
+		return c.Ledger.Get(slot).RecvProposalsMajV(), true
+	} else if c.Ledger.Get(slot).RecvProposalsMajT() >= Conf.Majority {
+		c.Ledger.Get(slot).SetMyBCMsgs(0, 2, 1) // Vote[0,2] = 1
 	} else {
-		c.Ledger[slot].SetMyBCMsgs(0, 2, 2) // Vote[0,2] = ?
+		c.Ledger.Get(slot).SetMyBCMsgs(0, 2, 2) // Vote[0,2] = ?
 	}
-	c.Ledger[slot].Round++
+	c.Ledger.Get(slot).Round++
 	return ConsensusObj{}, false
 }
 
@@ -256,20 +274,23 @@ func (c *Consensus) phase0Round2BeforeWait(seq uint32) {
 func (c *Consensus) phase0Round2AfterWait(seq uint32) (ConsensusObj, bool) {
 	c.PanicTermNotMatched(seq)
 	slot := seq % Conf.LenLedger
-	if c.Ledger[slot].RecvBCMsgsMajT(0, 2) >= Conf.FaultyPlusOne {
-		m := c.findReturnValue(seq, 0, 2)
+	if c.Ledger.Get(slot).RecvBCMsgsMajT(0, 2) >= Conf.FaultyPlusOne {
+		m, ok := c.findReturnValue(seq, 0, 2)
+		if !ok { // the server is exiting, the next wait call returns false
+			return ConsensusObj{}, false
+		}
 		msg := c.genDecMsgType2(seq, m)
 		c.toNet(msg)
-		c.Ledger[slot].Round++
+		c.Ledger.Get(slot).Round++
 		return m, true
-	} else if c.Ledger[slot].RecvBCMsgsMajT(0, 2) >= 1 {
-		c.Ledger[slot].SetMyBCMsgs(1, 1, c.Ledger[slot].RecvBCMsgsMajV(0, 2)) // State[1] = MajV(Vote[0])
+	} else if c.Ledger.Get(slot).RecvBCMsgsMajT(0, 2) >= 1 {
+		c.Ledger.Get(slot).SetMyBCMsgs(1, 1, c.Ledger.Get(slot).RecvBCMsgsMajV(0, 2)) // State[1] = MajV(Vote[0])
 	} else {
-		c.Ledger[slot].SetMyBCMsgs(1, 1, 0) // State[1] = 0
+		c.Ledger.Get(slot).SetMyBCMsgs(1, 1, 0) // State[1] = 0
 	}
-	c.Ledger[slot].IncrPhaseDecrRound()
-	if c.Ledger[slot].Round != 1 {
-		panic("here c.Ledger[slot].Round != 1")
+	c.Ledger.Get(slot).IncrPhaseDecrRound()
+	if c.Ledger.Get(slot).Round != 1 {
+		panic("here c.Ledger.Get(slot).Round != 1")
 	}
 	return ConsensusObj{}, false
 
@@ -281,7 +302,7 @@ func (c *Consensus) phase0Round2AfterWait(seq uint32) (ConsensusObj, bool) {
 func (c *Consensus) phaseNRound1BeforeWait(seq uint32) {
 	c.PanicTermNotMatched(seq)
 	slot := seq % Conf.LenLedger
-	pse := c.Ledger[slot].Phase
+	pse := c.Ledger.Get(slot).Phase
 	msg := c.genBinConMsg(seq, pse, 1)
 	c.toNet(msg)
 }
@@ -292,19 +313,22 @@ func (c *Consensus) phaseNRound1BeforeWait(seq uint32) {
 func (c *Consensus) phaseNRound1AfterWait(seq uint32) (ConsensusObj, bool) {
 	c.PanicTermNotMatched(seq)
 	slot := seq % Conf.LenLedger
-	pse := c.Ledger[slot].Phase
-	if c.Ledger[slot].RecvBCMsgsMajT(pse, 1) >= Conf.MajorityPlusF {
-		m := c.findReturnValue(seq, pse, 1)
+	pse := c.Ledger.Get(slot).Phase
+	if c.Ledger.Get(slot).RecvBCMsgsMajT(pse, 1) >= Conf.MajorityPlusF {
+		m, ok := c.findReturnValue(seq, pse, 1)
+		if !ok { // the server is exiting, the next wait call returns false
+			return ConsensusObj{}, false
+		}
 		msg := c.genDecMsgType2(seq, m)
 		c.toNet(msg)
-		c.Ledger[slot].Round++
+		c.Ledger.Get(slot).Round++
 		return m, true
-	} else if c.Ledger[slot].RecvBCMsgsMajT(pse, 1) >= Conf.Majority {
-		c.Ledger[slot].SetMyBCMsgs(pse, 2, c.Ledger[slot].RecvBCMsgsMajV(pse, 1)) // Vote[p] = MajV(State[p])
+	} else if c.Ledger.Get(slot).RecvBCMsgsMajT(pse, 1) >= Conf.Majority {
+		c.Ledger.Get(slot).SetMyBCMsgs(pse, 2, c.Ledger.Get(slot).RecvBCMsgsMajV(pse, 1)) // Vote[p] = MajV(State[p])
 	} else {
-		c.Ledger[slot].SetMyBCMsgs(pse, 2, 2) // Vote[p] = ?
+		c.Ledger.Get(slot).SetMyBCMsgs(pse, 2, 2) // Vote[p] = ?
 	}
-	c.Ledger[slot].Round++
+	c.Ledger.Get(slot).Round++
 	return ConsensusObj{}, false
 
 }
@@ -315,7 +339,7 @@ func (c *Consensus) phaseNRound1AfterWait(seq uint32) (ConsensusObj, bool) {
 func (c *Consensus) phaseNRound2BeforeWait(seq uint32) {
 	c.PanicTermNotMatched(seq)
 	slot := seq % Conf.LenLedger
-	pse := c.Ledger[slot].Phase
+	pse := c.Ledger.Get(slot).Phase
 	msg := c.genBinConMsg(seq, pse, 2)
 	c.toNet(msg)
 
@@ -327,59 +351,96 @@ func (c *Consensus) phaseNRound2BeforeWait(seq uint32) {
 func (c *Consensus) phaseNRound2AfterWait(seq uint32) (ConsensusObj, bool) {
 	c.PanicTermNotMatched(seq)
 	slot := seq % Conf.LenLedger
-	pse := c.Ledger[slot].Phase
-	randBit := c.CommonCoinFlip()
-	if c.Ledger[slot].RecvBCMsgsMajT(pse, 2) >= Conf.FaultyPlusOne {
-		m := c.findReturnValue(seq, pse, 2)
+	pse := c.Ledger.Get(slot).Phase
+	randBit := c.CommonCoinFlip(seq, pse)
+	if c.Ledger.Get(slot).RecvBCMsgsMajT(pse, 2) >= Conf.FaultyPlusOne {
+		m, ok := c.findReturnValue(seq, pse, 2)
+		if !ok { // the server is exiting, the next wait call returns false
+			return ConsensusObj{}, false
+		}
 		msg := c.genDecMsgType2(seq, m)
 		c.toNet(msg)
-		c.Ledger[slot].Round++
+		c.Ledger.Get(slot).Round++
 		return m, true
-	} else if c.Ledger[slot].RecvBCMsgsMajT(pse, 2) >= 1 {
-		c.Ledger[slot].SetMyBCMsgs(pse+1, 1, c.Ledger[slot].RecvBCMsgsMajV(pse, 2)) // State[p+1] = MajV(Vote[p])
+	} else if c.Ledger.Get(slot).RecvBCMsgsMajT(pse, 2) >= 1 {
+		c.Ledger.Get(slot).SetMyBCMsgs(pse+1, 1, c.Ledger.Get(slot).RecvBCMsgsMajV(pse, 2)) // State[p+1] = MajV(Vote[p])
 	} else {
-		c.Ledger[slot].SetMyBCMsgs(pse+1, 1, randBit) // State[p+1] = randBit
+		c.Ledger.Get(slot).SetMyBCMsgs(pse+1, 1, randBit) // State[p+1] = randBit
 	}
-	c.Ledger[slot].IncrPhaseDecrRound()
+	c.Ledger.Get(slot).IncrPhaseDecrRound()
 	return ConsensusObj{}, false
 }
 
 /*
 	sends a proposal request and waits for a respective reply
+
+	The first request is broadcast. If no reply comes within Conf.ProposalRequestTimeout, the request is sent to the
+	peers one at a time, and then broadcast again, and so on. Returns false if the server exits while waiting.
+
+	MsgHandler forwards the replies to the slot's Queue (see proposalReplyHandling). A Decision message in the Queue
+	also carries the value, and other messages no longer matter because the slot is being decided.
 */
-func (c *Consensus) requestProposalAndWait(seq uint32) ConsensusObj {
+func (c *Consensus) requestProposalAndWait(seq uint32) (ConsensusObj, bool) {
 	//fmt.Println(c.SvrId, "seq = ", seq, "requestProposalAndWait")
-	msg := Msg{Phase: c.SvrId, Type: ProposalRequest, Value: seq}
-	c.toNet(msg)
-	for {
-		msg := <-c.NetToConExecutor
-		if msg.Type != ProposalReply {
-			panic(fmt.Sprint("should not happen, msg.Type != ProposalReply"))
+	s := c.Ledger.Get(seq % Conf.LenLedger)
+	c.ELock.Lock()
+	c.ProposalRequests++
+	c.ELock.Unlock()
+	timer := time.NewTimer(Conf.ProposalRequestTimeout)
+	defer timer.Stop()
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			c.ELock.Lock()
+			c.ProposalRequestRetries++
+			c.ELock.Unlock()
 		}
-		if msg.Value < seq {
-			continue
+		c.toNet(c.genProposalRequest(seq, attempt))
+	WaitLoop:
+		for {
+			select {
+			case <-c.Done:
+				return ConsensusObj{}, false
+			case <-timer.C:
+				timer.Reset(Conf.ProposalRequestTimeout)
+				break WaitLoop
+			case msg := <-s.Queue:
+				if msg.Type == ProposalReply || msg.Type == Decision {
+					//fmt.Println(c.SvrId, "seq = ", seq, "requestProposalAndWait done")
+					return *msg.Obj, true
+				}
+			}
 		}
-		//fmt.Println(c.SvrId, "seq = ", seq, "requestProposalAndWait done")
-		return *msg.Obj
 	}
 }
 
+/*
+	Generates the ProposalRequest message of an attempt: attempt 0 is a broadcast, and each of the next NServers - 1
+	attempts asks one of the peers, after which the cycle repeats
+*/
+func (c *Consensus) genProposalRequest(seq uint32, attempt int) Msg {
+	msg := Msg{Phase: c.SvrId, Type: ProposalRequest, Value: seq}
+	if i := attempt % Conf.NServers; i != 0 {
+		msg.Dst = (c.SvrId+uint32(i))%uint32(Conf.NServers) + 1 // the i-th peer after this server
+	}
+	return msg
+}
+
 /*
 	The find return value function that follows Rabia's pseudo-code
 */
-func (c *Consensus) findReturnValue(seq, pse, rod uint32) ConsensusObj {
+func (c *Consensus) findReturnValue(seq, pse, rod uint32) (ConsensusObj, bool) {
 	c.PanicTermNotMatched(seq)
 	slot := seq % Conf.LenLedger
-	if c.Ledger[slot].RecvBCMsgsMajV(pse, rod) == 1 {
-		if c.Ledger[slot].RecvProposalsMajT() >= Conf.Majority {
-			obj := c.Ledger[slot].RecvProposalsMajV()
+	if c.Ledger.Get(slot).RecvBCMsgsMajV(pse, rod) == 1 {
+		if c.Ledger.Get(slot).RecvProposalsMajT() >= Conf.Majority {
+			obj := c.Ledger.Get(slot).RecvProposalsMajV()
 			obj.SvrSeq = seq
-			return obj
+			return obj, true
 		} else {
 			return c.requestProposalAndWait(seq)
 		}
 	} else {
-		return ConsensusObj{IsNull: true, SvrSeq: seq}
+		return ConsensusObj{IsNull: true, SvrSeq: seq}, true
 	}
 }
 
@@ -394,35 +455,87 @@ func (c *Consensus) toNet(msg Msg) {
 	Sets my proposal and return true if there's a pending request, otherwise, return false
 */
 func (c *Consensus) getRequest() bool {
+	if !c.isNextSlotInWindow() || !c.isNextSlotFree() {
+		return false
+	}
 	if obj, ok := c.QPop(); ok {
-		if c.Discard[obj.GetIdSeq()] {
-			delete(c.Discard, obj.GetIdSeq())
-			return false
-		} else {
-			//c.SvrSeq += Conf.NConcurrency
-			c.SvrSeq += 1
-			c.UpdateTermIfNecessary(uint32(c.SvrSeq), true)
-			slot := uint32(c.SvrSeq) % Conf.LenLedger
-			c.Ledger[slot].SetMyProposal(obj)
-			c.Ledger[slot].Round = 1
-			c.ResetCommonCoin()
-			return true
-		}
+		//c.SvrSeq += Conf.NConcurrency
+		c.SvrSeq += 1
+		c.UpdateTermIfNecessary(uint32(c.SvrSeq), true)
+		slot := uint32(c.SvrSeq) % Conf.LenLedger
+		c.Ledger.Get(slot).SetMyProposal(obj)
+		c.Ledger.Get(slot).Round = 1
+		return true
 	} else {
 		return false
 	}
 }
 
 /*
-	Actions performed when a decision is reached
+	Blocks until the pending request queue may have an object that is not held back and the next slot may be free and
+	in the window, or until the server exits. The wait time is added to IdleTime.
+*/
+func (c *Consensus) waitForWork() {
+	hold := c.QHold()
+	if c.QLen() > 0 && hold == 0 && c.isNextSlotInWindow() && c.Ledger.IsFree(uint32(c.SvrSeq+1)) {
+		return // the state has changed since getRequest returned
+	}
+	var released <-chan time.Time // fires when the queue releases its head object
+	if hold > 0 {
+		timer := time.NewTimer(hold)
+		defer timer.Stop()
+		released = timer.C
+	}
+	start := time.Now()
+	select {
+	case <-c.Done:
+	case <-c.QReady:
+	case <-c.Ledger.Freed():
+	case <-c.WindowMoved:
+	case <-released:
+	}
+	atomic.AddInt64(&c.IdleTime, int64(time.Since(start)))
+}
+
+/*
+	Returns whether the next slot is less than the lowest undecided slot + Conf.Window
+*/
+func (c *Consensus) isNextSlotInWindow() bool {
+	c.ELock.Lock()
+	defer c.ELock.Unlock()
+	return uint32(c.SvrSeq+1) < c.LowestUndecided+uint32(Conf.Window)
+}
+
+/*
+	Returns whether the next slot can be started, i.e., the proxy has applied the decision that the next slot's ledger
+	entry holds (see section 5 of the ledger package's comment). Otherwise, the executor stalls until the proxy catches
+	up, and the stall is counted in LedgerStalls and LedgerStallTime.
+*/
+func (c *Consensus) isNextSlotFree() bool {
+	if c.Ledger.IsFree(uint32(c.SvrSeq + 1)) {
+		if !c.StallStart.IsZero() {
+			c.LedgerStallTime += time.Since(c.StallStart)
+			c.StallStart = time.Time{}
+		}
+		return true
+	}
+	if c.StallStart.IsZero() {
+		c.LedgerStalls++
+		c.StallStart = time.Now()
+	}
+	return false
+}
+
+/*
+	Actions performed when a decision is reached. The routines of the slots in the window call it concurrently, so it
+	holds ELock.
 */
 func (c *Consensus) epilogue(seq uint32, dec ConsensusObj) {
+	c.ELock.Lock()
+	defer c.ELock.Unlock()
 	c.PanicTermNotMatched(seq)
 	slot := seq % Conf.LenLedger
 
-	c.Ledger[slot].Decision = dec
-	c.Ledger[slot].IsDone = true
-
 	if dec.IsNull {
 		c.NullSlots++
 		c.CurrConsecutiveNulls++
@@ -435,17 +548,20 @@ func (c *Consensus) epilogue(seq uint32, dec ConsensusObj) {
 		}
 		c.CurrConsecutiveNulls = 0
 
-		if !ProxySeqIdEqual(&dec, &c.Ledger[slot].MyProposal) {
+		if !ProxySeqIdEqual(&dec, &c.Ledger.Get(slot).MyProposal) {
 			c.UnmatchedSlots++
 			c.putBackMyProposal(seq)
-			c.Discard[dec.GetIdSeq()] = true
+			c.QRemove(&dec)
 
 		} else {
 			c.NormalSlots++
+			c.QForget(&dec) // in case that an earlier slot decided it, see isDuplicate in the proxy
 		}
 
 		// whether we did UnmatchedSlots++ or NormalSlots++, some client-requests are processed, so we do the following
 		c.NumClientBatchedRequests += len(dec.CliIds)
+		c.ProxyShares[dec.ProId]++
+		c.QServed(&dec, seq)
 	}
 
 	/*
@@ -465,7 +581,7 @@ func (c *Consensus) epilogue(seq uint32, dec ConsensusObj) {
 		Note 2: if Per1000RoundDist(old/new) is [0 7 16 977], it does NOT mean there are 7 2-round slots,
 		instead, it means there are 7 1-round slots among the pass 1000 slots.
 	*/
-	currentRoundNum := c.Ledger[slot].Phase*2 + c.Ledger[slot].Round
+	currentRoundNum := c.Ledger.Get(slot).Phase*2 + c.Ledger.Get(slot).Round
 	if currentRoundNum <= 3 {
 		currentRoundNum = 3
 	} else if currentRoundNum%2 == 0 {
@@ -475,6 +591,14 @@ func (c *Consensus) epilogue(seq uint32, dec ConsensusObj) {
 	//c.NumOfRounds[c.NumOfRoundsIdx] = currentRoundNum
 	c.NumOfRoundsDist[currentRoundNum] += 1
 
+	/*
+		The proxy may apply the decision from now on, and the entry may be renewed for its next term once the decision
+		is applied, so the slot must not be accessed after this line
+	*/
+	c.Ledger.Get(slot).SetDecision(dec)
+	c.Ledger.NotifyDecided()
+	c.moveWindow(seq)
+
 	/*
 		Below is the code for Per1000RoundDists
 	*/
@@ -512,13 +636,29 @@ func (c *Consensus) epilogue(seq uint32, dec ConsensusObj) {
 	//}
 }
 
+/*
+	Records that slot seq is decided and advances the lowest undecided slot, then wakes up the executor if it waits for
+	the window to move. Called with ELock held.
+*/
+func (c *Consensus) moveWindow(seq uint32) {
+	c.DecidedSlots[seq] = true
+	for c.DecidedSlots[c.LowestUndecided] {
+		delete(c.DecidedSlots, c.LowestUndecided)
+		c.LowestUndecided++
+	}
+	select {
+	case c.WindowMoved <- struct{}{}:
+	default:
+	}
+}
+
 /*
 	Put my proposal back to the request pending queue
 */
 func (c *Consensus) putBackMyProposal(seq uint32) {
 	c.PanicTermNotMatched(seq)
 	slot := seq % Conf.LenLedger
-	obj := c.Ledger[slot].MyProposal
+	obj := c.Ledger.Get(slot).MyProposal
 	c.QPush(obj)
 }
 
@@ -536,12 +676,24 @@ func (c *Consensus) logExitStatus() {
 		Int("NumClientBatchedRequests", c.NumClientBatchedRequests).
 		Int("NumClientUnbatchedRequests", c.NumClientBatchedRequests*Conf.ClientBatchSize).
 		Uint32("TotalRounds", c.TotalRounds).
-		Float64("avgNumOfRounds", float64(c.TotalRounds)/float64(c.TotalSlots)).
+		Float64("avgNumOfRounds", ratio(int(c.TotalRounds), c.TotalSlots)).
 		Int("p95NumOfrounds", c.findRds(95)).
 		Int("p99NumOfrounds", c.findRds(99)).
 		Int("maxNumOfrounds", c.findRds(100)).
 		Ints("roundsDistribution", RemoveTrailingZeros(c.NumOfRoundsDist)).
 		Int("OlderThanTermMsg", c.OlderThanTermMsg).
+		Int("AnsweredOldMsg", c.AnsweredOldMsg).
+		Int("BufferedEarlyMsg", c.BufferedEarlyMsg).
+		Int("DroppedEarlyMsg", c.DroppedEarlyMsg).
 		Int("MaxConsecutiveNulls", c.MaxConsecutiveNulls).
-		Int("MaxConsecutiveNullsEndSeq", c.MaxConsecutiveNullsEndSeq).Msg("")
+		Int("MaxConsecutiveNullsEndSeq", c.MaxConsecutiveNullsEndSeq).
+		Int("ProposalRequests", c.ProposalRequests).
+		Int("ProposalRequestRetries", c.ProposalRequestRetries).
+		Int("LedgerStalls", c.LedgerStalls).
+		Dur("LedgerStallTime", c.LedgerStallTime).
+		Dur("IdleTime", c.Idle()).
+		Str("Ordering", Conf.Ordering).
+		Float64("NullRate", ratio(c.NullSlots, c.TotalSlots)).
+		Float64("UnmatchedRate", ratio(c.UnmatchedSlots, c.TotalSlots)).
+		Interface("ProxyShares", c.ProxyShares).Msg("")
 }
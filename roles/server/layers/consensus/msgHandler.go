@@ -25,6 +25,12 @@ import (
 	Executor. Instead, after gathering strictly n - f messages for each round (see where HasEnoughMsg is called),
 	it then notifies the Executor. MsgHandler ignores future messages for this round to make sure the majority value
 	is stable after notifying the Executor.
+
+	Messages of future terms are buffered and replayed when the proxy applies the slots that their ledger entries store,
+	see binConMsgHandling and replayEarlyMsgs.
+
+	MsgHandler returns the ConsensusObj of a message to the pool (see section 4 of the message package's comment) once
+	it has copied the object, unless the message is buffered or forwarded to the Executor.
 */
 func (c *Consensus) MsgHandler() {
 	defer c.Wg.Done()
@@ -33,26 +39,37 @@ MainLoop:
 		select {
 		case <-c.Done:
 			break MainLoop
+		case <-c.Ledger.Renewable():
+			c.replayEarlyMsgs()
+		case msg := <-c.NetToConExecutor: // ProposalReply
+			c.proposalReplyHandling(msg)
 		case msg := <-c.NetToMsgHandler:
 			switch msg.Type {
 			case ClientRequest:
 				c.QPush(*msg.Obj) // push the object to the pending request queue
+				PutConsensusObj(msg.Obj)
 			case ProposalRequest:
 				/*
 					msg.Value contains the sequence number of the message, we are testing whether the term of the
-					message is the same as the term of the Slot object
+					message is the same as the term of the Slot object. The slot is fetched once, so that it is not
+					renewed in between; the majority getters do not modify the slot, so it is safe to read the slot
+					while the Executor is deciding it (see section 4 of the ledger package's comment).
+
+					If the slot is decided and not null, the decision is the value that the requester looks for, so it
+					answers the request even if the slot has been renewed.
 				*/
-				if !c.IsTermMatched(msg.Value) {
+				if dec, ok := c.Ledger.Decision(msg.Value); ok && !dec.IsNull {
+					obj := *dec
+					c.MsgHandlerToNet <- Msg{Phase: msg.Phase, Type: ProposalReply, Obj: &obj, Value: msg.Value}
 					continue
 				}
-				/*
-					Maybe you wonder there's a potential race? see out comments in "Race Conditions Documented" in
-					consensus.go.
-				*/
-				slot := msg.Value % Conf.LenLedger
-				if c.Ledger[slot].HasEnoughMsg(0, 1) {
-					if c.Ledger[slot].RecvProposalsMajT() >= Conf.Majority {
-						c.MsgHandlerToNet <- c.genProposalReply(msg.Value, msg.Phase)
+				s := c.Ledger.Get(msg.Value % Conf.LenLedger)
+				if s.Term != msg.Value/Conf.LenLedger {
+					continue
+				}
+				if s.HasEnoughMsg(0, 1) {
+					if s.RecvProposalsMajT() >= Conf.Majority {
+						c.MsgHandlerToNet <- c.genProposalReply(s, msg.Value, msg.Phase)
 					}
 				}
 			case Proposal, State, Vote, Decision:
@@ -66,55 +83,167 @@ MainLoop:
 
 /*
 	Handles Proposal, State, Vote, and Decision messages
+
+	A message whose term is newer than the term that its ledger entry can advance to (i.e., > 1 newer, or the entry's
+	current slot has not been applied, see section 5 of the ledger package's comment) is buffered in EarlyMsgs. A
+	message whose term is older than the entry's term is answered with the decision of its slot if the ledger still
+	knows it, so that a lagging peer can finish the slot.
 */
 func (c *Consensus) binConMsgHandling(msg Msg) {
+	kept := false // whether msg is buffered or forwarded, otherwise its object is returned to the pool
+	defer func() {
+		if !kept {
+			PutConsensusObj(msg.Obj)
+		}
+	}()
 	seq := msg.Obj.SvrSeq
-	if ok := c.UpdateTermIfNecessary(seq, false); !ok {
-		c.OlderThanTermMsg++
-		return
-	}
-	slot := seq % Conf.LenLedger
+	term := seq / Conf.LenLedger
+	c.UpdateTermIfNecessary(seq, false)
+	/*
+		Fetch the slot once and compare the terms: the Executor may have renewed the slot after the call above, in
+		which case the message is older than the slot
+	*/
+	s := c.Ledger.Get(seq % Conf.LenLedger)
 	Phase := msg.Phase
 	Value := msg.Value
-	if c.Ledger[slot].IsDone {
+	if term > s.Term {
+		kept = c.bufferEarlyMsg(msg)
+		return
+	} else if term < s.Term {
+		c.OlderThanTermMsg++
+		c.answerOldMsg(msg)
+		return
+	} else if s.IsDone() {
 		return
 	}
 	switch msg.Type {
 	case Proposal:
-		if c.Ledger[slot].HasEnoughMsg(0, 1) {
+		if s.HasEnoughMsg(0, 1) {
 			return
 		}
-		c.Ledger[slot].PutRecvProposals(*msg.Obj)
-		if c.Ledger[slot].HasEnoughMsg(0, 1) {
+		s.PutRecvProposals(*msg.Obj)
+		if s.HasEnoughMsg(0, 1) {
 			out := Msg{Phase: 0, Type: Proposal, Value: seq}
-			c.Ledger[slot].Queue <- out
+			s.Queue <- out
 		}
 
 	case State:
-		if c.Ledger[slot].HasEnoughMsg(Phase, 1) {
+		if s.HasEnoughMsg(Phase, 1) {
 			return
 		}
-		c.Ledger[slot].PutRecvBCMsgs(Phase, 1, Value)
-		if c.Ledger[slot].HasEnoughMsg(Phase, 1) {
+		s.PutRecvBCMsgs(Phase, 1, Value)
+		if s.HasEnoughMsg(Phase, 1) {
 			out := Msg{Phase: Phase, Type: State, Value: seq}
-			c.Ledger[slot].Queue <- out
+			s.Queue <- out
 		}
 
 	case Vote:
-		if c.Ledger[slot].HasEnoughMsg(Phase, 2) {
+		if s.HasEnoughMsg(Phase, 2) {
 			return
 		}
-		c.Ledger[slot].PutRecvBCMsgs(Phase, 2, Value)
-		if c.Ledger[slot].HasEnoughMsg(Phase, 2) {
+		s.PutRecvBCMsgs(Phase, 2, Value)
+		if s.HasEnoughMsg(Phase, 2) {
 			out := Msg{Phase: Phase, Type: Vote, Value: seq}
-			c.Ledger[slot].Queue <- out
+			s.Queue <- out
 		}
 
 	case Decision:
-		if !c.Ledger[slot].HasRecvDec {
-			c.Ledger[slot].Queue <- msg
-			c.Ledger[slot].HasRecvDec = true
+		if !s.HasRecvDec() {
+			s.SetRecvDec()
+			s.Queue <- msg
+			kept = true
 		}
 	}
+}
+
+/*
+	Forwards a ProposalReply to the routine that decides the slot (see requestProposalAndWait) through the slot's Queue.
+	The routine may have got another reply already, so the reply is dropped instead if the Queue is full.
+*/
+func (c *Consensus) proposalReplyHandling(msg Msg) {
+	s := c.Ledger.Get(msg.Value % Conf.LenLedger)
+	if s.Term != msg.Value/Conf.LenLedger || s.IsDone() {
+		return
+	}
+	select {
+	case s.Queue <- msg:
+	default:
+	}
+}
 
+/*
+	Buffers a message of a future term, or drops it if its ledger entry has Conf.LenEarlyMsgs buffered messages.
+	Returns true if the message is buffered.
+*/
+func (c *Consensus) bufferEarlyMsg(msg Msg) bool {
+	idx := msg.Obj.SvrSeq % Conf.LenLedger
+	if len(c.EarlyMsgs[idx]) >= Conf.LenEarlyMsgs {
+		c.DroppedEarlyMsg++
+		return false
+	}
+	c.EarlyMsgs[idx] = append(c.EarlyMsgs[idx], msg)
+	c.BufferedEarlyMsg++
+	return true
+}
+
+/*
+	Handles the buffered messages whose ledger entries have reached (or can advance to) their terms, in their arrival
+	order. The other messages stay in the buffer.
+
+	A buffered message waits for the proxy to apply the slot that its entry stores (see section 5 of the ledger
+	package's comment), so only the entries of the slots applied since the last call are checked, each entry once.
+*/
+func (c *Consensus) replayEarlyMsgs() {
+	applied := c.Ledger.Applied()
+	from := c.Replayed
+	if applied-from > Conf.LenLedger {
+		from = applied - Conf.LenLedger
+	}
+	c.Replayed = applied
+	for seq := from; seq < applied; seq++ {
+		idx := seq % Conf.LenLedger
+		msgs, ok := c.EarlyMsgs[idx]
+		if !ok {
+			continue
+		}
+		var ready, later []Msg
+		for _, msg := range msgs {
+			seq := msg.Obj.SvrSeq
+			if seq/Conf.LenLedger <= c.Ledger.Get(idx).Term || c.UpdateTermIfNecessary(seq, false) {
+				ready = append(ready, msg)
+			} else {
+				later = append(later, msg)
+			}
+		}
+		if len(ready) == 0 {
+			continue
+		}
+		if len(later) == 0 {
+			delete(c.EarlyMsgs, idx)
+		} else {
+			c.EarlyMsgs[idx] = later
+		}
+		for _, msg := range ready {
+			c.binConMsgHandling(msg)
+		}
+	}
+}
+
+/*
+	Answers a Proposal, State, or Vote message of an old term with a Decision message sent to the message's sender only
+	(see Msg.Dst), if the decision of the message's slot is known. A sender is answered once per slot: it sends several
+	messages for a slot, and one decision is enough for it to finish the slot.
+*/
+func (c *Consensus) answerOldMsg(msg Msg) {
+	seq := msg.Obj.SvrSeq
+	if msg.Type == Decision || msg.Dst == 0 || c.Answered[msg.Dst-1] == seq+1 {
+		return
+	}
+	if dec, ok := c.Ledger.Decision(seq); ok {
+		c.AnsweredOldMsg++
+		c.Answered[msg.Dst-1] = seq + 1
+		out := c.genDecMsgType2(seq, *dec)
+		out.Dst = msg.Dst
+		c.MsgHandlerToNet <- out
+	}
 }
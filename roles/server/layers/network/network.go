@@ -22,6 +22,10 @@
 	Note: for messages of type ProposalRequest and ProposalReply, some fields besides the type fields are also used in
 	determining routing destination. See the comment in msg.proto for more details.
 
+	Note: a message that a server sends to itself is delivered in-process (see deliver below), it is neither serialized
+	nor sent over TCP. So the receiver shares the message's ConsensusObj with the sender, and neither of them should
+	modify the object afterwards.
+
 	Comments on the sequence number / logical slot number / message sequence number:
 	They mean the same thing and I use them interchangeably. Why "message sequence number" means the same is a little
 	obscure, basically, messages except those of type ClientRequests has a slot number associated with it, and that
@@ -78,11 +82,14 @@ func NetworkInit(svrId uint32, done chan struct{}, doneWg *sync.WaitGroup, netIp
 }
 
 /*
-	1. establish network-layer TCP connection(s)
+	1. establish network-layer TCP connection(s), returns an error if they cannot be established
 */
-func (n *Network) Prologue() {
-	n.TCP.Connect()
+func (n *Network) Prologue() error {
+	if err := n.TCP.Connect(); err != nil {
+		return err
+	}
 	fmt.Println("network = ", n.SvrId, "successfully connected to all servers")
+	return nil
 }
 
 /*
@@ -107,19 +114,53 @@ MainLoop:
 		case msg := <-n.ProxyIn: // ClientRequest msg
 			n.ToSerializer <- msg
 
-		case msg := <-n.MsgHandlerIn: // ProposalReply msg
+		case msg := <-n.MsgHandlerIn: // ProposalReply and Decision msg
+			if msg.Type == Decision {
+				/*
+					the decision of an old slot that answers a lagging peer's message, send to that peer only,
+					msg.Dst contains the peer's id + 1
+				*/
+				if msg.Dst-1 == n.SvrId {
+					n.deliver(msg)
+					continue
+				}
+				data, err := n.TCP.Codec.MarshalMsg(&msg)
+				if err != nil {
+					panic(fmt.Sprint("should not happen, marshal error", err))
+				}
+				n.TCP.SendChan[msg.Dst-1] <- data
+				continue
+			}
 			/*
 				send to the peer which sends the respective ProposalRequest
 				msg.Phase contains the destination server's id
 			*/
-			data, err := msg.Marshal() // gogo-protobuf
-			//data, err := proto.Marshal(&msg) // vanilla protobuf
+			if msg.Phase == n.SvrId {
+				n.deliver(msg)
+				continue
+			}
+			data, err := n.TCP.Codec.MarshalMsg(&msg)
 			if err != nil {
 				panic(fmt.Sprint("should not happen, marshal error", err))
 			}
-			n.TCP.SendChan[msg.Phase] <- data
+			n.TCP.SendChan[msg.Phase] <- data // the SendHandler releases data
 
 		case msg := <-n.ConExecutorIn: // Proposal, State, Vote, ProposalRequest, and Decision msg
+			if msg.Type == ProposalRequest && msg.Dst != 0 {
+				/*
+					send to the peer that the request asks, msg.Dst contains the destination server's id + 1
+				*/
+				if msg.Dst-1 == n.SvrId {
+					n.deliver(msg)
+					continue
+				}
+				data, err := n.TCP.Codec.MarshalMsg(&msg)
+				if err != nil {
+					panic(fmt.Sprint("should not happen, marshal error", err))
+				}
+				n.TCP.SendChan[msg.Dst-1] <- data
+				continue
+			}
 			/*
 				broadcast the message so all peers' network layers can receive it
 			*/
@@ -129,11 +170,13 @@ MainLoop:
 			receives a message from a peer
 		*/
 		case msg := <-n.TCP.RecvChan:
-			if msg.Type == ProposalReply {
-				n.ToConExecutor <- msg // sends the proposal reply to the executor directly
-			} else {
-				n.ToMsgHandler <- msg
-			}
+			n.deliver(msg)
+
+		/*
+			a peer connection fails, the connection is closed and the server goes on with other peers
+		*/
+		case err := <-n.TCP.Errs:
+			fmt.Println("network = ", n.SvrId, err)
 		}
 	}
 }
@@ -142,18 +185,33 @@ MainLoop:
 	MsgSerializer routine serialize messages of type Msg to byte arrays. So that multiple NetworkTCP SendHandlers
 	do not need to serialize the same message repeatedly, instead, they take the serialized byte arrays and send
 	them to different peers through TCP connections. For each msg in ToSerializer, MsgSerializer serializes it and
-	send it to all send channels.
+	send it to all send channels, and then delivers the message to this server itself.
 */
 func (n *Network) MsgSerializer() {
 	defer n.Wg.Done()
 	for msg := range n.ToSerializer {
-		data, err := msg.Marshal() // gogo-protobuf
-		//data, err := proto.Marshal(&msg) // vanilla protobuf
+		data, err := n.TCP.Codec.MarshalMsg(&msg) // a pooled buffer, see the message package
 		if err != nil {
 			panic(fmt.Sprint("should not happen, marshal error", err))
 		}
-		for _, t := range n.TCP.SendChan { // broadcasting
-			t <- data
+		for i, t := range n.TCP.SendChan { // broadcasting
+			if uint32(i) != n.SvrId {
+				data.Retain(1) // released by the SendHandler
+				t <- data
+			}
 		}
+		data.Release()
+		n.deliver(msg) // after serializing, so the receiver does not share the message with Marshal
+	}
+}
+
+/*
+	Routes a message received from a peer, or a message this server sends to itself, to the consensus layer
+*/
+func (n *Network) deliver(msg Msg) {
+	if msg.Type == ProposalReply {
+		n.ToConExecutor <- msg // sends the proposal reply to the executor directly
+	} else {
+		n.ToMsgHandler <- msg
 	}
 }
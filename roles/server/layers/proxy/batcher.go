@@ -0,0 +1,149 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package proxy
+
+import (
+	"github.com/rs/zerolog"
+	. "rabia/internal/config"
+	. "rabia/internal/message"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	The thresholds of the adaptive batcher's policy, see batcher.adapt
+*/
+const (
+	highNullRate = 0.1  // the null-slot rate above which the batcher grows batches
+	lowNullRate  = 0.02 // the null-slot rate below which the batcher may shrink batches
+)
+
+/*
+	An adaptive batcher that adjusts the size and the timeout of proxy batches (see CmdReceiver) every
+	Conf.BatchAdaptInterval, within the bounds in Conf (see Conf.AdaptiveBatching). It observes three signals:
+
+	1. queue depth: the num. of objects in the consensus instance's pending request queue. If the queue is longer than
+	the window of slots, requests arrive faster than slots are decided, so larger batches put more requests into a slot.
+	2. null-slot rate: the ratio of NULL slots among the decided slots. NULL slots are decided when replicas propose
+	different objects, which is more likely when proxies submit objects more often, so a high rate grows batches.
+	3. decision latency: the time from creating one of this proxy's objects (ConsensusObj.Timestamp) to applying its
+	decision. If it doubles in an interval, the consensus layer falls behind, and so batches grow, too.
+
+	Otherwise, if the queue is empty, few slots are NULL, and the latency does not increase, the system is under light
+	load, and smaller batches reduce the time that a request waits in a batch. Batches grow fast (doubled) and shrink
+	slowly (by a quarter), so that the batcher backs off quickly from overload.
+
+	KVSExecutor records decisions (see observe) and CmdReceiver adapts the batches, so the counters are accessed
+	atomically.
+*/
+type batcher struct {
+	Size    int           // the current batch size
+	Timeout time.Duration // the current batch timeout
+
+	Decided, Nulls       int64         // num. of decided slots and NULL slots since the last adaptation
+	LatencySum, Latencys int64         // the total decision latency (ns) of this proxy's objects, and their num.
+	LastLatency          time.Duration // the avg. decision latency of the last interval, 0 if unknown
+
+	Logger zerolog.Logger // logs each change of the batch size and timeout
+}
+
+/*
+	Initialize a batcher with Conf.ProxyBatchSize and Conf.ProxyBatchTimeout
+*/
+func batcherInit(logger zerolog.Logger) *batcher {
+	return &batcher{
+		Size:    Conf.ProxyBatchSize,
+		Timeout: Conf.ProxyBatchTimeout,
+		Logger:  logger,
+	}
+}
+
+/*
+	Records a decision that this proxy (svrId) applies, safe to call from another routine than adapt
+*/
+func (b *batcher) observe(dec *ConsensusObj, svrId uint32) {
+	atomic.AddInt64(&b.Decided, 1)
+	if dec.IsNull {
+		atomic.AddInt64(&b.Nulls, 1)
+	} else if dec.ProId == svrId && dec.Timestamp != 0 {
+		atomic.AddInt64(&b.LatencySum, time.Now().UnixNano()-dec.Timestamp)
+		atomic.AddInt64(&b.Latencys, 1)
+	}
+}
+
+/*
+	Adjusts the batch size and the batch timeout according to the decisions observed since the last call and the
+	current queue depth. It returns whether the batch changed, and logs the change.
+*/
+func (b *batcher) adapt(depth int) bool {
+	decided := atomic.SwapInt64(&b.Decided, 0)
+	nulls := atomic.SwapInt64(&b.Nulls, 0)
+	latencySum := atomic.SwapInt64(&b.LatencySum, 0)
+	latencys := atomic.SwapInt64(&b.Latencys, 0)
+
+	nullRate := 0.0
+	if decided > 0 {
+		nullRate = float64(nulls) / float64(decided)
+	}
+	latency := b.LastLatency
+	if latencys > 0 {
+		latency = time.Duration(latencySum / latencys)
+	}
+	lastLatency := b.LastLatency
+	b.LastLatency = latency
+
+	size, timeout := b.Size, b.Timeout
+	var reason string
+	switch {
+	case depth > Conf.Window:
+		reason = "queue backlog"
+	case nullRate > highNullRate:
+		reason = "null slots"
+	case lastLatency > 0 && latency > 2*lastLatency:
+		reason = "decision latency"
+	}
+	if reason != "" {
+		size, timeout = size*2, timeout*2
+	} else if depth == 0 && nullRate < lowNullRate && (lastLatency == 0 || latency <= lastLatency) {
+		reason = "light load"
+		size, timeout = size-(size+3)/4, timeout-(timeout+3)/4
+	} else {
+		return false
+	}
+
+	if size < Conf.ProxyBatchSizeMin {
+		size = Conf.ProxyBatchSizeMin
+	} else if size > Conf.ProxyBatchSizeMax {
+		size = Conf.ProxyBatchSizeMax
+	}
+	if timeout < Conf.ProxyBatchTimeoutMin {
+		timeout = Conf.ProxyBatchTimeoutMin
+	} else if timeout > Conf.ProxyBatchTimeoutMax {
+		timeout = Conf.ProxyBatchTimeoutMax
+	}
+	if size == b.Size && timeout == b.Timeout {
+		return false
+	}
+	b.Logger.Warn().
+		Str("batcher", reason).
+		Int("QueueDepth", depth).
+		Float64("NullRate", nullRate).
+		Dur("Latency", latency).
+		Int("Size", size).
+		Dur("Timeout", timeout).Msg("")
+	b.Size, b.Timeout = size, timeout
+	return true
+}
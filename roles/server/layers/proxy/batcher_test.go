@@ -0,0 +1,62 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package proxy
+
+import (
+	"github.com/rs/zerolog"
+	"rabia/internal/config"
+	"rabia/internal/message"
+	"testing"
+	"time"
+)
+
+func TestBatcher_Adapt(t *testing.T) {
+	config.Conf.Window = 1
+	config.Conf.ProxyBatchSize, config.Conf.ProxyBatchTimeout = 8, 4*time.Millisecond
+	config.Conf.ProxyBatchSizeMin, config.Conf.ProxyBatchSizeMax = 2, 16
+	config.Conf.ProxyBatchTimeoutMin, config.Conf.ProxyBatchTimeoutMax = time.Millisecond, 10*time.Millisecond
+	b := batcherInit(zerolog.Nop())
+
+	// a backlog doubles the batch up to the upper bounds
+	if !b.adapt(5) || b.Size != 16 || b.Timeout != 8*time.Millisecond {
+		t.Fatalf("backlog: size %d, timeout %v", b.Size, b.Timeout)
+	}
+	if !b.adapt(5) || b.Size != 16 || b.Timeout != 10*time.Millisecond {
+		t.Fatalf("backlog: size %d, timeout %v", b.Size, b.Timeout)
+	}
+	if b.adapt(5) {
+		t.Fatalf("the batch changed beyond its upper bounds")
+	}
+
+	// an idle system shrinks the batch down to the lower bounds
+	for i := 0; i < 20; i++ {
+		b.adapt(0)
+	}
+	if b.Size != 2 || b.Timeout != time.Millisecond {
+		t.Fatalf("light load: size %d, timeout %v", b.Size, b.Timeout)
+	}
+
+	// many NULL slots grow the batch even if the queue is empty
+	for i := 0; i < 10; i++ {
+		b.observe(&message.ConsensusObj{IsNull: i%2 == 0}, 0)
+	}
+	if !b.adapt(0) || b.Size != 4 || b.Timeout != 2*time.Millisecond {
+		t.Fatalf("null slots: size %d, timeout %v", b.Size, b.Timeout)
+	}
+	if b.Decided != 0 || b.Nulls != 0 {
+		t.Errorf("adapt did not reset the counters")
+	}
+}
@@ -0,0 +1,110 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package proxy
+
+import (
+	. "rabia/internal/config"
+	"rabia/internal/kvs"
+	. "rabia/internal/message"
+	"time"
+)
+
+/*
+	The local deadline of a lease, see lease.go in the kvs package
+*/
+type leaseDeadline struct {
+	Epoch    uint64    // the lease's epoch when the deadline was set
+	Deadline time.Time // the wall-clock time at which this proxy proposes to expire the lease
+	Proposed time.Time // the last time an expire command was proposed, zero if never
+}
+
+/*
+	Starts, restarts, or stops the deadlines of leases according to the lease changes made by the current decision.
+	A deadline starts when this proxy applies the grant or the keep-alive, so deadlines differ slightly among proxies,
+	which does not matter because the expiry itself is decided by consensus.
+*/
+func (p *Proxy) updateLeaseDeadlines() {
+	changes := p.KVStore.TakeLeaseChanges()
+	if len(changes) == 0 {
+		return
+	}
+	now := time.Now()
+	p.LeaseMu.Lock()
+	for _, c := range changes {
+		if c.Deleted {
+			delete(p.LeaseDeadlines, c.Id)
+		} else {
+			p.LeaseDeadlines[c.Id] = &leaseDeadline{Epoch: c.Epoch,
+				Deadline: now.Add(time.Duration(c.TTL) * time.Millisecond)}
+		}
+	}
+	p.LeaseMu.Unlock()
+}
+
+/*
+	Proxy-level main thread 3: every Conf.LeaseCheckInterval, propose an expire command for each lease whose deadline
+	has passed. The commands of one check are sent as one request through ClientsIn, i.e., they are batched and decided
+	like client requests. If an expire command is not decided within Conf.LeaseRetryInterval (e.g., it is decided
+	after a keep-alive, or it is lost), the command is proposed again.
+
+	Note: every proxy proposes expire commands, the first decided one expires the lease and the others do nothing.
+*/
+func (p *Proxy) LeaseExpirer() {
+	defer p.Wg.Done()
+	ticker := time.NewTicker(Conf.LeaseCheckInterval)
+	defer ticker.Stop()
+
+	cliSeq := uint32(0)
+	for {
+		select {
+		case <-p.Done:
+			return
+		case now := <-ticker.C:
+			var cmds []string
+			p.LeaseMu.Lock()
+			for id, d := range p.LeaseDeadlines {
+				if now.Before(d.Deadline) || (!d.Proposed.IsZero() && now.Sub(d.Proposed) < Conf.LeaseRetryInterval) {
+					continue
+				}
+				d.Proposed = now
+				cmds = append(cmds, kvs.Expire(id, d.Epoch))
+			}
+			p.LeaseMu.Unlock()
+			if len(cmds) != 0 {
+				select {
+				case <-p.Done: // CmdReceiver may have exited
+					return
+				case p.ClientsIn <- Command{CliId: p.leaseCliId(), CliSeq: cliSeq, Commands: cmds}:
+				}
+				cliSeq++
+			}
+		}
+	}
+}
+
+/*
+	The client id of expire commands, which is not the id of any client, so that their replies are not sent
+*/
+func (p *Proxy) leaseCliId() uint32 {
+	return uint32(Conf.NClients) + p.SvrId
+}
+
+/*
+	Returns true if the client is connected to this proxy, i.e., false once the client's connection fails
+*/
+func (p *Proxy) connected(cid uint32) bool {
+	return p.TCP.IsConnected(cid)
+}
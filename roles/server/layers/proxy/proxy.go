@@ -17,7 +17,8 @@
 	The proxy package defines the proxy/application layer of a server. The proxy connects to one or more Rabia clients
 	to send and receive client requests. It also executes client commands decided by consensus instance(s). For these
 	two reasons, it has two primary routines that run concurrently, one is CmdReceiver (client command receiver), and
-	the other is KVSExecutor (KV-store executor).
+	the other is KVSExecutor (KV-store executor). A third routine, LeaseExpirer, proposes the expiry of leases (see
+	lease.go).
 */
 package proxy
 
@@ -28,9 +29,11 @@ import (
 	"github.com/rs/zerolog"
 	"os"
 	. "rabia/internal/config"
+	"rabia/internal/kvs"
 	"rabia/internal/ledger"
 	"rabia/internal/logger"
 	. "rabia/internal/message"
+	"rabia/internal/shard"
 	"rabia/internal/tcp"
 	"sync"
 	"time"
@@ -50,13 +53,26 @@ type Proxy struct {
 
 	TCP *tcp.ProxyTCP
 
-	KVStore     map[string]string
+	Batcher    *batcher   // adjusts the batch size and timeout if Conf.AdaptiveBatching is true, see batcher.go
+	QueueDepth func() int // returns the num. of pending objects in the consensus layer (nil: unknown, taken as 0)
+
+	KVStore     *kvs.Store
+	Shard       *shard.ShardMap
 	RedisClient *redis.Client
 	RedisCtx    context.Context
 
 	executeCmdFunc      func(string) string
 	executeAndReplyFunc func()
 
+	Watches          map[uint32]*watch // active watches of connected clients, see watch.go
+	NewWatches       []*watch          // watches registered by the current decision, activated by publishEvents
+	WatchCtr         uint32            // the id of the last registered watch
+	WatchHistory     []slotEvents      // the changes of the most recent slots (at most Conf.WatchHistoryLen slots)
+	WatchHistoryFrom uint32            // the changes of slots before this slot # are no longer retained
+
+	LeaseMu        sync.Mutex                // guards LeaseDeadlines, which KVSExecutor and LeaseExpirer access
+	LeaseDeadlines map[uint64]*leaseDeadline // the local deadlines of leases, see lease.go
+
 	Logger  zerolog.Logger // the proxy-level log that helps to ensure correctness
 	LogFile *os.File       // the log file that should be called .Sync() method before the routine exits
 
@@ -64,6 +80,7 @@ type Proxy struct {
 	CurrDec   *ConsensusObj // the current decision
 	CurrInsId int
 	CurrSeq   uint32
+	RecentIds []string // the ids of the decisions of the last Conf.Window slots ("" if null), see isDuplicate
 }
 
 /*
@@ -83,14 +100,24 @@ func ProxyInit(svrId uint32, done chan struct{}, doneWg *sync.WaitGroup, proxyIp
 
 		TCP: tcp.ProxyTcpInit(svrId, proxyIp, toProxy),
 
-		KVStore:     make(map[string]string),
+		KVStore:     kvs.StoreInit(),
+		Shard:       shard.ShardMapInit(Conf.ShardBounds),
 		RedisClient: RedisInit(svrId),
 		RedisCtx:    context.Background(),
 
 		Logger:  zerologger,
 		Ledger:  ledger,
 		LogFile: logFile,
+
+		Batcher: batcherInit(zerologger),
+
+		Watches:        make(map[uint32]*watch),
+		LeaseDeadlines: make(map[uint64]*leaseDeadline),
+
+		RecentIds: make([]string, Conf.Window),
 	}
+	p.KVStore.RecordEvents = Conf.StorageMode == 0
+	p.KVStore.RecordLeases = Conf.StorageMode == 0
 
 	/*
 		The purpose of these function pointers is to reduce branching on the critical path
@@ -109,6 +136,22 @@ func ProxyInit(svrId uint32, done chan struct{}, doneWg *sync.WaitGroup, proxyIp
 		panic("storage mode (Conf.StorageMode) not supported")
 	}
 
+	/*
+		If the key space is sharded, reject commands that access keys owned by other groups (see the shard package)
+	*/
+	if Conf.NGroups > 1 {
+		if p.executeCmdFunc == nil {
+			panic("sharding (Conf.NGroups > 1) requires storage mode 0 or 1")
+		}
+		executeCmdFunc := p.executeCmdFunc
+		p.executeCmdFunc = func(cmd string) string {
+			if !p.Shard.Owns(cmd, Conf.GroupId) {
+				return kvs.Reject(cmd)
+			}
+			return executeCmdFunc(cmd)
+		}
+	}
+
 	return p
 }
 
@@ -131,20 +174,47 @@ func (p *Proxy) Epilogue() {
 }
 
 /*
-	Proxy-level main thread 1: receive commands from clients, batch them, and then send to the network layer
+	Proxy-level main thread 1: receive commands from clients, batch them, and then send to the network layer. A batch is
+	sent when it has p.Batcher.Size requests, when adding a request would exceed Conf.ProxyBatchBytes command bytes, or
+	when the batch timeout fires. (A single request may exceed Conf.ProxyBatchBytes, it is sent in a batch of its own.)
+	If Conf.AdaptiveBatching is true, it also adjusts the batch size and timeout every Conf.BatchAdaptInterval (see
+	batcher.go), so the arrays below are allocated with the upper bound of batch sizes.
 */
 func (p *Proxy) CmdReceiver() {
 	defer p.Wg.Done()
-	batchClock := time.NewTicker(Conf.ProxyBatchTimeout)
+	batchClock := time.NewTicker(p.Batcher.Timeout)
 	defer batchClock.Stop() // release the resources
+	var adaptClock <-chan time.Time
+	if Conf.AdaptiveBatching {
+		ticker := time.NewTicker(Conf.BatchAdaptInterval)
+		defer ticker.Stop()
+		adaptClock = ticker.C
+	}
 
-	CliIds := make([]uint32, Conf.ProxyBatchSize)
-	CliSqs := make([]uint32, Conf.ProxyBatchSize)
-	Values := make([]string, Conf.ProxyBatchSize*Conf.ClientBatchSize)
+	CliIds := make([]uint32, Conf.ProxyBatchSizeMax)
+	CliSqs := make([]uint32, Conf.ProxyBatchSizeMax)
+	CliLns := make([]uint32, Conf.ProxyBatchSizeMax)
+	Values := make([]string, Conf.ProxyBatchSizeMax*Conf.ClientBatchSize)
 	IdsSqsCtr := 0
 	ValuesCtr := 0
+	BytesCtr := 0 // the num. of command bytes in the batch
 	ProSeq := 0
 
+	flush := func() {
+		obj := ConsensusObj{ProId: p.SvrId, ProSeq: uint32(ProSeq), Timestamp: time.Now().UnixNano(),
+			CliIds: CliIds[:IdsSqsCtr], CliSeqs: CliSqs[:IdsSqsCtr], Commands: Values[:ValuesCtr],
+			CliLens: CliLns[:IdsSqsCtr]}
+		p.ToNet <- Msg{Type: ClientRequest, Obj: &obj}
+		CliIds = make([]uint32, Conf.ProxyBatchSizeMax)
+		CliSqs = make([]uint32, Conf.ProxyBatchSizeMax)
+		CliLns = make([]uint32, Conf.ProxyBatchSizeMax)
+		Values = make([]string, Conf.ProxyBatchSizeMax*Conf.ClientBatchSize)
+		IdsSqsCtr = 0
+		ValuesCtr = 0
+		BytesCtr = 0
+		ProSeq++
+	}
+
 MainLoop:
 	for {
 		select {
@@ -153,38 +223,43 @@ MainLoop:
 			break MainLoop
 
 		case msg := <-p.ClientsIn: // a client's request object
+			size := 0
+			for _, v := range msg.Commands {
+				size += len(v)
+			}
+			if IdsSqsCtr != 0 && Conf.ProxyBatchBytes > 0 && BytesCtr+size > Conf.ProxyBatchBytes {
+				flush() // byte-based proxy batch
+			}
 			CliIds[IdsSqsCtr] = msg.CliId
 			CliSqs[IdsSqsCtr] = msg.CliSeq
+			CliLns[IdsSqsCtr] = uint32(len(msg.Commands))
 			IdsSqsCtr++
 			for _, v := range msg.Commands {
-				Values[ValuesCtr] = v
+				Values = append(Values[:ValuesCtr], v) // a request may have more than Conf.ClientBatchSize commands
 				ValuesCtr++
 			}
-			if IdsSqsCtr == Conf.ProxyBatchSize {
-				obj := ConsensusObj{ProId: p.SvrId, ProSeq: uint32(ProSeq),
-					CliIds: CliIds, CliSeqs: CliSqs, Commands: Values}
-				p.ToNet <- Msg{Type: ClientRequest, Obj: &obj}
-				CliIds = make([]uint32, Conf.ProxyBatchSize)
-				CliSqs = make([]uint32, Conf.ProxyBatchSize)
-				Values = make([]string, Conf.ProxyBatchSize*Conf.ClientBatchSize)
-				IdsSqsCtr = 0
-				ValuesCtr = 0
-				ProSeq++
+			BytesCtr += size
+			if IdsSqsCtr >= p.Batcher.Size || Conf.ProxyBatchBytes > 0 && BytesCtr >= Conf.ProxyBatchBytes {
+				flush()
 			}
 
 		case _ = <-batchClock.C: // time-based proxy batch
 			if IdsSqsCtr != 0 {
-				obj := ConsensusObj{ProId: p.SvrId, ProSeq: uint32(ProSeq),
-					CliIds: CliIds[:IdsSqsCtr], CliSeqs: CliSqs[:IdsSqsCtr], Commands: Values[:ValuesCtr]}
-				p.ToNet <- Msg{Type: ClientRequest, Obj: &obj}
-				CliIds = make([]uint32, Conf.ProxyBatchSize)
-				CliSqs = make([]uint32, Conf.ProxyBatchSize)
-				Values = make([]string, Conf.ProxyBatchSize*Conf.ClientBatchSize)
-				IdsSqsCtr = 0
-				ValuesCtr = 0
-				ProSeq++
+				flush()
 			}
 
+		case <-adaptClock: // adaptive batching
+			depth := 0
+			if p.QueueDepth != nil {
+				depth = p.QueueDepth()
+			}
+			if p.Batcher.adapt(depth) {
+				batchClock.Reset(p.Batcher.Timeout)
+			}
+
+		case err := <-p.TCP.Errs: // a client connection fails, the connection is closed and other clients go on
+			p.Logger.Warn().Err(err).Msg("client connection error")
+
 		case _ = <-p.NetIn: // dec msg -> reply
 			panic("this channel is reserved only, no msg should come in")
 		}
@@ -193,7 +268,8 @@ MainLoop:
 
 /*
 	Proxy-level main thread 2: check the Ledger to see if there's a new command, apply all new commands in sequence on
-	the KV store
+	the KV store. When the next slot is not decided yet, it sleeps until the consensus executor notifies it of a new
+	decision (see NotifyDecided in the ledger package).
 */
 func (p *Proxy) KVSExecutor() {
 	defer p.Wg.Done()
@@ -202,18 +278,26 @@ func (p *Proxy) KVSExecutor() {
 		case <-p.Done:
 			return
 		default:
-			slot := p.CurrSeq % Conf.LenLedger
-			if p.CurrSeq/Conf.LenLedger != p.Ledger[slot].Term {
+			slot := p.Ledger.Get(p.CurrSeq % Conf.LenLedger)
+			dec, ok := slot.GetDecision()
+			if p.CurrSeq/Conf.LenLedger != slot.Term || !ok {
+				select {
+				case <-p.Done:
+					return
+				case <-p.Ledger.Decided():
+				}
 				continue
 			}
-			if !p.Ledger[slot].IsDone {
-				continue
+			p.CurrDec = dec
+			if Conf.AdaptiveBatching {
+				p.Batcher.observe(dec, p.SvrId)
 			}
-			p.CurrDec = &p.Ledger[slot].Decision
 
-			if p.CurrDec.IsNull {
-				p.Logger.Debug().Uint32("SvrSeq", p.CurrDec.SvrSeq).Bool("IsNull", p.CurrDec.IsNull).Msg("")
+			if dup := p.isDuplicate(); p.CurrDec.IsNull || dup {
+				p.Logger.Debug().Uint32("SvrSeq", p.CurrDec.SvrSeq).Bool("IsNull", p.CurrDec.IsNull).
+					Bool("Duplicate", dup).Msg("")
 				p.CurrSeq++
+				p.Ledger.SetApplied(p.CurrSeq)
 				continue
 			} else {
 				p.Logger.Debug().Uint32("SvrSeq", p.CurrDec.SvrSeq).Bool("IsNull", p.CurrDec.IsNull).
@@ -222,31 +306,64 @@ func (p *Proxy) KVSExecutor() {
 
 			p.executeAndReplyFunc()
 			p.CurrSeq++
+			p.Ledger.SetApplied(p.CurrSeq) // the consensus layer may reuse the slot from now on
 		}
 	}
 }
 
+/*
+	Returns whether the current decision repeats one of the decisions of the last Conf.Window - 1 slots. If the
+	consensus layer decides a window of slots at once, a server may propose a consensus object before it learns that
+	an earlier slot in the window has decided the object, so the object may be decided twice within Conf.Window slots.
+	Each server applies the object in the first slot only and treats the repeated decision as a null decision, so they
+	all apply the same commands.
+*/
+func (p *Proxy) isDuplicate() bool {
+	idx := int(p.CurrSeq) % len(p.RecentIds)
+	id := ""
+	if !p.CurrDec.IsNull {
+		id = p.CurrDec.GetIdSeq()
+	}
+	dup := false
+	for i, recent := range p.RecentIds {
+		if i != idx && id != "" && recent == id {
+			dup = true
+		}
+	}
+	p.RecentIds[idx] = id
+	return dup
+}
+
 /*
 	the actual executeCmdFunc depends on Conf.EnableRedis
 */
 func (p *Proxy) singleExecuteAndReply() {
+	start := 0 // the index of the first command of each client request
 	for idx, cid := range p.CurrDec.CliIds {
-		res := make([]string, Conf.ClientBatchSize)
-		for j, cmd := range p.CurrDec.Commands[idx*Conf.ClientBatchSize : idx*Conf.ClientBatchSize+Conf.ClientBatchSize] {
+		n := cliLen(p.CurrDec, idx)
+		res := make([]string, n)
+		for j, cmd := range p.CurrDec.Commands[start : start+n] {
+			if kvs.IsWatchCmd(cmd) {
+				res[j] = p.executeWatchCmd(cid, cmd)
+				continue
+			}
 			res[j] = p.executeCmdFunc(cmd) // the actual function depends on Conf.EnableRedis
 		}
-		if p.TCP.Conns[cid] != nil { // if the client is connected to this proxy
+		start += n
+		if p.connected(cid) { // if the client is connected to this proxy
 			// todo: check the speed here, how about some global variables
 			rep := Command{SvrSeq: p.CurrDec.SvrSeq, CliId: cid, CliSeq: p.CurrDec.CliSeqs[idx], Commands: res}
 			p.TCP.SendChan[cid] <- rep
 		}
 	}
+	p.publishEvents()
+	p.updateLeaseDeadlines()
 }
 
 func (p *Proxy) batchExecuteAndReply() {
 	replies := p.RedisBatchExecuteCmd()
 	for idx, cid := range p.CurrDec.CliIds {
-		if p.TCP.Conns[cid] != nil { // if the client is connected to this proxy
+		if p.connected(cid) { // if the client is connected to this proxy
 			rep := Command{SvrSeq: p.CurrDec.SvrSeq, CliId: cid, CliSeq: p.CurrDec.CliSeqs[idx], Commands: replies[idx]}
 			p.TCP.SendChan[cid] <- rep
 		}
@@ -254,17 +371,18 @@ func (p *Proxy) batchExecuteAndReply() {
 }
 
 /*
-	Execute the KV store command and assemble a reply
+	Execute the KV store command and assemble a reply, see the kvs package for the command vocabulary
 */
 func (p *Proxy) naiveExecuteCmd(cmd string) string {
-	typ := cmd[0:1]
-	key := cmd[1 : 1+Conf.KeyLen]
-	val := cmd[1+Conf.KeyLen:]
-	if typ == "0" { // write
-		p.KVStore[key] = val
-		return "0" + key + "ok"
-	} else { // read
-		v := p.KVStore[key]
-		return "1" + key + v
+	return p.KVStore.Execute(cmd)
+}
+
+/*
+	Returns the num. of commands in the idx-th client request of a consensus object (see CliLens in message.proto)
+*/
+func cliLen(obj *ConsensusObj, idx int) int {
+	if len(obj.CliLens) == 0 {
+		return Conf.ClientBatchSize
 	}
+	return int(obj.CliLens[idx])
 }
@@ -18,6 +18,7 @@ package proxy
 import (
 	"github.com/go-redis/redis/v8"
 	. "rabia/internal/config"
+	"rabia/internal/kvs"
 )
 
 func RedisInit(id uint32) *redis.Client {
@@ -33,10 +34,16 @@ func RedisInit(id uint32) *redis.Client {
 
 /*
 	Execute the KV store command and assemble a reply to return
+
+	Note: the Redis storage modes only support writes and reads; commands of other operation types (see the kvs
+	package) are answered with kvs.StatusNo
 */
 
 func (p *Proxy) redisExecuteCmd(cmd string) string {
 	typ := cmd[0:1]
+	if typ != kvs.OpWrite && typ != kvs.OpRead {
+		return kvs.Reject(cmd)
+	}
 	key := cmd[1 : 1+Conf.KeyLen]
 	val := cmd[1+Conf.KeyLen:]
 	if typ == "0" { // write
@@ -58,18 +65,27 @@ func (p *Proxy) redisExecuteCmd(cmd string) string {
 
 func (p *Proxy) RedisBatchExecuteCmd() [][]string {
 	dec := p.CurrDec
-	mset := make([]string, Conf.ClientBatchSize*Conf.ProxyBatchSize*2) // pending MSET requests
-	mget := make([]string, Conf.ClientBatchSize*Conf.ProxyBatchSize)   // pending MGET requests
-	msetCtr, mgetCtr := 0, 0                                           // elements counter
+	mset := make([]string, len(dec.Commands)*2) // pending MSET requests
+	mget := make([]string, len(dec.Commands))   // pending MGET requests
+	msetCtr, mgetCtr := 0, 0                    // elements counter
 
 	replies := make([][]string, len(dec.CliIds)) // an array of client replies
 	repliesI, repliesJ := 0, 0                   // indexing the 2D array
+	starts := make([]int, len(dec.CliIds))       // the index of the first command of each client request
 
+	start := 0
 	for idx := range dec.CliIds {
-		replies[idx] = make([]string, Conf.ClientBatchSize) // initialize the 1D array
+		n := cliLen(dec, idx)
+		replies[idx] = make([]string, n) // initialize the 1D array
+		starts[idx] = start
 		// for each client's requests
-		for j, cmd := range dec.Commands[idx*Conf.ClientBatchSize : idx*Conf.ClientBatchSize+Conf.ClientBatchSize] {
+		for j, cmd := range dec.Commands[start : start+n] {
 			typ := cmd[0:1]
+			if typ != kvs.OpWrite && typ != kvs.OpRead {
+				// not supported, set a reply so that it is not taken as a read op
+				replies[idx][j] = kvs.Reject(cmd)
+				continue
+			}
 			key := cmd[1 : 1+Conf.KeyLen]
 			val := cmd[1+Conf.KeyLen:]
 			if typ == "0" { // write
@@ -84,6 +100,7 @@ func (p *Proxy) RedisBatchExecuteCmd() [][]string {
 				// if a read op, do not set a reply
 			}
 		}
+		start += n
 	}
 
 	//fmt.Println(msetCtr, mset[:msetCtr])
@@ -104,12 +121,12 @@ func (p *Proxy) RedisBatchExecuteCmd() [][]string {
 		} else {
 
 			for _, v := range vs {
-				for ; len(replies[repliesI][repliesJ]) != 0; { // if not a read op
+				for repliesJ == len(replies[repliesI]) || len(replies[repliesI][repliesJ]) != 0 { // if not a read op
 					/*
 						find the next read op
 					*/
 					repliesJ++
-					if repliesJ == Conf.ClientBatchSize {
+					if repliesJ >= len(replies[repliesI]) {
 						repliesJ = 0
 						repliesI++
 					}
@@ -117,7 +134,7 @@ func (p *Proxy) RedisBatchExecuteCmd() [][]string {
 
 				//if replies[repliesI][repliesJ] should be a read op
 				//req is the original request's OP field + key field
-				req := dec.Commands[repliesI*Conf.ClientBatchSize+repliesJ][:1+Conf.KeyLen]
+				req := dec.Commands[starts[repliesI]+repliesJ][:1+Conf.KeyLen]
 				if v == nil { // if the key does not exists
 					replies[repliesI][repliesJ] = req
 				} else { // if the key exists
@@ -0,0 +1,214 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package proxy
+
+import (
+	. "rabia/internal/config"
+	"rabia/internal/kvs"
+	. "rabia/internal/message"
+	"strconv"
+	"strings"
+)
+
+/*
+	A watch registered by a client connected to this proxy, see watch.go in the kvs package
+*/
+type watch struct {
+	Id     uint32 // unique within this proxy, starts from 1
+	CliId  uint32
+	Prefix string
+	Start  uint32 // the first slot # whose changes are pushed
+
+	Queue    chan Command // the changes to be sent to the client, forwarded by forwardEvents
+	Overflow bool         // whether the watch is canceled because Queue is full, set before Queue is closed
+	Dropped  uint32       // if Overflow, the first slot # whose changes are not pushed
+}
+
+/*
+	The changes of a decided slot, retained for watches that start from a past slot
+*/
+type slotEvents struct {
+	Seq    uint32
+	Events []kvs.Event
+}
+
+/*
+	Executes a watch or an unwatch command issued by client cid. A new watch is activated by publishEvents after the
+	replies of the current slot are sent, so that a client receives a watch's reply before the watch's events.
+
+	Note: every proxy executes the command, but only the proxy that the client connects to keeps the watch. Watch
+	commands are rejected if the key space is sharded, see note 4 of the shard package's comment.
+*/
+func (p *Proxy) executeWatchCmd(cid uint32, cmd string) string {
+	if Conf.StorageMode != 0 { // changes are only recorded by the dictionary KV store
+		return kvs.Reject(cmd)
+	}
+	if Conf.NGroups > 1 { // this group does not see the changes of the keys owned by other groups
+		return kvs.Reject(cmd)
+	}
+	if cmd[0:1] == kvs.OpUnwatch {
+		id, ok := kvs.ParseUnwatch(cmd)
+		if !ok {
+			return kvs.Reject(cmd)
+		}
+		if w, exists := p.Watches[id]; exists && w.CliId == cid {
+			p.cancelWatch(w)
+			return kvs.OpUnwatch + kvs.StatusOk
+		}
+		for i, w := range p.NewWatches {
+			if w.Id == id && w.CliId == cid {
+				p.NewWatches = append(p.NewWatches[:i], p.NewWatches[i+1:]...)
+				return kvs.OpUnwatch + kvs.StatusOk
+			}
+		}
+		return kvs.OpUnwatch + kvs.StatusNo
+	}
+
+	prefix, start, ok := kvs.ParseWatch(cmd)
+	if !ok {
+		return kvs.Reject(cmd)
+	}
+	if start < p.WatchHistoryFrom {
+		return kvs.OpWatch + kvs.StatusNo + strconv.FormatUint(uint64(p.WatchHistoryFrom), 10)
+	}
+	if !p.connected(cid) { // the reply is not sent either
+		return kvs.OpWatch + kvs.StatusOk
+	}
+	p.WatchCtr++
+	p.NewWatches = append(p.NewWatches, &watch{Id: p.WatchCtr, CliId: cid, Prefix: prefix, Start: start})
+	return kvs.OpWatch + kvs.StatusOk + strconv.FormatUint(uint64(p.WatchCtr), 10)
+}
+
+/*
+	Pushes the changes made by the current decision to watches, called after the decision's replies are sent:
+
+	1. activate new watches and replay the retained changes since their start slots
+	2. push the current slot's changes to every watch whose prefix matches, and drop the watches of disconnected clients
+	3. retain the current slot's changes, at most Conf.WatchHistoryLen slots are retained
+
+	Changes are queued to each watch without blocking (see sendEvents), so that a slow client does not stall
+	KVSExecutor.
+*/
+func (p *Proxy) publishEvents() {
+	for _, w := range p.NewWatches {
+		p.activateWatch(w)
+		for _, h := range p.WatchHistory {
+			if !p.sendEvents(w, h.Seq, h.Events) {
+				break
+			}
+		}
+	}
+	p.NewWatches = p.NewWatches[:0]
+
+	events := p.KVStore.TakeEvents()
+	if len(events) == 0 {
+		return
+	}
+	seq := p.CurrDec.SvrSeq
+	for _, w := range p.Watches {
+		if !p.connected(w.CliId) {
+			p.cancelWatch(w)
+			continue
+		}
+		p.sendEvents(w, seq, events)
+	}
+
+	p.WatchHistory = append(p.WatchHistory, slotEvents{Seq: seq, Events: events})
+	if len(p.WatchHistory) > Conf.WatchHistoryLen {
+		p.WatchHistoryFrom = p.WatchHistory[0].Seq + 1
+		p.WatchHistory[0] = slotEvents{} // release the events
+		p.WatchHistory = p.WatchHistory[1:]
+	}
+}
+
+/*
+	Queues the changes of slot seq whose keys match the watch's prefix (if any) to the watch. If the watch's queue is
+	full, the watch is canceled, see the Overflow field. Returns false if the watch is canceled.
+*/
+func (p *Proxy) sendEvents(w *watch, seq uint32, events []kvs.Event) bool {
+	if seq < w.Start {
+		return true
+	}
+	var cmds []string
+	for _, e := range events {
+		if strings.HasPrefix(e.Key, w.Prefix) {
+			cmds = append(cmds, e.String())
+		}
+	}
+	if len(cmds) == 0 {
+		return true
+	}
+	select {
+	case w.Queue <- Command{CliId: w.CliId, SvrSeq: seq, WatchId: w.Id, Commands: cmds}:
+		return true
+	default:
+		w.Overflow, w.Dropped = true, seq
+		p.cancelWatch(w)
+		return false
+	}
+}
+
+// Activates a watch and starts the routine that forwards its changes to its client
+func (p *Proxy) activateWatch(w *watch) {
+	w.Queue = make(chan Command, Conf.WatchQueueLen)
+	p.Watches[w.Id] = w
+	p.Wg.Add(1)
+	go p.forwardEvents(w)
+}
+
+// Cancels an active watch, its routine sends the queued changes (and WatchOverflow if it overflows) and exits
+func (p *Proxy) cancelWatch(w *watch) {
+	delete(p.Watches, w.Id)
+	close(w.Queue)
+}
+
+/*
+	Sends the changes queued to a watch to the watch's client until the watch is canceled or the proxy exits. This
+	routine, instead of KVSExecutor, waits if the client's SendChan is full.
+*/
+func (p *Proxy) forwardEvents(w *watch) {
+	defer p.Wg.Done()
+	for {
+		select {
+		case <-p.Done:
+			return
+		case c, ok := <-w.Queue:
+			if !ok { // the watch is canceled
+				if w.Overflow {
+					p.forward(Command{CliId: w.CliId, SvrSeq: w.Dropped, WatchId: w.Id,
+						Commands: []string{kvs.WatchOverflow}})
+				}
+				return
+			}
+			if !p.connected(w.CliId) {
+				continue // the client is gone, drop the changes until publishEvents cancels the watch
+			}
+			if !p.forward(c) {
+				return
+			}
+		}
+	}
+}
+
+// Sends a Command to its client's SendChan, returns false if the proxy exits before the Command is sent
+func (p *Proxy) forward(c Command) bool {
+	select {
+	case <-p.Done:
+		return false
+	case p.TCP.SendChan[c.CliId] <- c:
+		return true
+	}
+}
@@ -0,0 +1,140 @@
+/*
+    Copyright 2021 Rabia Research Team and Developers
+
+    Licensed under the Apache License, Version 2.0 (the "License");
+    you may not use this file except in compliance with the License.
+    You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+    Unless required by applicable law or agreed to in writing, software
+    distributed under the License is distributed on an "AS IS" BASIS,
+    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+    See the License for the specific language governing permissions and
+    limitations under the License.
+*/
+package proxy
+
+import (
+	"rabia/internal/config"
+	"rabia/internal/kvs"
+	"rabia/internal/message"
+	"rabia/internal/tcp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPublishEvents_SlowWatcher(t *testing.T) {
+	config.Conf.KeyLen = 2
+	config.Conf.WatchQueueLen, config.Conf.WatchHistoryLen = 4, 100
+
+	p := &Proxy{
+		Wg:      &sync.WaitGroup{},
+		Done:    make(chan struct{}),
+		TCP:     &tcp.ProxyTCP{Connected: []int32{1}, SendChan: []chan message.Command{make(chan message.Command)}},
+		KVStore: kvs.StoreInit(),
+		Watches: make(map[uint32]*watch),
+		CurrDec: &message.ConsensusObj{},
+	}
+	p.KVStore.RecordEvents = true
+	if rep := p.executeWatchCmd(0, kvs.Watch("k", 0)); rep != kvs.OpWatch+kvs.StatusOk+"1" {
+		t.Fatalf("executeWatchCmd() = %q", rep)
+	}
+
+	// the client reads nothing, so the queue overflows without blocking publishEvents
+	finished := make(chan struct{})
+	go func() {
+		for seq := uint32(0); seq < 10; seq++ {
+			p.CurrDec.SvrSeq = seq
+			p.KVStore.Execute(kvs.Write("k1", "v"))
+			p.publishEvents()
+		}
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishEvents blocks on a slow watcher")
+	}
+	if len(p.Watches) != 0 {
+		t.Fatalf("the watch that overflows is not canceled")
+	}
+
+	// the client receives the changes of slots 0, 1, ..., then WatchOverflow with the next slot #
+	next := uint32(0)
+	for {
+		var c message.Command
+		select {
+		case c = <-p.TCP.SendChan[0]:
+		case <-time.After(5 * time.Second):
+			t.Fatal("WatchOverflow is not sent")
+		}
+		if c.WatchId != 1 || c.SvrSeq != next {
+			t.Fatalf("got watch %d, slot %d, want watch 1, slot %d", c.WatchId, c.SvrSeq, next)
+		}
+		if c.Commands[0] == kvs.WatchOverflow {
+			break
+		}
+		next++
+	}
+	if next < uint32(config.Conf.WatchQueueLen) || next == 10 {
+		t.Errorf("WatchOverflow at slot %d", next)
+	}
+	close(p.Done)
+	p.Wg.Wait()
+}
+
+func TestExecuteWatchCmd_Sharded(t *testing.T) {
+	config.Conf.KeyLen, config.Conf.NGroups = 2, 2
+	defer func() { config.Conf.NGroups = 1 }()
+
+	p := &Proxy{
+		TCP:     &tcp.ProxyTCP{Connected: []int32{1}},
+		Watches: make(map[uint32]*watch),
+	}
+	for _, cmd := range []string{kvs.Watch("k", 0), kvs.Unwatch(1)} {
+		if rep, want := p.executeWatchCmd(0, cmd), kvs.Reject(cmd); rep != want {
+			t.Errorf("executeWatchCmd(%q) = %q, want %q", cmd, rep, want)
+		}
+	}
+	if len(p.NewWatches) != 0 {
+		t.Errorf("a watch is registered in a sharded deployment")
+	}
+}
+
+func TestPublishEvents_Disconnected(t *testing.T) {
+	config.Conf.KeyLen = 2
+	config.Conf.WatchQueueLen, config.Conf.WatchHistoryLen = 4, 100
+
+	p := &Proxy{
+		Wg:      &sync.WaitGroup{},
+		Done:    make(chan struct{}),
+		TCP:     &tcp.ProxyTCP{Connected: []int32{1}, SendChan: []chan message.Command{make(chan message.Command, 10)}},
+		KVStore: kvs.StoreInit(),
+		Watches: make(map[uint32]*watch),
+		CurrDec: &message.ConsensusObj{},
+	}
+	p.KVStore.RecordEvents = true
+	p.executeWatchCmd(0, kvs.Watch("k", 0))
+	p.KVStore.Execute(kvs.Write("k1", "v"))
+	p.publishEvents()
+	if len(p.Watches) != 1 {
+		t.Fatalf("the watch is not activated")
+	}
+
+	atomic.StoreInt32(&p.TCP.Connected[0], 0) // the client's connection fails
+	p.CurrDec.SvrSeq = 1
+	p.KVStore.Execute(kvs.Write("k1", "v"))
+	p.publishEvents()
+	if len(p.Watches) != 0 {
+		t.Fatalf("the watch of a disconnected client is not canceled")
+	}
+	p.Wg.Wait() // the watch's routine exits without the proxy exiting
+	for len(p.TCP.SendChan[0]) > 0 {
+		if c := <-p.TCP.SendChan[0]; c.SvrSeq != 0 {
+			t.Errorf("the change of slot %d is sent to a disconnected client", c.SvrSeq)
+		}
+	}
+}
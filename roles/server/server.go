@@ -36,6 +36,7 @@ import (
 	"rabia/roles/server/layers/network"
 	"rabia/roles/server/layers/proxy"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -47,7 +48,7 @@ type Server struct {
 	Wg    *sync.WaitGroup
 	Done  chan struct{}
 
-	Ledger  []*ledger.Slot
+	Ledger  ledger.Ledger
 	Logger  zerolog.Logger // the real-time server log that help to track throughput and the number of connections
 	LogFile *os.File       // the log file that should be called .Sync() method before the routine exits,
 	// see the last a few lines of Executor.Executor() function for an example
@@ -75,7 +76,7 @@ func ServerInit(svrId uint32, proxyIp, netIp string) *Server {
 		Wg:    &sync.WaitGroup{},
 		Done:  make(chan struct{}),
 
-		Ledger: make(ledger.Ledger, Conf.LenLedger),
+		Ledger: ledger.LedgerInit(),
 
 		ClientsToProxy:   make(chan Command),
 		ProxyToNet:       make(chan Msg, Conf.LenChannel),
@@ -90,15 +91,12 @@ func ServerInit(svrId uint32, proxyIp, netIp string) *Server {
 
 	s.NetToMsgHandler = make(chan Msg, Conf.LenChannel)
 	s.NetToConExecutor = make(chan Msg, Conf.LenChannel)
-	for i := 0; i < int(Conf.LenLedger); i++ {
-		s.Ledger[i] = &ledger.Slot{}
-		s.Ledger[i].Reset()
-	}
 	s.Proxy = proxy.ProxyInit(svrId, s.Done, s.Wg, proxyIp, s.ClientsToProxy, s.ProxyToNet, s.NetToProxy, s.Ledger)
 	s.Network = network.NetworkInit(svrId, s.Done, s.Wg, netIp, s.NetToProxy, s.ProxyToNet, s.MsgHandlerToNet,
 		s.ConExecutorToNet, s.NetToMsgHandler, s.NetToConExecutor)
 	s.Consensus = consensus.ConsensusInit(svrId, 0, s.Done, s.Wg, s.NetToMsgHandler,
 		s.MsgHandlerToNet, s.NetToConExecutor, s.ConExecutorToNet, s.Ledger)
+	s.Proxy.QueueDepth = s.Consensus.QLen
 	return s
 }
 
@@ -108,24 +106,30 @@ func ServerInit(svrId uint32, proxyIp, netIp string) *Server {
 	3. start the network layer
 	4. start the proxy layer
 	5. starts a terminal logger
+
+	Returns an error if the network layer cannot connect to its peers, in which case the server should exit.
 */
-func (s *Server) Prologue() {
+func (s *Server) Prologue() error {
 	go system.SigListen(s.Done)
-	s.Network.Prologue()
+	if err := s.Network.Prologue(); err != nil {
+		return err
+	}
 	s.Proxy.Prologue()
 	go s.TerminalLogger()
+	return nil
 }
 
 /*
-	1. start the proxy layer (two separate routines)
+	1. start the proxy layer (three separate routines)
 	2. start the network layer (two separate routines)
 	3. start the consensus layer (two separate routines)
 	4. wait all layers to finish
 */
 func (s *Server) ServerMain() {
-	s.Wg.Add(2)
+	s.Wg.Add(3)
 	go s.Proxy.CmdReceiver()
 	go s.Proxy.KVSExecutor()
+	go s.Proxy.LeaseExpirer()
 
 	s.Wg.Add(2)
 	go s.Network.MsgRouter()
@@ -150,7 +154,10 @@ func (s *Server) Epilogue() {
 }
 
 /*
-	A terminal logger that prints the status of a server to terminal
+	A terminal logger that prints the status of a server to terminal. The messages per flush of the network and the
+	proxy layers tell how many messages their SendHandlers write per syscall, see note 5 of the tcp package's comment.
+	The proxy shares tell how many not-NULL slots have decided each proxy's objects so far, see Conf.Ordering, and the
+	NULL and unmatched rates are the rates of such slots among the decided slots so far.
 */
 func (s *Server) TerminalLogger() {
 	tLogger, file := logger.InitLogger("server", s.SvrId, 1, "both")
@@ -163,14 +170,22 @@ func (s *Server) TerminalLogger() {
 
 	lastNotNulls := 0
 	lastCBProcessed := 0
+	lastIdle := time.Duration(0)
+	var lastNetSent, lastNetFlushes, lastProxySent, lastProxyFlushes int64
+	perFlush := func(sent, flushes int64) float64 {
+		if flushes == 0 {
+			return 0
+		}
+		return math.Round(100*float64(sent)/float64(flushes)) / 100
+	}
 	for {
 		select {
 		case <-s.Done:
 			return
 		case <-ticker.C:
 			var proxyConnect int
-			for _, c := range s.Proxy.TCP.Conns {
-				if c != nil {
+			for i := range s.Proxy.TCP.Connected {
+				if s.Proxy.TCP.IsConnected(uint32(i)) {
 					proxyConnect++
 				}
 			}
@@ -178,6 +193,12 @@ func (s *Server) TerminalLogger() {
 			thisNotNulls := s.Consensus.NormalSlots + s.Consensus.UnmatchedSlots
 			thisCBProcessed := s.Consensus.NumClientBatchedRequests
 			throughput := math.Round(float64((thisCBProcessed-lastCBProcessed)*Conf.ClientBatchSize) / Conf.SvrLogInterval.Seconds())
+			malformed := atomic.LoadInt64(&s.Proxy.TCP.Malformed) + atomic.LoadInt64(&s.Network.TCP.Malformed)
+			thisIdle := s.Consensus.Idle()
+			idle := math.Round(100 * (thisIdle - lastIdle).Seconds() / Conf.SvrLogInterval.Seconds())
+			netSent, netFlushes := atomic.LoadInt64(&s.Network.TCP.Sent), atomic.LoadInt64(&s.Network.TCP.Flushes)
+			proxySent, proxyFlushes := atomic.LoadInt64(&s.Proxy.TCP.Sent), atomic.LoadInt64(&s.Proxy.TCP.Flushes)
+			nullRate, unmatchedRate := s.Consensus.SlotRates()
 			// items below may not appear in this order, see https://github.com/rs/zerolog/issues/50
 			tLogger.Warn().
 				Uint32("Svr Id", s.SvrId).
@@ -186,9 +207,20 @@ func (s *Server) TerminalLogger() {
 				Int("Unmatched Slots", s.Consensus.UnmatchedSlots).
 				Int("NULL Slots", s.Consensus.NullSlots).
 				Int("Interval not-NULL Slots", thisNotNulls-lastNotNulls).
-				Float64("Interval throughput (cmd/sec)", throughput).Msg("")
+				Float64("Interval throughput (cmd/sec)", throughput).
+				Int("Queue depth", s.Consensus.QLen()).
+				Int64("Malformed conn.", malformed).
+				Float64("Interval net msgs/flush", perFlush(netSent-lastNetSent, netFlushes-lastNetFlushes)).
+				Float64("Interval proxy msgs/flush", perFlush(proxySent-lastProxySent, proxyFlushes-lastProxyFlushes)).
+				Float64("Interval executor idle (%)", idle).
+				Float64("NULL rate", math.Round(1000*nullRate)/1000).
+				Float64("Unmatched rate", math.Round(1000*unmatchedRate)/1000).
+				Interface("Proxy shares", s.Consensus.Shares()).Msg("")
 			lastNotNulls = thisNotNulls
 			lastCBProcessed = thisCBProcessed
+			lastIdle = thisIdle
+			lastNetSent, lastNetFlushes = netSent, netFlushes
+			lastProxySent, lastProxyFlushes = proxySent, proxyFlushes
 		}
 	}
 }